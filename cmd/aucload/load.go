@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zerozh/aucser/core"
+)
+
+// Arrival return offset in seconds of a request within a period of d seconds
+type Arrival func(rnd *rand.Rand, d float64) float64
+
+var arrivals = map[string]Arrival{
+	"uniform":    arrivalUniform,
+	"ramp":       arrivalRamp,
+	"lastminute": arrivalLastMinute,
+}
+
+func arrivalUniform(rnd *rand.Rand, d float64) float64 {
+	return rnd.Float64() * d
+}
+
+// arrivalRamp grow linearly toward the end
+func arrivalRamp(rnd *rand.Rand, d float64) float64 {
+	return math.Sqrt(rnd.Float64()) * d
+}
+
+// arrivalLastMinute mix normal distributions near the end like real auctions,
+// most bids arrive in the last 10 seconds
+func arrivalLastMinute(rnd *rand.Rand, d float64) float64 {
+	var mean, stddev float64
+	r := rnd.Intn(100)
+	if r > 80 {
+		mean, stddev = d-4.1, 1.1
+	} else if r > 32 {
+		mean, stddev = d-5.5, 1.5
+	} else if r > 15 {
+		mean, stddev = d-10, 2.5
+	} else {
+		mean, stddev = d-20, 15
+	}
+
+	for i := 0; i < 100; i++ {
+		if t := rnd.NormFloat64()*stddev + mean; t >= 0 && t <= d {
+			return t
+		}
+	}
+	return rnd.Float64() * d
+}
+
+// Strategy return price of second half bid based on current lowest price
+type Strategy func(rnd *rand.Rand, lowest, tick int) int
+
+var strategies = map[string]Strategy{
+	"lowest": strategyLowest,
+	"random": strategyRandom,
+	"max":    strategyMax,
+}
+
+// strategyLowest bid one tick above the lowest price
+func strategyLowest(rnd *rand.Rand, lowest, tick int) int {
+	return lowest + tick
+}
+
+// strategyRandom bid anywhere in the price range
+func strategyRandom(rnd *rand.Rand, lowest, tick int) int {
+	return lowest + (rnd.Intn(2*auccore.PricingDelta+1)-auccore.PricingDelta)*tick
+}
+
+// strategyMax bid the highest price of the range
+func strategyMax(rnd *rand.Rand, lowest, tick int) int {
+	return lowest + auccore.PricingDelta*tick
+}
+
+// Options of a load test
+type Options struct {
+	Bidders    int
+	BasePrice  int // first half price, spread over BaseSpread ticks
+	BaseSpread int
+	Rebids     int // second half bids per bidder, at most BidsPerBidder-1
+	Arrival    Arrival
+	Strategy   Strategy
+	Retries    int           // retries of transient errors with the same RequestID
+	Backoff    time.Duration // first retry delay, doubled each retry
+	Timeout    time.Duration // deadline of each request, 0 for none
+	Seed       int64
+}
+
+// Report summarize outcomes of all requests
+type Report struct {
+	sync.Mutex
+	Requests  int
+	Accepted  int
+	Retries   int
+	Codes     map[int]int
+	latencies []time.Duration
+	start     time.Time
+	end       time.Time
+}
+
+func newReport() *Report {
+	return &Report{Codes: make(map[int]int)}
+}
+
+func (r *Report) add(latency time.Duration, err error, retries int) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.Requests++
+	r.Retries += retries
+	r.latencies = append(r.latencies, latency)
+	if err == nil {
+		r.Accepted++
+		r.Codes[auccore.CodeSuccess]++
+	} else if e, ok := err.(auccore.Error); ok {
+		r.Codes[e.Code]++
+	} else {
+		r.Codes[-1]++
+	}
+}
+
+// Percentile return the latency of percentile p in [0, 100], after Load returned
+func (r *Report) Percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	if !sort.SliceIsSorted(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] }) {
+		sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+	}
+	idx := int(math.Ceil(p/100*float64(len(r.latencies)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return r.latencies[idx]
+}
+
+func (r *Report) String() string {
+	r.Lock()
+	defer r.Unlock()
+
+	d := r.end.Sub(r.start).Seconds()
+
+	s := fmt.Sprintf("requests %d, accepted %d, retries %d in %.1fs, %.1f req/s\n", r.Requests, r.Accepted, r.Retries, d, float64(r.Requests)/d)
+	s += fmt.Sprintf("latency p50 %s, p90 %s, p99 %s, max %s\n", r.Percentile(50), r.Percentile(90), r.Percentile(99), r.Percentile(100))
+
+	codes := make([]int, 0, len(r.Codes))
+	for code := range r.Codes {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		s += fmt.Sprintf("code %3d: %d\n", code, r.Codes[code])
+	}
+	return s
+}
+
+// Load drive exchange with bidders until EndTime
+func Load(e *auccore.Exchange, opt Options) *Report {
+	conf := e.Config()
+	report := newReport()
+	report.start = time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < opt.Bidders; i++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			bidder(e, conf, client, opt, report)
+		}(10000000 + i)
+	}
+	wg.Wait()
+	report.end = time.Now()
+
+	return report
+}
+
+func bidder(e *auccore.Exchange, conf *auccore.Config, client int, opt Options, report *Report) {
+	rnd := rand.New(rand.NewSource(opt.Seed + int64(client)))
+	tick := conf.Tick()
+
+	// first half
+	first := conf.HalfTime.Sub(conf.StartTime).Seconds()
+	at := conf.StartTime.Add(time.Duration(opt.Arrival(rnd, first) * float64(time.Second)))
+	time.Sleep(time.Until(at))
+	price := opt.BasePrice + rnd.Intn(opt.BaseSpread+1)*tick
+	request(e, auccore.BidRequest{Client: client, Price: price, RequestID: "1"}, opt, report)
+
+	// second half, EndTime may be extended by soft close but arrivals follow the original one
+	second := conf.EndTime.Sub(conf.HalfTime).Seconds()
+	offsets := make([]float64, opt.Rebids)
+	for i := range offsets {
+		offsets[i] = opt.Arrival(rnd, second)
+	}
+	sort.Float64s(offsets)
+	for i, offset := range offsets {
+		time.Sleep(time.Until(conf.HalfTime.Add(time.Duration(offset * float64(time.Second)))))
+		price := opt.Strategy(rnd, e.State().LowestPrice, tick)
+		request(e, auccore.BidRequest{Client: client, Price: price, RequestID: fmt.Sprint(i + 2)}, opt, report)
+	}
+}
+
+// request bid with retries of transient errors
+func request(e *auccore.Exchange, req auccore.BidRequest, opt Options, report *Report) {
+	tInit := time.Now()
+	backoff := opt.Backoff
+
+	var err error
+	retries := 0
+	for {
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if opt.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, opt.Timeout)
+		}
+		_, err = e.BidContext(ctx, req)
+		cancel()
+
+		if err == nil || !auccore.IsTransientError(err) || retries >= opt.Retries {
+			break
+		}
+		retries++
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	report.add(time.Since(tInit), err, retries)
+}
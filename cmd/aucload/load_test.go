@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zerozh/aucser/core"
+)
+
+func TestArrivals(t *testing.T) {
+	const d, n = 60.0, 10000
+	for name, arrival := range arrivals {
+		rnd := rand.New(rand.NewSource(1))
+		late := 0
+		for i := 0; i < n; i++ {
+			offset := arrival(rnd, d)
+			if offset < 0 || offset > d {
+				t.Fatalf("%s: offset %f out of period", name, offset)
+			}
+			if offset > d-10 {
+				late++
+			}
+		}
+
+		// share of arrivals in the last 10 seconds
+		share := float64(late) / n
+		if name == "uniform" && (share < 0.14 || share > 0.19) {
+			t.Errorf("uniform: last 10s share %.2f", share)
+		} else if name == "ramp" && (share < 0.28 || share > 0.33) {
+			t.Errorf("ramp: last 10s share %.2f", share)
+		} else if name == "lastminute" && share < 0.7 {
+			t.Errorf("lastminute: last 10s share %.2f", share)
+		}
+	}
+}
+
+func TestArrivalSeed(t *testing.T) {
+	a, b := rand.New(rand.NewSource(7)), rand.New(rand.NewSource(7))
+	for i := 0; i < 100; i++ {
+		if arrivalLastMinute(a, 60) != arrivalLastMinute(b, 60) {
+			t.Fatal("arrivals differ with the same seed")
+		}
+	}
+}
+
+func TestReportPercentile(t *testing.T) {
+	r := newReport()
+	if r.Percentile(50) != 0 {
+		t.Error("percentile of empty report")
+	}
+	for i := 100; i >= 1; i-- {
+		r.add(time.Duration(i)*time.Millisecond, nil, 0)
+	}
+
+	for p, want := range map[float64]time.Duration{0: 1, 50: 50, 90: 90, 99: 99, 100: 100} {
+		if got := r.Percentile(p); got != want*time.Millisecond {
+			t.Errorf("p%v %s, want %s", p, got, want*time.Millisecond)
+		}
+	}
+}
+
+func TestReportCodes(t *testing.T) {
+	r := newReport()
+	r.add(time.Millisecond, nil, 0)
+	r.add(time.Millisecond, nil, 1)
+	r.add(time.Millisecond, auccore.Error{Code: auccore.CodeRequestOutOfRange, Message: "Out of Range"}, 0)
+	r.add(time.Millisecond, auccore.Error{Code: auccore.CodeServerSaveError1, Message: "Save err"}, 2)
+	r.add(time.Millisecond, errors.New("unknown"), 0)
+	r.start = time.Now()
+	r.end = r.start.Add(time.Second)
+
+	if r.Requests != 5 || r.Accepted != 2 || r.Retries != 3 {
+		t.Errorf("unexpected report %d %d %d", r.Requests, r.Accepted, r.Retries)
+	}
+	want := map[int]int{auccore.CodeSuccess: 2, auccore.CodeRequestOutOfRange: 1, auccore.CodeServerSaveError1: 1, -1: 1}
+	for code, n := range want {
+		if r.Codes[code] != n {
+			t.Errorf("code %d: %d, want %d", code, r.Codes[code], n)
+		}
+	}
+
+	s := r.String()
+	if !strings.Contains(s, "requests 5, accepted 2, retries 3") || !strings.Contains(s, "code  21: 1") || !strings.Contains(s, "code  -1: 1") {
+		t.Error("unexpected report", s)
+	}
+}
@@ -0,0 +1,93 @@
+// Command aucload drive an in-process Exchange with simulated bidders,
+// report throughput, latency percentiles and error codes.
+//
+// Warehouse is selected by DB_DRIVER like the server, memory warehouse by default.
+// Only in-process load is supported, the exchange has no network API to drive remotely.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/zerozh/aucser/core"
+)
+
+func main() {
+	bidders := flag.Int("bidders", 10000, "number of bidders")
+	capacity := flag.Int("capacity", 1000, "number of plates")
+	first := flag.Duration("first", time.Minute, "duration of first half")
+	second := flag.Duration("second", time.Minute, "duration of second half")
+	delay := flag.Duration("delay", time.Second, "delay before StartTime")
+	basePrice := flag.Int("price", 80000, "base price of first half")
+	baseSpread := flag.Int("spread", 100, "first half prices spread over ticks above base price")
+	tickSize := flag.Int("tick", 100, "Config.TickSize")
+	rebids := flag.Int("rebids", auccore.BidsPerBidder-1, "second half bids per bidder")
+	arrival := flag.String("arrival", "lastminute", "arrival curve: uniform, ramp, lastminute")
+	strategy := flag.String("strategy", "random", "second half price strategy: lowest, random, max")
+	retries := flag.Int("retries", 2, "retries of transient errors")
+	backoff := flag.Duration("backoff", time.Millisecond*50, "first retry delay, doubled each retry")
+	timeout := flag.Duration("timeout", 0, "deadline of each request, 0 for none")
+	seed := flag.Int64("seed", 1, "random seed of bidders and memory warehouse latency")
+	latency := flag.String("latency", "default", "latency model of memory warehouse, eg, constant:15ms, normal:15ms,3ms, lognormal:15ms,0.5, empirical:file, queue:10ms,0.9")
+	pool := flag.Int("pool", 12000/44, "concurrent requests of memory warehouse")
+	flag.Parse()
+
+	opt := Options{
+		Bidders:    *bidders,
+		BasePrice:  *basePrice,
+		BaseSpread: *baseSpread,
+		Rebids:     *rebids,
+		Arrival:    arrivals[*arrival],
+		Strategy:   strategies[*strategy],
+		Retries:    *retries,
+		Backoff:    *backoff,
+		Timeout:    *timeout,
+		Seed:       *seed,
+	}
+	if opt.Arrival == nil || opt.Strategy == nil {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if opt.Rebids >= auccore.BidsPerBidder {
+		opt.Rebids = auccore.BidsPerBidder - 1
+	}
+
+	// memory warehouse is configured by env
+	os.Setenv("SIM_LATENCY", *latency)
+	os.Setenv("SIM_SEED", fmt.Sprint(*seed))
+	os.Setenv("SIM_POOL", fmt.Sprint(*pool))
+
+	// Exchange logs to ./logs
+	if err := os.MkdirAll("logs", 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	start := time.Now().Add(*delay)
+	conf := auccore.Config{
+		StartTime: start,
+		HalfTime:  start.Add(*first),
+		EndTime:   start.Add(*first + *second),
+		Capacity:  *capacity,
+		TickSize:  *tickSize,
+	}
+	e, err := auccore.NewExchange(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go e.Serve()
+
+	report := Load(e, opt)
+	for e.Session() < auccore.SessionFinished {
+		time.Sleep(time.Millisecond * 100)
+	}
+	final := e.Seal()
+	e.Close()
+
+	fmt.Print(report)
+	if final != nil {
+		fmt.Printf("final: allocated %d / %d, lowest price %d @ %s\n", final.Allocated, final.Capacity, final.LowestPrice, final.LowestTime.Format("15:04:05.000"))
+	}
+}
@@ -0,0 +1,442 @@
+package auccore
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Archive keep results of completed auctions after Seal
+type Archive interface {
+	Save(r *AuctionRecord) error // replace the auction if saved before
+	List() ([]AuctionSummary, error)
+	Get(id string) (*AuctionRecord, error) // nil if not found
+}
+
+// AuctionRecord is everything of a sealed auction
+type AuctionRecord struct {
+	ID       string
+	Config   Config
+	Final    *Final // nil if no one succeed
+	Bids     []ArchivedBid
+	States   []State // collected per second
+	SealedAt time.Time
+}
+
+// ArchivedBid is a bid with final status
+type ArchivedBid struct {
+	Serial    int
+	Client    int
+	Price     int
+	Time      time.Time
+	Sequence  int
+	Active    bool
+	Withdrawn bool
+	Won       bool
+	RequestID string
+	SourceIP  string
+}
+
+// AuctionSummary is a row of auction list
+type AuctionSummary struct {
+	ID          string
+	StartTime   time.Time
+	EndTime     time.Time
+	Capacity    int
+	Allocated   int
+	Bidders     int
+	LowestPrice int
+}
+
+func newAuctionSummary(r *AuctionRecord) AuctionSummary {
+	s := AuctionSummary{ID: r.ID, StartTime: r.Config.StartTime, EndTime: r.Config.EndTime, Capacity: r.Config.Capacity}
+	if r.Final != nil {
+		s.Allocated = r.Final.Allocated
+		s.Bidders = r.Final.Bidders
+		s.LowestPrice = r.Final.LowestPrice
+	}
+	return s
+}
+
+// newAuctionID return pid with a random suffix
+func newAuctionID(pid string) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return pid + "-" + hex.EncodeToString(b)
+}
+
+// AuctionID return the id of auction in archive
+func (e *Exchange) AuctionID() string {
+	return e.auctionID
+}
+
+// SetArchive save the auction to archive after sealing, must be called before Seal
+func (e *Exchange) SetArchive(a Archive) {
+	e.archive = a
+}
+
+// auctionRecord build record of sealed exchange
+func (e *Exchange) auctionRecord(final *Final) *AuctionRecord {
+	r := &AuctionRecord{ID: e.auctionID, Config: *e.Config(), Final: final, SealedAt: time.Now()}
+
+	e.statLock.RLock()
+	r.States = append([]State(nil), e.history...)
+	e.statLock.RUnlock()
+
+	e.store.RLock()
+	defer e.store.RUnlock()
+	won := make(map[*Bid]bool, len(e.store.FinalBids))
+	for _, bid := range e.store.FinalBids {
+		won[bid] = true
+	}
+	for _, key := range e.store.BidderChain.Index {
+		for _, bid := range e.store.BidderChain.Blocks[key].Bids {
+			r.Bids = append(r.Bids, ArchivedBid{
+				Serial:    bid.Serial,
+				Client:    bid.Client,
+				Price:     bid.Price,
+				Time:      bid.Time,
+				Sequence:  bid.Sequence,
+				Active:    bid.Active,
+				Withdrawn: bid.Withdrawn,
+				Won:       won[bid],
+				RequestID: bid.RequestID,
+				SourceIP:  bid.SourceIP,
+			})
+		}
+	}
+	sort.Slice(r.Bids, func(i, j int) bool {
+		if r.Bids[i].Client != r.Bids[j].Client {
+			return r.Bids[i].Client < r.Bids[j].Client
+		}
+		return r.Bids[i].Sequence < r.Bids[j].Sequence
+	})
+	return r
+}
+
+// MemoryArchive keep auctions in memory, for debug and test
+type MemoryArchive struct {
+	lock     sync.RWMutex
+	auctions map[string]*AuctionRecord
+}
+
+func NewMemoryArchive() *MemoryArchive {
+	return &MemoryArchive{auctions: make(map[string]*AuctionRecord)}
+}
+
+func (a *MemoryArchive) Save(r *AuctionRecord) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.auctions[r.ID] = r
+	return nil
+}
+
+// List return auctions in StartTime DESC order
+func (a *MemoryArchive) List() ([]AuctionSummary, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	list := make([]AuctionSummary, 0, len(a.auctions))
+	for _, r := range a.auctions {
+		list = append(list, newAuctionSummary(r))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartTime.After(list[j].StartTime) })
+	return list, nil
+}
+
+func (a *MemoryArchive) Get(id string) (*AuctionRecord, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return a.auctions[id], nil
+}
+
+// archive tables, time is saved as unix microseconds, free of time zone
+func archiveTables(s schema, suffix string) []string {
+	return []string{
+		`CREATE TABLE IF NOT EXISTS ` + s.prefix + `auction (
+			id VARCHAR(32) NOT NULL,
+			start_time BIGINT NOT NULL,
+			half_time BIGINT NOT NULL,
+			end_time BIGINT NOT NULL,
+			capacity INT NOT NULL,
+			warning_price INT NOT NULL,
+			reserve_price INT NOT NULL,
+			tick_size INT NOT NULL,
+			price_unit INT NOT NULL,
+			config TEXT NOT NULL,
+			judged BOOLEAN NOT NULL,
+			allocated INT NOT NULL,
+			bidders INT NOT NULL,
+			lowest_price INT NOT NULL,
+			lowest_time BIGINT NOT NULL,
+			lowest_sequence INT NOT NULL,
+			average_price INT NOT NULL,
+			sealed_at BIGINT NOT NULL,
+			PRIMARY KEY (id))` + suffix + `;`,
+		`CREATE TABLE IF NOT EXISTS ` + s.prefix + `auction_bid (
+			auction_id VARCHAR(32) NOT NULL,
+			client INT NOT NULL,
+			sequence SMALLINT NOT NULL,
+			serial BIGINT NOT NULL,
+			price INT NOT NULL,
+			ts BIGINT NOT NULL,
+			active BOOLEAN NOT NULL,
+			withdrawn BOOLEAN NOT NULL,
+			won BOOLEAN NOT NULL,
+			request_id VARCHAR(64) NULL,
+			source_ip VARCHAR(45) NULL,
+			PRIMARY KEY (auction_id, client, sequence))` + suffix + `;`,
+		`CREATE TABLE IF NOT EXISTS ` + s.prefix + `auction_state (
+			auction_id VARCHAR(32) NOT NULL,
+			ts BIGINT NOT NULL,
+			session SMALLINT NOT NULL,
+			end_time BIGINT NOT NULL,
+			lowest_price INT NOT NULL,
+			lowest_time BIGINT NOT NULL,
+			bidders INT NOT NULL,
+			PRIMARY KEY (auction_id, ts))` + suffix + `;`,
+	}
+}
+
+var postgresArchiveMigrations = []Migration{
+	{1, "create archive tables", func(s schema) []string {
+		return append(archiveTables(s, ""),
+			`CREATE INDEX IF NOT EXISTS `+s.prefix+`auction_start ON `+s.prefix+`auction (start_time);`,
+			`CREATE INDEX IF NOT EXISTS `+s.prefix+`auction_bid_client ON `+s.prefix+`auction_bid (client);`)
+	}},
+}
+
+var mysqlArchiveMigrations = []Migration{
+	{1, "create archive tables", func(s schema) []string {
+		return append(archiveTables(s, " ENGINE = InnoDB"),
+			`ALTER TABLE `+s.prefix+`auction ADD INDEX idx_start (start_time);`,
+			`ALTER TABLE `+s.prefix+`auction_bid ADD INDEX idx_client (client);`)
+	}},
+}
+
+// SQLArchive keep auctions in long-lived tables of MySQL or Postgres, shared by all auctions
+type SQLArchive struct {
+	driver string // mysql or postgres
+	db     *sql.DB
+	schema schema
+	once   sync.Once
+	err    error
+}
+
+// NewSQLArchive create archive of driver mysql or postgres, tables are prefixed, eg, auc_
+func NewSQLArchive(driver string, db *sql.DB, prefix string) *SQLArchive {
+	return &SQLArchive{driver: driver, db: db, schema: newSchema(prefix, "InnoDB")}
+}
+
+// Initialize migrate archive tables, called by Save, List and Get if not yet
+func (a *SQLArchive) Initialize() error {
+	a.once.Do(func() {
+		if a.driver == "postgres" {
+			_, a.err = migrate(a.db, a.schema, postgresArchiveMigrations, `CREATE TABLE IF NOT EXISTS `+a.schema.version+` (
+			version INT PRIMARY KEY,
+			description VARCHAR(255),
+			ts TIMESTAMP(6) DEFAULT now());`, true)
+		} else {
+			_, a.err = migrate(a.db, a.schema, mysqlArchiveMigrations, `CREATE TABLE IF NOT EXISTS `+a.schema.version+` (
+			version INT(10) UNSIGNED NOT NULL,
+			description VARCHAR(255),
+			ts TIMESTAMP(6) DEFAULT CURRENT_TIMESTAMP(6),
+			PRIMARY KEY (version)) ENGINE = InnoDB;`, false)
+		}
+	})
+	return a.err
+}
+
+// bind replace ? by $n for postgres
+func (a *SQLArchive) bind(query string) string {
+	if a.driver != "postgres" {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+func (a *SQLArchive) Save(r *AuctionRecord) error {
+	if err := a.Initialize(); err != nil {
+		return err
+	}
+	conf, err := json.Marshal(r.Config)
+	if err != nil {
+		return err
+	}
+	final := r.Final
+	if final == nil {
+		final = &Final{}
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	p := a.schema.prefix
+	for _, table := range []string{"auction_state", "auction_bid"} {
+		if _, err := tx.Exec(a.bind("DELETE FROM "+p+table+" WHERE auction_id = ?"), r.ID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(a.bind("DELETE FROM "+p+"auction WHERE id = ?"), r.ID); err != nil {
+		return err
+	}
+
+	c := r.Config
+	if _, err := tx.Exec(a.bind("INSERT INTO "+p+"auction (id, start_time, half_time, end_time, capacity, warning_price, reserve_price, tick_size, price_unit, config, "+
+		"judged, allocated, bidders, lowest_price, lowest_time, lowest_sequence, average_price, sealed_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+		r.ID, unixMicro(c.StartTime), unixMicro(c.HalfTime), unixMicro(c.EndTime), c.Capacity, c.WarningPrice, c.ReservePrice, c.TickSize, c.PriceUnit, string(conf),
+		r.Final != nil, final.Allocated, final.Bidders, final.LowestPrice, unixMicro(final.LowestTime), final.LowestSequence, final.AveragePrice, unixMicro(r.SealedAt)); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(a.bind("INSERT INTO " + p + "auction_bid (auction_id, client, sequence, serial, price, ts, active, withdrawn, won, request_id, source_ip) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, bid := range r.Bids {
+		if _, err := stmt.Exec(r.ID, bid.Client, bid.Sequence, bid.Serial, bid.Price, unixMicro(bid.Time), bid.Active, bid.Withdrawn, bid.Won, nullString(bid.RequestID), nullString(bid.SourceIP)); err != nil {
+			return err
+		}
+	}
+
+	stmtState, err := tx.Prepare(a.bind("INSERT INTO " + p + "auction_state (auction_id, ts, session, end_time, lowest_price, lowest_time, bidders) VALUES (?, ?, ?, ?, ?, ?, ?)"))
+	if err != nil {
+		return err
+	}
+	defer stmtState.Close()
+	for _, s := range r.States {
+		if _, err := stmtState.Exec(r.ID, unixMicro(s.Time), s.Session, unixMicro(s.EndTime), s.LowestPrice, unixMicro(s.LowestTime), s.Bidders); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// List return auctions in StartTime DESC order
+func (a *SQLArchive) List() ([]AuctionSummary, error) {
+	if err := a.Initialize(); err != nil {
+		return nil, err
+	}
+
+	rows, err := a.db.Query("SELECT id, start_time, end_time, capacity, allocated, bidders, lowest_price FROM " + a.schema.prefix + "auction ORDER BY start_time DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []AuctionSummary
+	for rows.Next() {
+		var s AuctionSummary
+		var start, end int64
+		if err := rows.Scan(&s.ID, &start, &end, &s.Capacity, &s.Allocated, &s.Bidders, &s.LowestPrice); err != nil {
+			return nil, err
+		}
+		s.StartTime, s.EndTime = fromUnixMicro(start), fromUnixMicro(end)
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+func (a *SQLArchive) Get(id string) (*AuctionRecord, error) {
+	if err := a.Initialize(); err != nil {
+		return nil, err
+	}
+	p := a.schema.prefix
+
+	r := &AuctionRecord{ID: id}
+	var conf string
+	var judged bool
+	var lowestTime, sealedAt int64
+	final := &Final{}
+	err := a.db.QueryRow(a.bind("SELECT config, judged, allocated, bidders, lowest_price, lowest_time, lowest_sequence, average_price, sealed_at FROM "+p+"auction WHERE id = ?"), id).
+		Scan(&conf, &judged, &final.Allocated, &final.Bidders, &final.LowestPrice, &lowestTime, &final.LowestSequence, &final.AveragePrice, &sealedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(conf), &r.Config); err != nil {
+		return nil, err
+	}
+	if judged {
+		final.Capacity = r.Config.Capacity
+		final.LowestTime = fromUnixMicro(lowestTime)
+		r.Final = final
+	}
+	r.SealedAt = fromUnixMicro(sealedAt)
+
+	rows, err := a.db.Query(a.bind("SELECT client, sequence, serial, price, ts, active, withdrawn, won, request_id, source_ip FROM "+p+"auction_bid WHERE auction_id = ? ORDER BY client, sequence"), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var bid ArchivedBid
+		var ts int64
+		var requestID, sourceIP sql.NullString
+		if err := rows.Scan(&bid.Client, &bid.Sequence, &bid.Serial, &bid.Price, &ts, &bid.Active, &bid.Withdrawn, &bid.Won, &requestID, &sourceIP); err != nil {
+			return nil, err
+		}
+		bid.Time = fromUnixMicro(ts)
+		bid.RequestID, bid.SourceIP = requestID.String, sourceIP.String
+		r.Bids = append(r.Bids, bid)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rowsState, err := a.db.Query(a.bind("SELECT ts, session, end_time, lowest_price, lowest_time, bidders FROM "+p+"auction_state WHERE auction_id = ? ORDER BY ts"), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rowsState.Close()
+	for rowsState.Next() {
+		var s State
+		var ts, end, lowest int64
+		if err := rowsState.Scan(&ts, &s.Session, &end, &s.LowestPrice, &lowest, &s.Bidders); err != nil {
+			return nil, err
+		}
+		s.Time, s.EndTime, s.LowestTime = fromUnixMicro(ts), fromUnixMicro(end), fromUnixMicro(lowest)
+		r.States = append(r.States, s)
+	}
+	return r, rowsState.Err()
+}
+
+// unixMicro return microseconds since epoch, 0 for zero time
+func unixMicro(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Microsecond)
+}
+
+func fromUnixMicro(v int64) time.Time {
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, v*int64(time.Microsecond))
+}
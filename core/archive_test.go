@@ -0,0 +1,303 @@
+package auccore
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeArchiveDB keep rows of archive tables in memory, only statements of SQLArchive are understood,
+// DDL and version records of migrate are ignored
+type fakeArchiveDB struct {
+	sync.Mutex
+	tables map[string][]map[string]driver.Value
+}
+
+var fakeArchiveDBs sync.Map
+
+var (
+	archiveInsert = regexp.MustCompile(`^INSERT INTO (\w+) \(([^)]*)\) VALUES`)
+	archiveDelete = regexp.MustCompile(`^DELETE FROM (\w+) WHERE (\w+) = (?:\?|\$1)$`)
+	archiveSelect = regexp.MustCompile(`^SELECT (.+?) FROM (\w+)(?: WHERE (\w+) = (?:\?|\$1))?(?: ORDER BY (.+))?$`)
+)
+
+type fakeArchiveDriver struct{}
+
+func (fakeArchiveDriver) Open(name string) (driver.Conn, error) {
+	db, _ := fakeArchiveDBs.Load(name)
+	return &fakeArchiveConn{db: db.(*fakeArchiveDB)}, nil
+}
+
+type fakeArchiveConn struct {
+	db *fakeArchiveDB
+}
+
+func (c *fakeArchiveConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeArchiveStmt{db: c.db, query: query}, nil
+}
+func (c *fakeArchiveConn) Close() error              { return nil }
+func (c *fakeArchiveConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *fakeArchiveConn) Commit() error             { return nil }
+func (c *fakeArchiveConn) Rollback() error           { return nil }
+
+type fakeArchiveStmt struct {
+	db    *fakeArchiveDB
+	query string
+}
+
+func (s *fakeArchiveStmt) Close() error  { return nil }
+func (s *fakeArchiveStmt) NumInput() int { return -1 }
+
+func (s *fakeArchiveStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db := s.db
+	db.Lock()
+	defer db.Unlock()
+
+	if m := archiveInsert.FindStringSubmatch(s.query); m != nil && len(args) > 0 {
+		cols := strings.Split(m[2], ", ")
+		if len(cols) != len(args) {
+			return nil, fmt.Errorf("%d columns, %d values", len(cols), len(args))
+		}
+		row := make(map[string]driver.Value, len(cols))
+		for i, col := range cols {
+			row[col] = args[i]
+		}
+		db.tables[m[1]] = append(db.tables[m[1]], row)
+	} else if m := archiveDelete.FindStringSubmatch(s.query); m != nil {
+		var kept []map[string]driver.Value
+		for _, row := range db.tables[m[1]] {
+			if row[m[2]] != args[0] {
+				kept = append(kept, row)
+			}
+		}
+		db.tables[m[1]] = kept
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeArchiveStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := s.db
+	db.Lock()
+	defer db.Unlock()
+
+	if strings.HasPrefix(s.query, "SELECT COALESCE(MAX(version), 0)") {
+		return &fakeArchiveRows{cols: []string{"version"}, rows: []map[string]driver.Value{{"version": int64(0)}}}, nil
+	}
+	m := archiveSelect.FindStringSubmatch(s.query)
+	if m == nil {
+		return nil, fmt.Errorf("unexpected query %s", s.query)
+	}
+
+	r := &fakeArchiveRows{cols: strings.Split(m[1], ", ")}
+	for _, row := range db.tables[m[2]] {
+		if m[3] == "" || row[m[3]] == args[0] {
+			r.rows = append(r.rows, row)
+		}
+	}
+	// order by integer columns
+	if m[4] != "" {
+		orders := strings.Split(m[4], ", ")
+		sort.SliceStable(r.rows, func(i, j int) bool {
+			for _, order := range orders {
+				col, desc := strings.TrimSuffix(order, " DESC"), strings.HasSuffix(order, " DESC")
+				a, b := r.rows[i][col].(int64), r.rows[j][col].(int64)
+				if a != b {
+					return (a < b) != desc
+				}
+			}
+			return false
+		})
+	}
+	return r, nil
+}
+
+type fakeArchiveRows struct {
+	cols []string
+	rows []map[string]driver.Value
+}
+
+func (r *fakeArchiveRows) Columns() []string { return r.cols }
+func (r *fakeArchiveRows) Close() error      { return nil }
+func (r *fakeArchiveRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	for i, col := range r.cols {
+		v, ok := r.rows[0][col]
+		if !ok {
+			return fmt.Errorf("unknown column %s", col)
+		}
+		dest[i] = v
+	}
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func init() {
+	sql.Register("fakearchive", fakeArchiveDriver{})
+}
+
+func TestArchive(t *testing.T) {
+	now := time.Now()
+	e := newServingExchange(t, Config{
+		StartTime: now,
+		HalfTime:  now.Add(time.Millisecond * 1200),
+		EndTime:   now.Add(time.Millisecond * 1500),
+		Capacity:  1,
+	})
+	defer e.Close()
+	archive := NewMemoryArchive()
+	e.SetArchive(archive)
+
+	for client := 1; client <= 2; client++ {
+		if code := bidCode(e.Bid(BidRequest{Client: client, Price: 100 * client, SourceIP: "10.0.0.1"})); code != CodeSuccess {
+			t.Fatalf("bid, code %d", code)
+		}
+	}
+	for e.Session() < SessionFinished {
+		time.Sleep(time.Millisecond * 10)
+	}
+	e.Seal()
+
+	list, _ := archive.List()
+	if len(list) != 1 || list[0].ID != e.AuctionID() || list[0].LowestPrice != 200 || list[0].Allocated != 1 {
+		t.Fatalf("unexpected list %+v", list)
+	}
+	r, _ := archive.Get(e.AuctionID())
+	if r == nil || r.Final == nil || r.Config.Capacity != 1 {
+		t.Fatalf("unexpected record %+v", r)
+	}
+	if len(r.Bids) != 2 || r.Bids[0].Won || !r.Bids[1].Won || r.Bids[1].SourceIP != "10.0.0.1" {
+		t.Errorf("unexpected bids %+v", r.Bids)
+	}
+	if len(r.States) == 0 {
+		t.Error("states not archived")
+	}
+	if r, _ := archive.Get("none"); r != nil {
+		t.Error("get unknown auction")
+	}
+
+	// auctions starting in the same second share uuid
+	if id := newAuctionID(e.uuid); id == e.AuctionID() || !strings.HasPrefix(id, e.uuid) {
+		t.Errorf("auction id %s not unique", id)
+	}
+}
+
+func TestSQLArchive(t *testing.T) {
+	fakeSchemaDBs.Store(t.Name(), &fakeSchemaDB{})
+	db, _ := sql.Open("fakeschema", t.Name())
+	defer db.Close()
+
+	a := NewSQLArchive("postgres", db, "auc_")
+	if err := a.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if q := a.bind("SELECT * FROM t WHERE a = ? AND b = ?"); q != "SELECT * FROM t WHERE a = $1 AND b = $2" {
+		t.Errorf("unexpected bind %s", q)
+	}
+	if q := NewSQLArchive("mysql", db, "auc_").bind("a = ?"); q != "a = ?" {
+		t.Errorf("unexpected bind %s", q)
+	}
+
+	now := time.Now().Truncate(time.Microsecond)
+	if !fromUnixMicro(unixMicro(now)).Equal(now) || !fromUnixMicro(unixMicro(time.Time{})).IsZero() {
+		t.Error("unix microseconds not reversible")
+	}
+}
+
+func TestSQLArchiveRoundTrip(t *testing.T) {
+	now := time.Now().Truncate(time.Microsecond)
+	conf := Config{StartTime: now, HalfTime: now.Add(time.Minute * 30), EndTime: now.Add(time.Hour), Capacity: 1, ReservePrice: 100, TickSize: 100}
+	record := &AuctionRecord{
+		ID:     "a1",
+		Config: conf,
+		Final:  &Final{Capacity: 1, Allocated: 1, Bidders: 2, LowestPrice: 300, LowestTime: now.Add(time.Minute * 40), LowestSequence: 2, AveragePrice: 300},
+		Bids: []ArchivedBid{
+			{Serial: 1, Client: 1, Price: 200, Time: now.Add(time.Minute), Sequence: 1, Active: true, RequestID: "r1", SourceIP: "10.0.0.1"},
+			{Serial: 2, Client: 2, Price: 200, Time: now.Add(time.Minute * 2), Sequence: 1},
+			{Serial: 3, Client: 2, Price: 300, Time: now.Add(time.Minute * 40), Sequence: 2, Active: true, Won: true},
+			{Serial: 4, Client: 2, Price: 400, Time: now.Add(time.Minute * 41), Sequence: 3, Withdrawn: true},
+		},
+		States: []State{
+			{Time: now.Add(time.Second), Session: SessionFirstHalf, EndTime: conf.EndTime, Bidders: 1},
+			{Time: now.Add(time.Minute * 50), Session: SessionSecondHalf, EndTime: conf.EndTime, LowestPrice: 300, LowestTime: now.Add(time.Minute * 40), Bidders: 2},
+		},
+		SealedAt: now.Add(time.Hour + time.Second),
+	}
+	// earlier auction without result
+	unjudged := &AuctionRecord{ID: "a0", Config: Config{StartTime: now.Add(-time.Hour * 24), HalfTime: now.Add(-time.Hour * 23), EndTime: now.Add(-time.Hour * 22), Capacity: 5}, SealedAt: now}
+
+	for _, driverName := range []string{"postgres", "mysql"} {
+		name := t.Name() + driverName
+		fakeArchiveDBs.Store(name, &fakeArchiveDB{tables: make(map[string][]map[string]driver.Value)})
+		db, _ := sql.Open("fakearchive", name)
+		defer db.Close()
+		a := NewSQLArchive(driverName, db, "auc_")
+
+		// saved again replaces the auction
+		for _, r := range []*AuctionRecord{record, unjudged, record} {
+			if err := a.Save(r); err != nil {
+				t.Fatal(driverName, err)
+			}
+		}
+
+		list, err := a.List()
+		if err != nil {
+			t.Fatal(driverName, err)
+		}
+		if len(list) != 2 || list[0].ID != "a1" || list[1].ID != "a0" {
+			t.Fatalf("%s unexpected list %+v", driverName, list)
+		}
+		if s := list[0]; !s.StartTime.Equal(conf.StartTime) || !s.EndTime.Equal(conf.EndTime) || s.Capacity != 1 || s.Allocated != 1 || s.Bidders != 2 || s.LowestPrice != 300 {
+			t.Errorf("%s unexpected summary %+v", driverName, s)
+		}
+
+		r, err := a.Get("a1")
+		if err != nil || r == nil {
+			t.Fatal(driverName, r, err)
+		}
+		if r.Config.Capacity != 1 || r.Config.ReservePrice != 100 || !r.Config.HalfTime.Equal(conf.HalfTime) || !r.SealedAt.Equal(record.SealedAt) {
+			t.Errorf("%s unexpected record %+v", driverName, r)
+		}
+		if f := r.Final; f == nil || f.Capacity != 1 || f.Allocated != 1 || f.Bidders != 2 || f.LowestPrice != 300 ||
+			!f.LowestTime.Equal(record.Final.LowestTime) || f.LowestSequence != 2 || f.AveragePrice != 300 {
+			t.Errorf("%s unexpected final %+v", driverName, r.Final)
+		}
+		if len(r.Bids) != len(record.Bids) {
+			t.Fatalf("%s unexpected bids %+v", driverName, r.Bids)
+		}
+		for i, bid := range r.Bids {
+			want := record.Bids[i]
+			if bid.Time.Equal(want.Time) {
+				bid.Time = want.Time
+			}
+			if bid != want {
+				t.Errorf("%s bid %d %+v, want %+v", driverName, i, bid, want)
+			}
+		}
+		if len(r.States) != len(record.States) {
+			t.Fatalf("%s unexpected states %+v", driverName, r.States)
+		}
+		for i, s := range r.States {
+			want := record.States[i]
+			if !s.Time.Equal(want.Time) || s.Session != want.Session || !s.EndTime.Equal(want.EndTime) ||
+				s.LowestPrice != want.LowestPrice || !s.LowestTime.Equal(want.LowestTime) || s.Bidders != want.Bidders {
+				t.Errorf("%s state %d %+v, want %+v", driverName, i, s, want)
+			}
+		}
+
+		if r, err := a.Get("a0"); err != nil || r == nil || r.Final != nil || len(r.Bids) != 0 {
+			t.Errorf("%s unexpected unjudged record %+v, %v", driverName, r, err)
+		}
+		if r, err := a.Get("none"); err != nil || r != nil {
+			t.Errorf("%s get unknown auction %+v, %v", driverName, r, err)
+		}
+	}
+}
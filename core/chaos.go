@@ -0,0 +1,123 @@
+package auccore
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Chaos inject failures into MemoryWarehouse, zero value inject nothing
+type Chaos struct {
+	ErrorRate   float64       // probability of CodeServerSaveError* before saving
+	TimeoutRate float64       // probability of hanging Timeout then CodeServerSaveError0, like a driver timeout
+	Timeout     time.Duration // 0 for 1s
+	StallRate   float64       // probability of extra latency Stall before saving
+	Stall       time.Duration
+	Skew        time.Duration // warehouse clock minus local clock, applied to Bid.Time
+	Seed        int64
+}
+
+// chaosMonkey decide failures of each request
+type chaosMonkey struct {
+	sync.Mutex
+	Chaos
+	rnd *rand.Rand
+}
+
+func newChaosMonkey(c Chaos) *chaosMonkey {
+	if c.Timeout <= 0 {
+		c.Timeout = time.Second
+	}
+	return &chaosMonkey{Chaos: c, rnd: rand.New(rand.NewSource(c.Seed))}
+}
+
+// ChaosFromEnv read Chaos from env, false if not configured, eg,
+// CHAOS_ERROR_RATE=0.01 CHAOS_TIMEOUT_RATE=0.001 CHAOS_TIMEOUT=3s CHAOS_STALL_RATE=0.05 CHAOS_STALL=200ms CHAOS_SKEW=-20ms CHAOS_SEED=1
+func ChaosFromEnv() (Chaos, bool) {
+	var c Chaos
+	ok := false
+	rate := func(key string) float64 {
+		v, err := strconv.ParseFloat(os.Getenv(key), 64)
+		if err == nil {
+			ok = true
+		}
+		return v
+	}
+	duration := func(key string) time.Duration {
+		v, err := time.ParseDuration(os.Getenv(key))
+		if err == nil {
+			ok = true
+		}
+		return v
+	}
+
+	c.ErrorRate = rate("CHAOS_ERROR_RATE")
+	c.TimeoutRate = rate("CHAOS_TIMEOUT_RATE")
+	c.Timeout = duration("CHAOS_TIMEOUT")
+	c.StallRate = rate("CHAOS_STALL_RATE")
+	c.Stall = duration("CHAOS_STALL")
+	c.Skew = duration("CHAOS_SKEW")
+	c.Seed, _ = strconv.ParseInt(os.Getenv("CHAOS_SEED"), 10, 64)
+
+	return c, ok
+}
+
+func (m *chaosMonkey) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	return m.rnd.Float64() < rate
+}
+
+func (m *chaosMonkey) errorCode() int {
+	m.Lock()
+	defer m.Unlock()
+	return CodeServerSaveError0 + m.rnd.Intn(CodeServerSaveError4-CodeServerSaveError0+1)
+}
+
+// before run before saving, return injected error
+func (m *chaosMonkey) before(ctx context.Context) error {
+	if m.roll(m.StallRate) {
+		if err := sleepContext(ctx, m.Stall); err != nil {
+			return contextError(err)
+		}
+	}
+
+	if m.roll(m.TimeoutRate) {
+		if err := sleepContext(ctx, m.Timeout); err != nil {
+			return contextError(err)
+		}
+		return Error{Code: CodeServerSaveError0, Message: "Chaos timeout"}
+	}
+
+	if m.roll(m.ErrorRate) {
+		return Error{Code: m.errorCode(), Message: "Chaos error"}
+	}
+
+	return nil
+}
+
+// now return warehouse time
+func (m *chaosMonkey) now() time.Time {
+	return time.Now().Add(m.Skew)
+}
+
+// SetChaos inject failures to all later requests
+func (w *MemoryWarehouse) SetChaos(c Chaos) {
+	w.chaosLock.Lock()
+	w.chaos = newChaosMonkey(c)
+	w.chaosLock.Unlock()
+}
+
+func (w *MemoryWarehouse) monkey() *chaosMonkey {
+	w.chaosLock.RLock()
+	defer w.chaosLock.RUnlock()
+
+	return w.chaos
+}
@@ -0,0 +1,218 @@
+package auccore
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ShardOf return the node index of client in cluster mode.
+// For a power of two shards up to TableShards it equals (client & (TableShards-1)) % shards,
+// the table sharding of warehouse, so clients of a node fill TableShards/shards of its tables.
+// Other counts use modulo instead of the mask, which would leave nodes beyond TableShards
+// without clients and balance counts like 3 unevenly; each node has its own tables anyway
+func ShardOf(client, shards int) int {
+	shard := client % shards
+	if shard < 0 {
+		shard += shards
+	}
+	return shard
+}
+
+// ownClient check the client belongs to this node in cluster mode
+func (e *Exchange) ownClient(client int) bool {
+	return e.config.ShardCount == 0 || ShardOf(client, e.config.ShardCount) == e.config.ShardIndex
+}
+
+// Coordinator merge price histograms of all nodes in cluster mode,
+// compute global TailBid and push lowest price to every node for the price range of second half
+type Coordinator struct {
+	Interval time.Duration // collect interval
+
+	config *Config
+	nodes  []*Exchange // index by Config.ShardIndex
+	log    *log.Logger
+
+	lock    sync.RWMutex
+	state   State
+	store   *Store // merged store at sealing
+	final   *Final
+	tailBid *Bid
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// NewCoordinator bind nodes created by NewExchange with Config.ShardCount = len(nodes)
+func NewCoordinator(conf Config, nodes []*Exchange, logger *log.Logger) *Coordinator {
+	return &Coordinator{
+		Interval: time.Millisecond * 100,
+		config:   &conf,
+		nodes:    nodes,
+		log:      logger,
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Node return the node accepting the client
+func (c *Coordinator) Node(client int) *Exchange {
+	return c.nodes[ShardOf(client, len(c.nodes))]
+}
+
+// Bid route bid to its node
+func (c *Coordinator) Bid(req BidRequest) (BidResult, error) {
+	return c.Node(req.Client).Bid(req)
+}
+
+// Serve collect state of nodes periodically until Close
+func (c *Coordinator) Serve() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Collect()
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// Close stop collecting
+func (c *Coordinator) Close() {
+	close(c.quit)
+	<-c.done
+}
+
+// Collect merge histograms of nodes, compute global TailBid and push to nodes
+func (c *Coordinator) Collect() {
+	hist := make(map[int]int)
+	bidders := 0
+	for _, node := range c.nodes {
+		for price, n := range node.store.Histogram() {
+			hist[price] += n
+		}
+		bidders += node.store.CountBidders()
+	}
+
+	prices := make([]int, 0, len(hist))
+	for price := range hist {
+		prices = append(prices, price)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(prices)))
+
+	// same as Store.updateState, but only the tail block is fetched from nodes
+	var tail *Bid
+	if bidders >= c.config.Capacity {
+		cnt := 0
+		for _, price := range prices {
+			if cnt+hist[price] >= c.config.Capacity {
+				var bids []Bid
+				for _, node := range c.nodes {
+					bids = append(bids, node.store.ActiveBids(price)...)
+				}
+				sort.SliceStable(bids, func(i, j int) bool { return bids[i].Time.Before(bids[j].Time) })
+				// no TailBid for Capacity 0
+				if offset := c.config.Capacity - cnt; offset > 0 && offset <= len(bids) {
+					tail = &bids[offset-1]
+				}
+				break
+			}
+			cnt += hist[price]
+		}
+	}
+
+	c.lock.Lock()
+	c.tailBid = tail
+	c.state.Time = time.Now()
+	c.state.Bidders = bidders
+	if tail != nil {
+		c.state.LowestPrice = tail.Price
+		c.state.LowestTime = tail.Time
+	} else if c.config.ReservePrice > 0 {
+		c.state.LowestPrice = c.config.ReservePrice
+	}
+	state := c.state
+	c.lock.Unlock()
+
+	for _, node := range c.nodes {
+		node.setLowest(state.LowestPrice, state.LowestTime, state.Bidders)
+	}
+}
+
+// State return the global state at last Collect
+func (c *Coordinator) State() *State {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	state := c.state
+	if len(c.nodes) > 0 {
+		state.Session = c.nodes[0].Session()
+		_, state.EndTime = c.nodes[0].schedule()
+	}
+	return &state
+}
+
+// Seal seal all nodes, merge active bids and judge final result globally,
+// successful bids are committed to the warehouse of their node,
+// must be called before Halt of nodes, return nil if any node fails to seal
+func (c *Coordinator) Seal() *Final {
+	for i, node := range c.nodes {
+		if node.terminated() {
+			if c.log != nil {
+				c.log.Printf("ERR:Coordinator node %d halted before Seal", i)
+			}
+			return nil
+		}
+	}
+	for _, node := range c.nodes {
+		node.Seal()
+	}
+
+	var bids []*Bid
+	for _, node := range c.nodes {
+		for _, price := range node.store.PriceChain.Index {
+			for _, bid := range node.store.ActiveBids(price) {
+				bidCopy := bid
+				bids = append(bids, &bidCopy)
+			}
+		}
+	}
+	sort.SliceStable(bids, func(i, j int) bool { return bids[i].Time.Before(bids[j].Time) })
+
+	store := NewStore(c.config.Capacity)
+	store.ReservePrice = c.config.ReservePrice
+	for _, bid := range bids {
+		store.Add(bid)
+	}
+	seq, avg := store.Judge()
+	for _, bid := range store.FinalBids {
+		c.Node(bid.Client).warehouse.Commit(context.Background(), bid)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.store = store
+	c.final = newFinal(c.config, store, store.CountBidders(), seq, avg)
+	if c.log != nil {
+		DumpAll(c.log, store)
+	}
+	return c.final
+}
+
+// SuccessfulBids list all successful bids of the cluster
+func (c *Coordinator) SuccessfulBids() []BidResult {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.store == nil {
+		return nil
+	}
+	return newBidResults(c.store.FinalBids)
+}
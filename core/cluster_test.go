@@ -0,0 +1,183 @@
+package auccore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCluster(t *testing.T) {
+	t.Setenv("DB_DRIVER", "")
+	now := time.Now()
+	conf := Config{
+		StartTime:  now,
+		HalfTime:   now.Add(time.Millisecond * 400),
+		EndTime:    now.Add(time.Second * 2),
+		Capacity:   3,
+		ShardCount: 2,
+	}
+
+	var nodes []*Exchange
+	for i := 0; i < conf.ShardCount; i++ {
+		nodeConf := conf
+		nodeConf.ShardIndex = i
+		node, err := NewExchange(nodeConf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go node.Serve()
+		nodes = append(nodes, node)
+	}
+	for i := 0; i < 100 && nodes[1].Session() == SessionUnprepared; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	c := NewCoordinator(conf, nodes, nil)
+
+	if code := bidCode(nodes[0].Bid(BidRequest{Client: 1, Price: 100})); code != CodeRequestWrongShard {
+		t.Errorf("bid to wrong shard, code %d", code)
+	}
+	for client, price := range map[int]int{1: 100, 2: 101, 3: 102, 4: 100, 5: 103} {
+		if _, err := c.Bid(BidRequest{Client: client, Price: price}); err != nil {
+			t.Error(err)
+		}
+	}
+	c.Collect()
+	if state := c.State(); state.LowestPrice != 101 || state.Bidders != 5 {
+		t.Errorf("unexpected state %+v", state)
+	}
+
+	// schedule extended while state is read
+	extended := conf.EndTime.Add(time.Second)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			c.State()
+		}
+	}()
+	for _, node := range nodes {
+		if err := node.Extend(time.Time{}, extended, "test"); err != nil {
+			t.Error(err)
+		}
+	}
+	<-done
+	if state := c.State(); !state.EndTime.Equal(extended) {
+		t.Errorf("state end time %s", state.EndTime)
+	}
+
+	time.Sleep(time.Until(conf.HalfTime.Add(time.Millisecond * 50)))
+	if _, err := c.Bid(BidRequest{Client: 4, Price: 104}); err != nil {
+		t.Error(err)
+	}
+	c.Collect()
+	if state := c.State(); state.LowestPrice != 102 {
+		t.Errorf("unexpected state %+v", state)
+	}
+	if code := bidCode(c.Bid(BidRequest{Client: 1, Price: 98})); code != CodeRequestOutOfRange {
+		t.Errorf("bid out of global range, code %d", code)
+	}
+
+	final := c.Seal()
+	if final == nil || final.LowestPrice != 102 || final.Allocated != 3 || final.Bidders != 5 {
+		t.Errorf("unexpected final %+v", final)
+	}
+	if len(c.SuccessfulBids()) != 3 {
+		t.Error("len(c.SuccessfulBids()) != 3")
+	}
+	for _, node := range nodes {
+		node.Halt()
+	}
+}
+
+func TestClusterSealAfterHalt(t *testing.T) {
+	t.Setenv("DB_DRIVER", "")
+	now := time.Now()
+	conf := Config{
+		StartTime:  now,
+		HalfTime:   now.Add(time.Millisecond * 400),
+		EndTime:    now.Add(time.Second * 2),
+		Capacity:   1,
+		ShardCount: 2,
+	}
+
+	var nodes []*Exchange
+	for i := 0; i < conf.ShardCount; i++ {
+		nodeConf := conf
+		nodeConf.ShardIndex = i
+		node, err := NewExchange(nodeConf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go node.Serve()
+		nodes = append(nodes, node)
+	}
+	for i := 0; i < 100 && nodes[1].Session() == SessionUnprepared; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	c := NewCoordinator(conf, nodes, nil)
+	c.Bid(BidRequest{Client: 1, Price: 100})
+	for _, node := range nodes {
+		node.Halt()
+	}
+
+	if final := c.Seal(); final != nil {
+		t.Errorf("sealed after warehouse terminated %+v", final)
+	}
+}
+
+func TestClusterZeroCapacity(t *testing.T) {
+	t.Setenv("DB_DRIVER", "")
+	now := time.Now()
+	conf := Config{
+		StartTime:  now,
+		HalfTime:   now.Add(time.Second),
+		EndTime:    now.Add(time.Second * 2),
+		ShardCount: 2,
+	}
+
+	var nodes []*Exchange
+	for i := 0; i < conf.ShardCount; i++ {
+		nodeConf := conf
+		nodeConf.ShardIndex = i
+		node, err := NewExchange(nodeConf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go node.Serve()
+		defer node.Halt()
+		nodes = append(nodes, node)
+	}
+	for i := 0; i < 100 && nodes[1].Session() == SessionUnprepared; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	c := NewCoordinator(conf, nodes, nil)
+	if _, err := c.Bid(BidRequest{Client: 1, Price: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Collect()
+	if state := c.State(); state.Bidders != 1 || state.LowestPrice != 0 {
+		t.Errorf("unexpected state %+v", state)
+	}
+}
+
+func TestShardOf(t *testing.T) {
+	for _, shards := range []int{1, 3, 10, 16} {
+		counts := make([]int, shards)
+		for client := 1; client <= shards*100; client++ {
+			counts[ShardOf(client, shards)]++
+		}
+		for i, n := range counts {
+			if n != 100 {
+				t.Errorf("shard %d of %d has %d clients", i, shards, n)
+			}
+		}
+	}
+	// same as table sharding of warehouse
+	for _, shards := range []int{1, 2, 4, TableShards} {
+		for client := -20; client <= 20; client++ {
+			if ShardOf(client, shards) != (client&(TableShards-1))%shards {
+				t.Errorf("client %d of %d shards differs from table", client, shards)
+			}
+		}
+	}
+}
@@ -1,34 +1,286 @@
 package auccore
 
 import (
+	"bufio"
+	"context"
 	"math"
 	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// LatencyModel return latency of a database write/read
+// inflight is the number of running requests including this one, pool is the size of pool
+type LatencyModel interface {
+	Latency(rnd *rand.Rand, inflight, pool int) time.Duration
+}
+
 // Simulate concurrent latency, specially for database concurrent write/read latency
 // typical latency of db write/read is 15ms, plus about 10ms for high concurrency
 type ConcurrencySimulator struct {
 	Threshold int
+	Model     LatencyModel
 	conLock   chan bool
+
+	rndLock sync.Mutex
+	rnd     *rand.Rand
 }
 
 func NewConcurrencySimulator(threshold int) *ConcurrencySimulator {
+	return NewConcurrencySimulatorWithModel(threshold/44, DefaultLatency{}, time.Now().UnixNano())
+}
+
+// NewConcurrencySimulatorWithModel create simulator with pool size, latency model and random seed,
+// same seed gives same latency sequence for reproducible runs
+func NewConcurrencySimulatorWithModel(pool int, model LatencyModel, seed int64) *ConcurrencySimulator {
+	if pool < 1 {
+		pool = 1
+	}
 	return &ConcurrencySimulator{
-		Threshold: threshold,
-		conLock:   make(chan bool, threshold/44),
+		Threshold: pool * 44,
+		Model:     model,
+		conLock:   make(chan bool, pool),
+		rnd:       rand.New(rand.NewSource(seed)),
 	}
 }
 
+// Simulation configure a ConcurrencySimulator, zero values for defaults
+type Simulation struct {
+	Pool  int          // concurrent requests, 12000/44 by default
+	Model LatencyModel // DefaultLatency by default
+	Seed  int64        // same seed gives same latency sequence
+}
+
+// Simulator create ConcurrencySimulator of the simulation
+func (s Simulation) Simulator() *ConcurrencySimulator {
+	pool, model := s.Pool, s.Model
+	if pool <= 0 {
+		pool = 12000 / 44
+	}
+	if model == nil {
+		model = DefaultLatency{}
+	}
+	return NewConcurrencySimulatorWithModel(pool, model, s.Seed)
+}
+
 // Run run time.Sleep simulating latency for each database write/read
 func (c *ConcurrencySimulator) Run() {
-	c.conLock <- true
-	c.run()
-	<-c.conLock
+	c.RunContext(context.Background())
+}
+
+// RunContext simulate latency like Run, return ctx.Err() once ctx is done
+func (c *ConcurrencySimulator) RunContext(ctx context.Context) error {
+	select {
+	case c.conLock <- true:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-c.conLock }()
+
+	return sleepContext(ctx, c.latency())
+}
+
+func (c *ConcurrencySimulator) latency() time.Duration {
+	c.rndLock.Lock()
+	defer c.rndLock.Unlock()
+
+	return c.Model.Latency(c.rnd, len(c.conLock), cap(c.conLock))
+}
+
+// sleepContext sleep d, return ctx.Err() if ctx is done before
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// DefaultLatency is 10~15ms plus contention growing logarithmically with inflight requests
+type DefaultLatency struct{}
+
+func (m DefaultLatency) Latency(rnd *rand.Rand, inflight, pool int) time.Duration {
+	t := float64(1) / (math.Log(float64(pool)/float64(inflight+1)) + 1)
+	return time.Millisecond*time.Duration(10+rnd.Intn(5)) + time.Microsecond*time.Duration(int64(10000*t))
+}
+
+// ConstantLatency always return D
+type ConstantLatency struct {
+	D time.Duration
+}
+
+func (m ConstantLatency) Latency(rnd *rand.Rand, inflight, pool int) time.Duration {
+	return m.D
+}
+
+// NormalLatency is normally distributed, never negative
+type NormalLatency struct {
+	Mean   time.Duration
+	StdDev time.Duration
+}
+
+func (m NormalLatency) Latency(rnd *rand.Rand, inflight, pool int) time.Duration {
+	d := time.Duration(rnd.NormFloat64()*float64(m.StdDev)) + m.Mean
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// LogNormalLatency is log-normally distributed with Median and shape Sigma, typical long tail of databases
+type LogNormalLatency struct {
+	Median time.Duration
+	Sigma  float64
+}
+
+func (m LogNormalLatency) Latency(rnd *rand.Rand, inflight, pool int) time.Duration {
+	return time.Duration(float64(m.Median) * math.Exp(rnd.NormFloat64()*m.Sigma))
 }
 
-func (c *ConcurrencySimulator) run() {
-	time.Sleep(time.Millisecond * time.Duration(10+rand.Intn(5)))
-	t := float64(1) / (math.Log(float64(cap(c.conLock))/float64(len(c.conLock)+1)) + 1)
-	time.Sleep(time.Microsecond * time.Duration(int64(10000*t)))
+// EmpiricalLatency sample latencies from a histogram
+type EmpiricalLatency struct {
+	latencies  []time.Duration // bucket value in ASC order
+	cumulative []int           // cumulative count of buckets
+}
+
+// NewEmpiricalLatency create model from histogram of latency and count
+func NewEmpiricalLatency(histogram map[time.Duration]int) *EmpiricalLatency {
+	m := &EmpiricalLatency{}
+	for d := range histogram {
+		m.latencies = append(m.latencies, d)
+	}
+	sort.Slice(m.latencies, func(i, j int) bool { return m.latencies[i] < m.latencies[j] })
+
+	total := 0
+	for _, d := range m.latencies {
+		total += histogram[d]
+		m.cumulative = append(m.cumulative, total)
+	}
+	return m
+}
+
+// LoadEmpiricalLatency load histogram from file, each line is "latency count", eg, "15ms 120",
+// empty lines and lines start with # are ignored
+func LoadEmpiricalLatency(name string) (*EmpiricalLatency, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	histogram := make(map[time.Duration]int)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, Error{Code: CodeRequestInvalid, Message: name + ":" + strconv.Itoa(line) + " invalid histogram line"}
+		}
+		d, err := time.ParseDuration(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		cnt, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		histogram[d] += cnt
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(histogram) == 0 {
+		return nil, Error{Code: CodeRequestInvalid, Message: name + " empty histogram"}
+	}
+
+	return NewEmpiricalLatency(histogram), nil
+}
+
+func (m *EmpiricalLatency) Latency(rnd *rand.Rand, inflight, pool int) time.Duration {
+	total := m.cumulative[len(m.cumulative)-1]
+	if total <= 0 {
+		return 0
+	}
+	n := rnd.Intn(total)
+	return m.latencies[sort.SearchInts(m.cumulative, n+1)]
+}
+
+// QueueLatency is exponential service time stretched by utilization like a M/M/1 queue,
+// latency = service / (1 - utilization), utilization is capped by Saturation
+type QueueLatency struct {
+	Service    time.Duration // mean service time without contention
+	Saturation float64       // max utilization in (0, 1), 0 for 0.95
+}
+
+func (m QueueLatency) Latency(rnd *rand.Rand, inflight, pool int) time.Duration {
+	saturation := m.Saturation
+	if saturation <= 0 || saturation >= 1 {
+		saturation = 0.95
+	}
+	rho := float64(inflight) / float64(pool)
+	if rho > saturation {
+		rho = saturation
+	}
+	return time.Duration(rnd.ExpFloat64() * float64(m.Service) / (1 - rho))
+}
+
+// ParseLatencyModel parse model from spec, eg,
+// "default", "constant:15ms", "normal:15ms,3ms", "lognormal:15ms,0.5", "empirical:latency.txt", "queue:10ms,0.9"
+func ParseLatencyModel(spec string) (LatencyModel, error) {
+	name, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, arg = spec[:i], spec[i+1:]
+	}
+	args := strings.Split(arg, ",")
+	invalid := Error{Code: CodeRequestInvalid, Message: "Invalid latency model " + spec}
+
+	if name == "" || name == "default" {
+		return DefaultLatency{}, nil
+	} else if name == "constant" {
+		d, err := time.ParseDuration(args[0])
+		if err != nil {
+			return nil, invalid
+		}
+		return ConstantLatency{D: d}, nil
+	} else if name == "normal" && len(args) == 2 {
+		mean, err1 := time.ParseDuration(args[0])
+		stddev, err2 := time.ParseDuration(args[1])
+		if err1 != nil || err2 != nil {
+			return nil, invalid
+		}
+		return NormalLatency{Mean: mean, StdDev: stddev}, nil
+	} else if name == "lognormal" && len(args) == 2 {
+		median, err1 := time.ParseDuration(args[0])
+		sigma, err2 := strconv.ParseFloat(args[1], 64)
+		if err1 != nil || err2 != nil {
+			return nil, invalid
+		}
+		return LogNormalLatency{Median: median, Sigma: sigma}, nil
+	} else if name == "empirical" {
+		return LoadEmpiricalLatency(arg)
+	} else if name == "queue" {
+		service, err := time.ParseDuration(args[0])
+		if err != nil {
+			return nil, invalid
+		}
+		m := QueueLatency{Service: service}
+		if len(args) > 1 {
+			if m.Saturation, err = strconv.ParseFloat(args[1], 64); err != nil {
+				return nil, invalid
+			}
+		}
+		return m, nil
+	}
+
+	return nil, invalid
 }
@@ -3,6 +3,7 @@ package auccore
 import (
 	"fmt"
 	"math/rand"
+	"os"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -105,3 +106,86 @@ func generateRequest(d float64) float64 {
 		}
 	}
 }
+
+func TestLatencyModel(t *testing.T) {
+	name := t.TempDir() + "/latency.txt"
+	if err := os.WriteFile(name, []byte("# latency count\n10ms 3\n20ms 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, spec := range []string{"default", "constant:15ms", "normal:15ms,3ms", "lognormal:15ms,0.5", "empirical:" + name, "queue:10ms,0.9"} {
+		model, err := ParseLatencyModel(spec)
+		if err != nil {
+			t.Fatal(spec, err)
+		}
+
+		// same seed, same latencies
+		rnd1, rnd2 := rand.New(rand.NewSource(7)), rand.New(rand.NewSource(7))
+		for i := 0; i < 100; i++ {
+			d1, d2 := model.Latency(rnd1, 1+i%10, 10), model.Latency(rnd2, 1+i%10, 10)
+			if d1 != d2 {
+				t.Errorf("%s not reproducible", spec)
+				break
+			}
+			if d1 < 0 {
+				t.Errorf("%s negative latency", spec)
+			}
+		}
+	}
+
+	if _, err := ParseLatencyModel("normal:15ms"); err == nil {
+		t.Error("invalid spec accepted")
+	}
+
+	// empirical latencies only from histogram
+	model, _ := LoadEmpiricalLatency(name)
+	rnd := rand.New(rand.NewSource(1))
+	cnt := map[time.Duration]int{}
+	for i := 0; i < 4000; i++ {
+		cnt[model.Latency(rnd, 1, 1)]++
+	}
+	if len(cnt) != 2 || cnt[time.Millisecond*10] < 2700 || cnt[time.Millisecond*10] > 3300 {
+		t.Errorf("unexpected empirical samples %v", cnt)
+	}
+
+	// queue latency grows with utilization
+	queue := QueueLatency{Service: time.Millisecond * 10}
+	var low, high time.Duration
+	rnd1, rnd2 := rand.New(rand.NewSource(1)), rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		low += queue.Latency(rnd1, 1, 100)
+		high += queue.Latency(rnd2, 100, 100)
+	}
+	if high < low*10 {
+		t.Errorf("queue latency not saturated, %s vs %s", low, high)
+	}
+
+	// simulator with seeded model
+	c := NewConcurrencySimulatorWithModel(4, ConstantLatency{D: time.Millisecond}, 1)
+	start := time.Now()
+	c.Run()
+	if time.Since(start) < time.Millisecond {
+		t.Error("simulator did not sleep")
+	}
+}
+
+func TestSimulation(t *testing.T) {
+	s := Simulation{}.Simulator()
+	if cap(s.conLock) != 12000/44 {
+		t.Errorf("default pool %d", cap(s.conLock))
+	}
+	if _, ok := s.Model.(DefaultLatency); !ok {
+		t.Error("default model is not DefaultLatency")
+	}
+
+	// default simulator of MemoryWarehouse is reproducible
+	w1, w2 := NewMemoryWarehouse(), NewMemoryWarehouse()
+	w1.Simulation.Seed, w2.Simulation.Seed = 7, 7
+	w1.Initialize()
+	w2.Initialize()
+	for i := 0; i < 100; i++ {
+		if w1.simulator.latency() != w2.simulator.latency() {
+			t.Fatal("latencies differ with the same seed")
+		}
+	}
+}
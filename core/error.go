@@ -1,9 +1,13 @@
 package auccore
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+)
 
 const (
 	CodeSuccess        = 0
+	CodeServerPaused   = 1
 	CodeServerNotReady = 2
 	CodeServerEnd      = 3
 
@@ -11,16 +15,27 @@ const (
 	CodeRequestInvalidPrice = 5
 	CodeRequestInvalidTime  = 6
 	CodeRequestNotAttend    = 7
+	CodeRequestLTReserve    = 9
+	CodeRequestInvalidTick  = 10
+	CodeRequestWrongShard   = 11
 
 	CodeRequestGTWarningPrice   = 12
 	CodeRequestAttendFirstRound = 13
 	CodeRequestEnd1             = 14
+	CodeRequestNotCommit        = 15
+	CodeRequestCommitMismatch   = 16
+	CodeRequestNotReveal        = 17
+	CodeRequestRevealWindow     = 18
+	CodeRequestTimeout          = 19
+	CodeRequestCanceled         = 20
 
 	CodeRequestOutOfRange          = 21
 	CodeRequestNotAttendFirstRound = 22
 	CodeRequestAllIn               = 23
 	CodeRequestSamePrice           = 24
 	CodeRequestEnd2                = 25
+	CodeRequestNotWithdrawable     = 26
+	CodeRequestWithdrawExpired     = 27
 
 	CodeServerSaveError0 = 30
 	CodeServerSaveError1 = 31
@@ -29,6 +44,11 @@ const (
 	CodeServerSaveError4 = 34
 	CodeServerSaveError5 = 35
 
+	CodeServerNotLeader      = 36
+	CodeServerReplicateError = 37
+	CodeServerUnavailable    = 38
+	CodeServerInvalidConfig  = 39
+
 	CodeSuccessfulBid = 41
 	CodeFailBid       = 42
 )
@@ -41,3 +61,20 @@ type Error struct {
 func (e Error) Error() string {
 	return fmt.Sprintf("%v: %v", e.Code, e.Message)
 }
+
+// IsTransientError check the error may not happen again on retry
+func IsTransientError(err error) bool {
+	e, ok := err.(Error)
+	if !ok {
+		return true
+	}
+	return e.Code == CodeServerNotReady || e.Code == CodeRequestTimeout || e.Code == CodeRequestCanceled || e.Code == CodeServerPaused || (e.Code >= CodeServerSaveError0 && e.Code <= CodeServerUnavailable)
+}
+
+// contextError convert error of done context
+func contextError(err error) error {
+	if err == context.DeadlineExceeded {
+		return Error{Code: CodeRequestTimeout, Message: "Timeout"}
+	}
+	return Error{Code: CodeRequestCanceled, Message: "Canceled"}
+}
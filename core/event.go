@@ -0,0 +1,256 @@
+package auccore
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const EventBufferSize = 65536
+
+// BidEvent is the outcome of a bid request or a schedule change, published to EventSink
+type BidEvent struct {
+	Seq      int // position in event stream from 1, a missing Seq means the event is lost
+	Serial   int
+	Client   int
+	Price    int
+	Sequence int
+	Time     time.Time // request time
+	BidTime  time.Time // warehouse time, zero if rejected before saving
+	Accepted bool
+	Retry    bool   // outcome of a retry with the same Bid.RequestID
+	Withdraw bool   // withdrawal of bid Sequence, BidTime is zero
+	Commit   bool   // sealed bid of first half, only Hash is set instead of Price, BidTime is commitment time
+	Hash     string // CommitmentHash of sealed bid
+	Code     int
+	Latency  time.Duration
+
+	Schedule bool // session or schedule changed, only Session, HalfTime and EndTime are set
+	Session  int
+	HalfTime time.Time
+	EndTime  time.Time
+}
+
+// EventSink publish bid events to downstream, eg, Kafka or file
+type EventSink interface {
+	Publish(events []BidEvent) error
+	Close() error
+}
+
+// EventSource provide events published by primary exchange in order, for Replica
+type EventSource interface {
+	Poll() ([]BidEvent, error) // return events after last Poll
+}
+
+// BufferedSink publish events to EventSink in background,
+// Publish never blocks, events are dropped if buffer is full or sink is closed
+type BufferedSink struct {
+	sink   EventSink
+	buffer chan BidEvent
+	done   chan struct{}
+	log    *log.Logger
+
+	lock   sync.Mutex // keep events in buffer ordered by Seq
+	seq    int
+	closed bool
+
+	dropped uint64 // atomic
+	failed  uint64 // atomic
+}
+
+func NewBufferedSink(sink EventSink, size int, logger *log.Logger) *BufferedSink {
+	s := &BufferedSink{
+		sink:   sink,
+		buffer: make(chan BidEvent, size),
+		done:   make(chan struct{}),
+		log:    logger,
+	}
+	go s.run()
+
+	return s
+}
+
+// Publish assign Seq and put event into buffer without blocking, return false if dropped
+func (s *BufferedSink) Publish(ev BidEvent) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		atomic.AddUint64(&s.dropped, 1)
+		return false
+	}
+	s.seq++
+	ev.Seq = s.seq
+	select {
+	case s.buffer <- ev:
+		return true
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+		return false
+	}
+}
+
+// Close flush buffered events and close the sink, events published later are dropped
+func (s *BufferedSink) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.buffer)
+	s.lock.Unlock()
+	<-s.done
+
+	return s.sink.Close()
+}
+
+// Dropped return the count of events dropped due to full buffer or closed sink
+func (s *BufferedSink) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Failed return the count of events failed to publish
+func (s *BufferedSink) Failed() uint64 {
+	return atomic.LoadUint64(&s.failed)
+}
+
+func (s *BufferedSink) run() {
+	defer close(s.done)
+
+	batch := make([]BidEvent, 0, 512)
+	for ev := range s.buffer {
+		batch = append(batch[:0], ev)
+		// batch all events already in buffer
+	drain:
+		for len(batch) < cap(batch) {
+			select {
+			case ev, ok := <-s.buffer:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, ev)
+			default:
+				break drain
+			}
+		}
+
+		if err := s.sink.Publish(batch); err != nil {
+			atomic.AddUint64(&s.failed, uint64(len(batch)))
+			if s.log != nil {
+				s.log.Printf("ERR:EventSink %d events, %s", len(batch), err)
+			}
+		}
+	}
+}
+
+// MemorySink keep events in memory, for test and in-process consumers
+type MemorySink struct {
+	sync.RWMutex
+	events []BidEvent
+}
+
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+func (s *MemorySink) Publish(events []BidEvent) error {
+	s.Lock()
+	s.events = append(s.events, events...)
+	s.Unlock()
+
+	return nil
+}
+
+func (s *MemorySink) Close() error {
+	return nil
+}
+
+// Events return events published after offset
+func (s *MemorySink) Events(offset int) []BidEvent {
+	s.RLock()
+	defer s.RUnlock()
+
+	if offset >= len(s.events) {
+		return nil
+	}
+	return append([]BidEvent(nil), s.events[offset:]...)
+}
+
+// MemorySource consume events of MemorySink in process
+type MemorySource struct {
+	sink   *MemorySink
+	offset int
+}
+
+func NewMemorySource(sink *MemorySink) *MemorySource {
+	return &MemorySource{sink: sink}
+}
+
+func (s *MemorySource) Poll() ([]BidEvent, error) {
+	events := s.sink.Events(s.offset)
+	s.offset += len(events)
+
+	return events, nil
+}
+
+// FileSink append events to file as JSON lines
+type FileSink struct {
+	file *os.File
+	w    *bufio.Writer
+	enc  *json.Encoder
+}
+
+func NewFileSink(name string) (*FileSink, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(f)
+	return &FileSink{file: f, w: w, enc: json.NewEncoder(w)}, nil
+}
+
+func (s *FileSink) Publish(events []BidEvent) error {
+	for i := range events {
+		if err := s.enc.Encode(&events[i]); err != nil {
+			return err
+		}
+	}
+
+	return s.w.Flush()
+}
+
+func (s *FileSink) Close() error {
+	if err := s.w.Flush(); err != nil {
+		s.file.Close()
+		return err
+	}
+
+	return s.file.Close()
+}
+
+// ReadEventFile read all events saved by FileSink
+func ReadEventFile(name string) ([]BidEvent, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []BidEvent
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var ev BidEvent
+		if err := dec.Decode(&ev); err != nil {
+			return events, err
+		}
+		events = append(events, ev)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,194 @@
+package auccore
+
+import (
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKafkaSink(t *testing.T) {
+	broker, err := NewLocalBroker("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	sink := NewKafkaSink(broker.Addr(), "bids", 2)
+	defer sink.Close()
+
+	events := []BidEvent{
+		{Serial: 1, Client: 10, Price: 100, Accepted: true},
+		{Serial: 2, Client: 11, Price: 101, Code: CodeRequestOutOfRange},
+		{Serial: 3, Client: 12, Price: 102, Accepted: true},
+	}
+	if err := sink.Publish(events); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Publish(events[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := broker.Messages("bids", 0, 0)
+	if len(msgs) != 3 {
+		t.Fatalf("len(msgs) != 3, %d", len(msgs))
+	}
+	if msgs[2].Offset != 2 || string(msgs[2].Key) != "10" {
+		t.Error("unexpected offset or key")
+	}
+	ev, err := DecodeBidEvent(msgs[1].Value)
+	if err != nil || ev.Serial != 3 || ev.Price != 102 {
+		t.Error("unexpected event", ev, err)
+	}
+	msgs = broker.Messages("bids", 1, 0)
+	if len(msgs) != 1 {
+		t.Fatalf("len(msgs) != 1, %d", len(msgs))
+	}
+	if ev, _ := DecodeBidEvent(msgs[0].Value); ev.Code != CodeRequestOutOfRange {
+		t.Error("ev.Code != CodeRequestOutOfRange")
+	}
+
+	// rejected request of invalid client
+	if err := sink.Publish([]BidEvent{{Serial: 4, Client: -1, Code: CodeRequestInvalid}, events[2]}); err != nil {
+		t.Fatal(err)
+	}
+	if msgs = broker.Messages("bids", 1, 1); len(msgs) != 1 || string(msgs[0].Key) != "-1" {
+		t.Errorf("event of negative client %+v", msgs)
+	}
+	if msgs = broker.Messages("bids", 0, 3); len(msgs) != 1 {
+		t.Errorf("events of other clients lost %+v", msgs)
+	}
+}
+
+func TestKafkaUnsupportedVersion(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := readKafkaFrame(conn); err != nil {
+			return
+		}
+		// broker of Kafka 4.0 removed Produce v0-v2
+		resp := &kafkaWriter{}
+		resp.int32(0)
+		resp.int16(kafkaErrNone)
+		resp.int32(1)
+		resp.int16(kafkaApiProduce)
+		resp.int16(3)
+		resp.int16(12)
+		writeKafkaFrame(conn, resp.Bytes())
+	}()
+
+	sink := NewKafkaSink(l.Addr().String(), "bids", 1)
+	defer sink.Close()
+	if err := sink.Publish([]BidEvent{{Serial: 1}}); err != ErrKafkaUnsupportedVersion {
+		t.Error("err != ErrKafkaUnsupportedVersion", err)
+	}
+}
+
+func TestBufferedFileSink(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "events.jsonl")
+	fs, err := NewFileSink(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := NewBufferedSink(fs, 16, nil)
+	for i := 1; i <= 10; i++ {
+		if !sink.Publish(BidEvent{Serial: i}) {
+			t.Error("event dropped")
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := ReadEventFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 10 || events[9].Serial != 10 {
+		t.Error("events not flushed on close")
+	}
+}
+
+func TestBufferedSinkClose(t *testing.T) {
+	sink := NewBufferedSink(NewMemorySink(), 16, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				sink.Publish(BidEvent{Serial: i*100 + j})
+			}
+		}(i)
+	}
+	sink.Close()
+	wg.Wait()
+
+	if sink.Publish(BidEvent{Serial: 1000}) {
+		t.Error("event published after close")
+	}
+	if err := sink.Close(); err != nil {
+		t.Error("close twice", err)
+	}
+}
+
+func TestExchangePublish(t *testing.T) {
+	now := time.Now()
+	t.Setenv("DB_DRIVER", "")
+	e, err := NewExchange(Config{
+		StartTime: now,
+		HalfTime:  now.Add(time.Second * 2),
+		EndTime:   now.Add(time.Second * 4),
+		Capacity:  1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := NewMemorySink()
+	e.SetEventSink(sink)
+	go e.Serve()
+	for i := 0; i < 100 && e.Session() == SessionUnprepared; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	e.Bid(BidRequest{Client: 1, Price: 100})
+	e.Bid(BidRequest{Client: 1, Price: 100})
+	e.Halt()
+
+	var events []BidEvent
+	var sessions []int
+	for i, ev := range sink.Events(0) {
+		if ev.Seq != i+1 {
+			t.Errorf("ev.Seq != %d, %d", i+1, ev.Seq)
+		}
+		if ev.Schedule {
+			sessions = append(sessions, ev.Session)
+		} else {
+			events = append(events, ev)
+		}
+	}
+	if len(sessions) != 2 || sessions[0] != SessionFirstHalf || sessions[1] != SessionFinished {
+		t.Error("unexpected session events", sessions)
+	}
+	if len(events) != 2 {
+		t.Fatalf("len(events) != 2, %d", len(events))
+	}
+	if !events[0].Accepted || events[0].BidTime.IsZero() {
+		t.Error("first bid not accepted")
+	}
+	if events[1].Accepted || events[1].Code != CodeRequestAttendFirstRound {
+		t.Error("second bid not rejected")
+	}
+}
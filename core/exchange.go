@@ -1,11 +1,14 @@
 package auccore
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"runtime"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -24,6 +27,7 @@ const (
 	SessionFirstHalf
 	SessionSecondHalf
 	SessionFinished
+	SessionSealed
 )
 
 // Exchange hold a exchange instance for bid,
@@ -31,20 +35,30 @@ const (
 type Exchange struct {
 	// exchange uuid
 	uuid string
+	// unique id in archive, uuid is shared by auctions starting in the same second
+	auctionID string
 
-	config *Config
-	state  *State // runtime status, collect per second
-	final  *Final
+	config  *Config
+	state   *State  // runtime status, collect per second
+	history []State // all collected states, for archive
+	final   *Final
+
+	sealDiff   *StoreDiff  // difference between memory and warehouse found by Seal
+	reconciled []BidChange // bids changed status by reconciliation
 
 	// state
-	session int  // 0 before start, 1 first half, 2 second half, 3 end
-	sealed  bool // finish dump all data and verify
+	session  *SessionMachine
+	sealing  int32 // atomic, 1 once Seal started
+	released int32 // atomic, 1 once warehouse terminated by Halt or Close
 
-	serial      uint64 // serial number for each Bid, atomic increasing
+	serial      uint64       // serial number for each Bid, atomic increasing
+	statLock    sync.RWMutex // protect lowestPrice, lowestTime, bidders, state, history, final, sealDiff and reconciled
 	lowestPrice int
 	lowestTime  time.Time
 	bidders     int // total bidders
 
+	timeLock sync.RWMutex // protect config.HalfTime and config.EndTime extended by Serve
+
 	// timer & locker
 	startTimer          *time.Timer
 	halfTimer           *time.Timer
@@ -54,10 +68,25 @@ type Exchange struct {
 	quitStateTickerSign chan struct{}
 	bidConcurrentLock   chan struct{} // concurrency lock channel
 	bidWaitGroup        sync.WaitGroup
+	bidGate             sync.RWMutex   // make session check and bidWaitGroup.Add atomic with closeBids
+	bidderLocks         [64]sync.Mutex // serialize bids and withdrawals of a bidder, by client
+
+	// schedule intervention
+	paused       int32 // atomic, 1 for rejecting bids
+	scheduleSign chan scheduleRequest
+	serveDone    chan struct{}
+	scheduleLog  ScheduleLog
+
+	softCloseSign     chan struct{} // lowest price changed near EndTime
+	softCloseExtended time.Duration // total extension by soft close, only accessed in Serve
 
 	// storage
 	store     *Store
 	warehouse Warehouse
+	clock     TimeSource    // decide Bid.Time before saving to warehouse
+	archive   Archive       // save the auction after sealing, nil for disable
+	events    *BufferedSink // nil for disable
+	raft      *RaftNode     // replicate accepted bids before return, nil for disable
 
 	// util
 	sysLog *log.Logger
@@ -69,6 +98,12 @@ type Exchange struct {
 	counterProcess uint64
 	counterReq     *Counter
 	counterRes     *Counter
+
+	requests *RequestCache // outcome of bids with Bid.RequestID, for idempotent retry
+
+	appliedLock sync.Mutex
+	applied     map[string]*Bid // bids committed through raft by client and Bid.RequestID
+	unsaved     []RaftEntry     // committed entries failed to save to warehouse, saved again by Seal
 }
 
 type Config struct {
@@ -78,20 +113,83 @@ type Config struct {
 
 	Capacity     int
 	WarningPrice int // warning price of first half, 0 for disable
+	ReservePrice int // minimum acceptable price of both halves, 0 for disable
+	TickSize     int // price must be multiple of TickSize, PricingDelta counts in ticks, 0 for 1
+	PriceUnit    int // yuan of one price unit, eg, 100 if price quoted in hundred yuan, 0 for 1
+
+	// RevealWindow enable sealed-bid commit-reveal of first half, 0 for disable.
+	// Bidders Commit before HalfTime-RevealWindow, then reveal by Bid with Bid.Nonce before HalfTime
+	RevealWindow time.Duration
+
+	WithdrawWindow time.Duration // withdraw latest second half bid within the window, 0 for disable
+
+	// Soft close of second half, 0 for disable.
+	// If lowest price changes within SoftCloseWindow before EndTime,
+	// EndTime extends SoftCloseExtension, at most SoftCloseCap in total
+	SoftCloseWindow    time.Duration
+	SoftCloseExtension time.Duration
+	SoftCloseCap       time.Duration
+
+	Reconcile int // ReconcileNone or ReconcileWarehouse, when Seal finds memory differs from warehouse
+
+	// Cluster mode, 0 for single node.
+	// The node only accepts clients of ShardOf(client, ShardCount) == ShardIndex,
+	// lowest price is pushed by Coordinator
+	ShardCount int
+	ShardIndex int
 }
 
 type State struct {
 	Time    time.Time
 	Session int
+	EndTime time.Time // may be extended by soft close
 
 	LowestPrice int
 	LowestTime  time.Time
 	Bidders     int
 }
 
+// BidRequest is a bid of bidder, Exchange never modifies it
+type BidRequest struct {
+	Client    int
+	Price     int
+	Nonce     string // reveal nonce of sealed-bid first half
+	RequestID string // optional identifier for idempotent retry
+	SourceIP  string // optional address of bidder, saved by SQL warehouses for audit
+}
+
+// BidResult is a snapshot of bid handled by Exchange
+type BidResult struct {
+	Serial   int
+	Client   int
+	Price    int
+	Time     time.Time // warehouse time, zero if rejected before saving
+	Sequence int
+}
+
+// newBidResult copy fields of bid never changed once saved to Store
+func newBidResult(bid *Bid) BidResult {
+	return BidResult{
+		Serial:   bid.Serial,
+		Client:   bid.Client,
+		Price:    bid.Price,
+		Time:     bid.Time,
+		Sequence: bid.Sequence,
+	}
+}
+
+func newBidResults(bids []*Bid) []BidResult {
+	results := make([]BidResult, len(bids))
+	for i, bid := range bids {
+		results[i] = newBidResult(bid)
+	}
+	return results
+}
+
 type Final struct {
-	Capacity int
-	Bidders  int
+	Capacity  int
+	Allocated int // less than Capacity if demand at ReservePrice is insufficient
+	Bidders   int
 
 	LowestPrice    int
 	LowestTime     time.Time
@@ -105,18 +203,95 @@ type Counter struct {
 	ct map[string]int
 }
 
+// newFinal build final result of a judged store, nil if no one succeed
+func newFinal(conf *Config, store *Store, bidders, seq int, avg float64) *Final {
+	if store.TailBid == nil {
+		return nil
+	}
+
+	return &Final{
+		Capacity:       conf.Capacity,
+		Allocated:      len(store.FinalBids),
+		Bidders:        bidders,
+		LowestPrice:    store.TailBid.Price,
+		LowestTime:     store.TailBid.Time,
+		LowestSequence: seq,
+		AveragePrice:   int(avg * 100),
+	}
+}
+
 func newCounter() *Counter {
 	return &Counter{ct: make(map[string]int)}
 }
 
-func NewExchange(conf Config) *Exchange {
+// RequestCache hold outcome of bids by client supplied Bid.RequestID
+type RequestCache struct {
+	sync.Mutex
+	rs map[string]*requestOutcome
+}
+
+type requestOutcome struct {
+	done   chan struct{} // closed once outcome is ready
+	result BidResult
+	err    error
+}
+
+func newRequestCache() *RequestCache {
+	return &RequestCache{rs: make(map[string]*requestOutcome)}
+}
+
+// acquire return the outcome of request, loaded is false if caller is the first to process it
+func (c *RequestCache) acquire(client int, requestID string) (r *requestOutcome, loaded bool) {
+	k := strconv.Itoa(client) + ":" + requestID
+
+	c.Lock()
+	defer c.Unlock()
+	if r, got := c.rs[k]; got {
+		return r, true
+	}
+	r = &requestOutcome{done: make(chan struct{})}
+	c.rs[k] = r
+	return r, false
+}
+
+// release save the outcome of request and wake up waiting retries
+// transient errors are not kept, so later retry will be processed again
+func (c *RequestCache) release(r *requestOutcome, requestID string, result BidResult, err error) {
+	r.result = result
+	r.err = err
+	if err != nil && IsTransientError(err) {
+		c.Lock()
+		delete(c.rs, strconv.Itoa(result.Client)+":"+requestID)
+		c.Unlock()
+	}
+	close(r.done)
+}
+
+// NewExchange create exchange of conf, error with CodeServerInvalidConfig if conf is misconfigured
+func NewExchange(conf Config) (*Exchange, error) {
 	pid := conf.StartTime.Format("060102150405")
+	capacity := conf.Capacity
+	if conf.ShardCount > 0 {
+		// each node of a cluster has its own logs and warehouse tables
+		pid += fmt.Sprintf("s%d", conf.ShardIndex)
+		// TailBid is judged globally by Coordinator
+		capacity = 0
+	}
 
 	// init log files
 	logFile1, _ := os.OpenFile("./logs/"+pid+"_server_sys.txt", os.O_CREATE|os.O_WRONLY, 0666)
 	mw1 := io.MultiWriter(logFile1)
 	sysLogger := log.New(mw1, "", log.LstdFlags)
 
+	// reject misconfigured auction
+	if err := conf.Validate(); err != nil {
+		sysLogger.Println(err)
+		if logFile1 != nil {
+			logFile1.Close()
+		}
+		return nil, err
+	}
+
 	logFile2, _ := os.OpenFile("./logs/"+pid+"_server_bid.txt", os.O_CREATE|os.O_WRONLY, 0666)
 	mw2 := io.MultiWriter(logFile2)
 	bidLogger := log.New(mw2, "", log.LstdFlags)
@@ -132,7 +307,10 @@ func NewExchange(conf Config) *Exchange {
 		// default max connections of mysql is 151
 		db.SetMaxIdleConns(150)
 		db.SetMaxOpenConns(150)
-		warehouse = NewMysqlWarehouse("pp_"+pid+"_", db, sysLogger)
+		mysqlWarehouse := NewMysqlWarehouse("pp_"+pid+"_", db, sysLogger)
+		// eg, MYSQL_ENGINE=InnoDB, MyISAM by default
+		mysqlWarehouse.Engine = os.Getenv("MYSQL_ENGINE")
+		warehouse = mysqlWarehouse
 	} else if os.Getenv("DB_DRIVER") == "postgres" {
 		db, _ := sql.Open("postgres", os.Getenv("POSTGRES_DSN"))
 		// default max connections of postgres is 100
@@ -140,14 +318,77 @@ func NewExchange(conf Config) *Exchange {
 		db.SetMaxOpenConns(99)
 		warehouse = NewPostgresWarehouse("pp_"+pid+"_", db, sysLogger)
 	} else {
-		warehouse = NewMemoryWarehouse()
+		memory := NewMemoryWarehouse()
+		// reproducible latency, eg, SIM_LATENCY=lognormal:15ms,0.5 SIM_SEED=1 SIM_POOL=250
+		if os.Getenv("SIM_LATENCY") != "" || os.Getenv("SIM_SEED") != "" {
+			model, err := ParseLatencyModel(os.Getenv("SIM_LATENCY"))
+			if err != nil {
+				sysLogger.Println(err)
+				model = DefaultLatency{}
+			}
+			seed, _ := strconv.ParseInt(os.Getenv("SIM_SEED"), 10, 64)
+			pool, _ := strconv.Atoi(os.Getenv("SIM_POOL"))
+			memory.Simulation = Simulation{Pool: pool, Model: model, Seed: seed}
+		}
+		if chaos, ok := ChaosFromEnv(); ok {
+			sysLogger.Printf("Chaos warehouse %+v", chaos)
+			memory.SetChaos(chaos)
+		}
+		warehouse = memory
+	}
+	var retryWarehouse *RetryWarehouse
+	if policy, ok := RetryPolicyFromEnv(); ok {
+		retryWarehouse = NewRetryWarehouse(warehouse, policy)
+		warehouse = retryWarehouse
+	}
+	// dual-write a WAL file, eg, WAREHOUSE_MIRROR=file
+	if os.Getenv("WAREHOUSE_MIRROR") == "file" {
+		warehouse = NewMirrorWarehouse(warehouse, NewFileWarehouse("./logs/"+pid+"_server_wal.jsonl", sysLogger), sysLogger)
 	}
 	warehouse.Initialize()
+	// eg, TIME_SOURCE=local, database by default
+	clock, err := ParseTimeSource(os.Getenv("TIME_SOURCE"))
+	if err != nil {
+		sysLogger.Println(err)
+	}
+	if clock == nil {
+		clock = DatabaseClock{}
+	}
+
+	// archive results after sealing, eg, ARCHIVE_DRIVER=postgres ARCHIVE_DSN=...
+	var archive Archive
+	if driver := os.Getenv("ARCHIVE_DRIVER"); driver == "mysql" || driver == "postgres" {
+		if db, err := sql.Open(driver, os.Getenv("ARCHIVE_DSN")); err != nil {
+			sysLogger.Println("ERR:Archive disabled")
+			sysLogger.Println(err)
+		} else {
+			archive = NewSQLArchive(driver, db, "auc_")
+		}
+	}
+
+	// judge from warehouse if differs from memory, eg, RECONCILE=warehouse
+	if os.Getenv("RECONCILE") == "warehouse" {
+		conf.Reconcile = ReconcileWarehouse
+	}
+
+	// init event sink
+	var sink EventSink
+	if os.Getenv("EVENT_SINK") == "kafka" {
+		partitions, _ := strconv.Atoi(os.Getenv("KAFKA_PARTITIONS"))
+		sink = NewKafkaSink(os.Getenv("KAFKA_BROKER"), os.Getenv("KAFKA_TOPIC"), partitions)
+	} else if os.Getenv("EVENT_SINK") == "file" {
+		if fs, err := NewFileSink("./logs/" + pid + "_server_event.jsonl"); err != nil {
+			sysLogger.Println(err)
+		} else {
+			sink = fs
+		}
+	}
 
 	loc, _ := time.LoadLocation("Asia/Shanghai")
 
-	return &Exchange{
+	e := &Exchange{
 		uuid:      pid,
+		auctionID: newAuctionID(pid),
 		config:    &conf,
 		state:     &State{},
 		sysLog:    sysLogger,
@@ -155,8 +396,40 @@ func NewExchange(conf Config) *Exchange {
 		resLog:    resLogger,
 		loc:       loc,
 		warehouse: warehouse,
-		store:     NewStore(conf.Capacity),
+		clock:     clock,
+		archive:   archive,
+		store:     NewStore(capacity),
+		requests:  newRequestCache(),
+		session:   NewSessionMachine(),
+
+		counterReq: newCounter(),
+
+		scheduleSign: make(chan scheduleRequest),
+		serveDone:    make(chan struct{}),
+
+		softCloseSign: make(chan struct{}, 1),
 	}
+	e.store.ReservePrice = conf.ReservePrice
+	e.session.OnSessionChange(e.logSession)
+	e.session.OnSessionChange(func(from, to int) { e.publishSchedule(to) })
+	if retryWarehouse != nil {
+		retryWarehouse.Deadline = e.sessionDeadline
+	}
+	if sink != nil {
+		e.SetEventSink(sink)
+	}
+
+	return e, nil
+}
+
+// SetEventSink publish all bid outcomes to sink, should be called before Serve
+func (e *Exchange) SetEventSink(sink EventSink) {
+	e.events = NewBufferedSink(sink, EventBufferSize, e.sysLog)
+}
+
+// SetTimeSource decide Bid.Time by clock instead of warehouse, must be called before Serve
+func (e *Exchange) SetTimeSource(clock TimeSource) {
+	e.clock = clock
 }
 
 // Serve start to serve incoming request
@@ -165,6 +438,7 @@ func (e *Exchange) Serve() {
 	e.bidConcurrentLock = make(chan struct{}, BidProcessThreshold)
 	e.quitStateTickerSign = make(chan struct{})
 	e.quitServe = make(chan struct{})
+	defer close(e.serveDone)
 
 	// add clock
 	now := time.Now()
@@ -176,29 +450,30 @@ func (e *Exchange) Serve() {
 	e.halfTimer = time.NewTimer(e.config.HalfTime.Sub(now))
 	e.endTimer = time.NewTimer(e.config.EndTime.Sub(now))
 
-	// init counter
-	e.counterReq = newCounter()
-
 	for {
 		select {
 		case <-e.startTimer.C:
-			e.session = SessionFirstHalf
-			//e.toggleStart()
-			go e.startCollector()
+			e.session.Transit(SessionFirstHalf)
+			e.stateTicker = time.NewTicker(time.Millisecond * 1000)
+			go e.startCollector(e.stateTicker)
 		case <-e.halfTimer.C:
-			e.session = SessionSecondHalf
-			//e.toggleHalf()
+			e.session.Transit(SessionSecondHalf)
 			e.collectLowestPrice()
 			e.collectCountBidders()
+			if e.config.RevealWindow > 0 {
+				e.sysLog.Printf(">>> Unrevealed commitments %d", e.store.CountUnrevealed())
+			}
 		case <-e.endTimer.C:
-			e.session = SessionFinished
-			//e.toggleEnd()
+			e.closeBids()
 			e.stopCollector()
 			e.bidWaitGroup.Wait()
 			return
+		case req := <-e.scheduleSign:
+			req.done <- e.reschedule(req)
+		case <-e.softCloseSign:
+			e.softClose()
 		case <-e.quitServe:
-			e.session = SessionFinished
-			//e.toggleEnd()
+			e.closeBids()
 			e.stopCollector()
 			e.bidWaitGroup.Wait()
 			return
@@ -210,9 +485,7 @@ func (e *Exchange) Serve() {
 func (e *Exchange) Close() {
 	e.stopTimer()
 
-	if !e.sealed {
-		e.Seal()
-	}
+	e.Seal()
 
 	e.releaseResource()
 }
@@ -221,8 +494,9 @@ func (e *Exchange) Close() {
 func (e *Exchange) Halt() {
 	e.stopTimer()
 
-	if e.session != SessionFinished {
+	if e.session.Current() < SessionFinished {
 		e.quitServe <- struct{}{}
+		<-e.serveDone // bids in flight and session events are published before sink closed
 	}
 
 	e.releaseResource()
@@ -240,40 +514,108 @@ func (e *Exchange) stopTimer() {
 	}
 }
 
+// terminated check warehouse is terminated by Halt or Close
+func (e *Exchange) terminated() bool {
+	return atomic.LoadInt32(&e.released) == 1
+}
+
 func (e *Exchange) releaseResource() {
+	atomic.StoreInt32(&e.released, 1)
 	if e.warehouse != nil {
 		e.warehouse.Terminate()
 	}
+	if c, ok := e.clock.(*NTPClock); ok {
+		c.Stop()
+	}
+	if e.events != nil {
+		// e.events is never reset, bids still in flight drop their events
+		e.events.Close()
+	}
 }
 
 // Seal check all data correct and judge final result
 func (e *Exchange) Seal() *Final {
+	// warehouse is terminated after Halt, nothing to judge from
+	if e.terminated() {
+		e.sysLog.Println("*** Seal after warehouse terminated")
+		return e.Final()
+	}
 	// avoid duplicate sealing
-	if e.sealed {
-		return e.final
+	if !atomic.CompareAndSwapInt32(&e.sealing, 0, 1) {
+		return e.Final()
 	}
-	e.sealed = true
+	// reject all bids from now on
+	e.closeBids()
+	e.bidWaitGroup.Wait()
 
 	e.sysLog.Println("===============================")
 	e.sysLog.Printf(">>> Start Sealing @ %s", time.Now().Format("15:04:05.000000"))
 	e.sysLog.Println("===============================")
 
+	// committed by raft but failed to save on this node
+	unsaved := e.saveUnsaved()
+
 	// compare store in memory with store restored from warehouse
 	// make all data correct
-	restoreStore := NewStore(0)
-	e.warehouse.Restore(restoreStore, e.config)
-	//restoreStore.SetCapacity(e.config.Capacity)
-	//restoreStore.SortAllBlocks()
-	if !e.store.Equal(restoreStore) {
+	restoreStore := NewStore(e.store.Capacity)
+	restoreStore.ReservePrice = e.store.ReservePrice
+	diff := &StoreDiff{}
+	restoreErr := e.warehouse.Restore(restoreStore, e.config)
+	if restoreErr == nil {
+		//restoreStore.SortAllBlocks()
+		diff = e.store.Diff(restoreStore)
+	}
+	e.statLock.Lock()
+	e.sealDiff = diff
+	e.statLock.Unlock()
+	if restoreErr != nil {
+		// judge from memory
+		e.sysLog.Println("*** Restore from warehouse failed, raw data not checked !!!")
+		e.sysLog.Println(restoreErr)
+	} else if !diff.Empty() {
 		e.sysLog.Println("*** Store is not equal to store restored from warehouse !!!")
+		e.sysLog.Printf("*** Diff %s", diff)
 	} else {
 		e.sysLog.Println("warehouse raw data check done!")
 	}
+	warehouse := e.warehouse
+	if mw, ok := warehouse.(*MirrorWarehouse); ok {
+		if restoreErr != nil {
+			e.sysLog.Println("*** Mirror not compared, primary not restored")
+		} else if report, err := mw.Report(restoreStore, e.store, e.config); err != nil {
+			e.sysLog.Println("*** Mirror not compared, restore from mirror failed")
+			e.sysLog.Println(err)
+		} else {
+			e.sysLog.Printf(">>> Mirror %s", report)
+		}
+		e.sysLog.Printf(">>> Mirror failures %d", len(mw.Failures()))
+		warehouse = mw.Primary
+	}
+	if rw, ok := warehouse.(*RetryWarehouse); ok {
+		e.sysLog.Printf(">>> Warehouse retry %+v", rw.Stats())
+	}
 
 	// sort blocks in case time in store different from warehouse
 	e.store.SortAllBlocks()
 	// export final result
 	seq, avg := e.store.Judge()
+	if unsaved > 0 {
+		// warehouse lacks accepted bids
+		e.sysLog.Printf("*** %d committed entries not saved to warehouse, judge from memory !!!", unsaved)
+	} else if !diff.Empty() && e.config.Reconcile == ReconcileWarehouse {
+		// warehouse is the source of truth
+		restoreStore.SortAllBlocks()
+		seq, avg = restoreStore.Judge()
+		changes := statusChanges(e.store, restoreStore)
+		e.store.Replace(restoreStore)
+		e.statLock.Lock()
+		e.reconciled = changes
+		e.statLock.Unlock()
+		e.sysLog.Printf("*** Reconciled from warehouse, %d bids changed status", len(changes))
+		if len(changes) > 0 {
+			e.sysLog.Println(formatBidChanges(changes))
+		}
+	}
 	e.commitResults()
 	e.dump()
 
@@ -298,46 +640,199 @@ func (e *Exchange) Seal() *Final {
 	runtime.ReadMemStats(&mem)
 	e.sysLog.Printf(">>> Memory Alloc %d, TotalAlloc %d, HeapAlloc %d, HeapSys %d", mem.Alloc, mem.TotalAlloc, mem.HeapAlloc, mem.HeapSys)
 
-	if e.store.TailBid != nil {
-		e.final = &Final{
-			Capacity:       e.config.Capacity,
-			Bidders:        e.state.Bidders,
-			LowestPrice:    e.store.TailBid.Price,
-			LowestTime:     e.store.TailBid.Time,
-			LowestSequence: seq,
-			AveragePrice:   int(avg * 100),
+	conf := e.Config()
+	e.statLock.Lock()
+	final := newFinal(conf, e.store, e.state.Bidders, seq, avg)
+	e.final = final
+	e.statLock.Unlock()
+	if final != nil {
+		e.sysLog.Printf(">>> Lowest price %d (%d yuan)", final.LowestPrice, e.config.Yuan(final.LowestPrice))
+	}
+	if e.archive != nil {
+		if err := e.archive.Save(e.auctionRecord(final)); err != nil {
+			e.sysLog.Println("*** Archive failed")
+			e.sysLog.Println(err)
+		} else {
+			e.sysLog.Println(">>> Archived")
 		}
 	}
-	return e.final
+	e.session.Seal(final)
+
+	return final
+}
+
+// SealDiff return the difference between store in memory and store restored from warehouse,
+// nil before Seal
+func (e *Exchange) SealDiff() *StoreDiff {
+	e.statLock.RLock()
+	defer e.statLock.RUnlock()
+
+	return e.sealDiff
+}
+
+// Reconciled return bids changed status when Seal judged from warehouse by ReconcileWarehouse
+func (e *Exchange) Reconciled() []BidChange {
+	e.statLock.RLock()
+	defer e.statLock.RUnlock()
+
+	return append([]BidChange(nil), e.reconciled...)
 }
 
 // Enquiry enquiries bidder's latest Bid
-func (e *Exchange) Enquiry(client int) (*Bid, error) {
-	bidder := e.store.GetBidderBlock(client)
-	if bidder != nil {
-		return bidder.Bids[len(bidder.Bids)-1], nil
+func (e *Exchange) Enquiry(client int) (BidResult, error) {
+	bid, err := enquiry(e.store, client)
+	if err != nil {
+		return BidResult{}, err
+	}
+	return newBidResult(bid), nil
+}
+
+func enquiry(store *Store, client int) (*Bid, error) {
+	if bids := store.Bids(client); len(bids) > 0 {
+		// latest bid may be withdrawn, return the active one
+		for i := len(bids) - 1; i > 0; i-- {
+			if !bids[i].Withdrawn {
+				return &bids[i], nil
+			}
+		}
+		return &bids[0], nil
+	}
+
+	if c := store.GetCommitment(client); c != nil {
+		return nil, Error{Code: CodeRequestNotReveal, Message: "Not reveal"}
 	}
 
 	return nil, Error{Code: CodeRequestNotAttend, Message: "Not attend"}
 }
 
 // SuccessfulBids list all successful bids
-func (e *Exchange) SuccessfulBids() []*Bid {
-	return e.store.FinalBids
+func (e *Exchange) SuccessfulBids() []BidResult {
+	e.store.RLock()
+	defer e.store.RUnlock()
+
+	return newBidResults(e.store.FinalBids)
 }
 
+// Config return a copy of config with current schedule
 func (e *Exchange) Config() *Config {
-	return e.config
+	conf := *e.config
+	conf.HalfTime, conf.EndTime = e.schedule()
+	return &conf
+}
+
+// schedule return current HalfTime and EndTime, which may be extended by Serve
+func (e *Exchange) schedule() (halfTime, endTime time.Time) {
+	e.timeLock.RLock()
+	defer e.timeLock.RUnlock()
+
+	return e.config.HalfTime, e.config.EndTime
+}
+
+// setSchedule change HalfTime and EndTime, must be called in Serve
+func (e *Exchange) setSchedule(halfTime, endTime time.Time) {
+	e.timeLock.Lock()
+	e.config.HalfTime, e.config.EndTime = halfTime, endTime
+	e.timeLock.Unlock()
+
+	e.statLock.Lock()
+	e.state.EndTime = endTime
+	e.statLock.Unlock()
+
+	e.publishSchedule(e.session.Current())
 }
 
+// Tick return the price increment, at least 1
+func (c *Config) Tick() int {
+	if c.TickSize < 1 {
+		return 1
+	}
+	return c.TickSize
+}
+
+// Validate check the auction is well configured, with CodeServerInvalidConfig
+func (c *Config) Validate() error {
+	invalid := func(msg string) error {
+		return Error{Code: CodeServerInvalidConfig, Message: msg}
+	}
+
+	if !c.StartTime.Before(c.HalfTime) || !c.HalfTime.Before(c.EndTime) {
+		return invalid("StartTime, HalfTime and EndTime out of order")
+	} else if c.Capacity < 0 {
+		return invalid("Negative Capacity")
+	} else if c.TickSize < 0 || c.PriceUnit < 0 {
+		return invalid("Negative TickSize or PriceUnit")
+	} else if c.ReservePrice < 0 || c.ReservePrice%c.Tick() != 0 {
+		return invalid("ReservePrice is not multiple of TickSize")
+	} else if c.WarningPrice < 0 || c.WarningPrice%c.Tick() != 0 {
+		return invalid("WarningPrice is not multiple of TickSize")
+	} else if c.WarningPrice > 0 && c.ReservePrice > c.WarningPrice {
+		return invalid("ReservePrice greater than WarningPrice")
+	} else if c.RevealWindow < 0 || c.WithdrawWindow < 0 || c.SoftCloseWindow < 0 || c.SoftCloseExtension < 0 || c.SoftCloseCap < 0 {
+		return invalid("Negative window")
+	} else if c.RevealWindow >= c.HalfTime.Sub(c.StartTime) {
+		return invalid("RevealWindow longer than first half")
+	}
+	return nil
+}
+
+// Yuan convert price to yuan by PriceUnit
+func (c *Config) Yuan(price int) int {
+	if c.PriceUnit < 1 {
+		return price
+	}
+	return price * c.PriceUnit
+}
+
+// State return a copy of state at last collecting
 func (e *Exchange) State() *State {
-	return e.state
+	e.statLock.RLock()
+	defer e.statLock.RUnlock()
+
+	state := *e.state
+	return &state
 }
 
 func (e *Exchange) Final() *Final {
+	e.statLock.RLock()
+	defer e.statLock.RUnlock()
+
 	return e.final
 }
 
+// sessionDeadline return the end of current session for warehouse retries, zero after EndTime
+func (e *Exchange) sessionDeadline() time.Time {
+	halfTime, endTime := e.schedule()
+	if session := e.session.Current(); session <= SessionFirstHalf {
+		return halfTime
+	} else if session == SessionSecondHalf {
+		return endTime
+	}
+	return time.Time{}
+}
+
+// lowest return the lowest price and its time for now
+func (e *Exchange) lowest() (int, time.Time) {
+	e.statLock.RLock()
+	defer e.statLock.RUnlock()
+
+	return e.lowestPrice, e.lowestTime
+}
+
+// Session return current session
+func (e *Exchange) Session() int {
+	return e.session.Current()
+}
+
+// OnSessionChange register hook called after each session change
+func (e *Exchange) OnSessionChange(h func(from, to int)) {
+	e.session.OnSessionChange(h)
+}
+
+// OnSealed register hook called with final result after sealing
+func (e *Exchange) OnSealed(h func(final *Final)) {
+	e.session.OnSealed(h)
+}
+
 func (e *Exchange) BiddersCount() int {
 	return e.store.CountBidders()
 }
@@ -354,48 +849,341 @@ func (e *Exchange) incrRequestCount() {
 	e.counterReq.Unlock()
 }
 
-// Bid accept a *Bid request with only Bid.Client and Bid.Price
-// If success, *Bid will be fulfill with Bid.Time, Bid.Sequence
-func (e *Exchange) Bid(bid *Bid) error {
+// Commit accept a sealed bid of first half, hash is CommitmentHash(client, price, nonce)
+// only available before reveal window in sealed-bid mode
+func (e *Exchange) Commit(client int, hash string) error {
+	if e.config.RevealWindow <= 0 || hash == "" {
+		return Error{Code: CodeRequestInvalid, Message: "Invalid request"}
+	}
+
+	if session := e.session.Current(); session == SessionUnprepared {
+		return Error{Code: CodeServerNotReady, Message: "Not ready"}
+	} else if session >= SessionFinished {
+		return Error{Code: CodeServerEnd, Message: "Invalid time"}
+	} else if session != SessionFirstHalf {
+		return Error{Code: CodeRequestInvalidTime, Message: "Invalid time"}
+	}
+
+	if e.Paused() {
+		return Error{Code: CodeServerPaused, Message: "Paused"}
+	}
+
+	if !e.ownClient(client) {
+		return Error{Code: CodeRequestWrongShard, Message: "Wrong shard"}
+	}
+
+	if e.raft != nil && !e.raft.IsLeader() {
+		return Error{Code: CodeServerNotLeader, Message: "Not leader"}
+	}
+
+	tInit := time.Now()
+	if !tInit.Before(e.revealTime()) {
+		return Error{Code: CodeRequestRevealWindow, Message: "Reveal window"}
+	}
+
+	c := &Commitment{Client: client, Hash: hash}
+	err := e.commit(c)
+	if err != nil {
+		e.bidLog.Printf("<<< %d #### @ %s commit %s ✘ %d %s", client, tInit.Format("15:04:05.000"), hash, err.(Error).Code, err.(Error).Message)
+	} else {
+		e.bidLog.Printf("<<< %d #### @ %s commit %s ✔ ", client, tInit.Format("15:04:05.000"), hash)
+	}
+
+	if e.events != nil {
+		ev := BidEvent{Client: client, Time: tInit, BidTime: c.Time, Accepted: err == nil, Commit: true, Hash: hash, Latency: time.Since(tInit)}
+		if err != nil {
+			ev.Code = err.(Error).Code
+		}
+		e.events.Publish(ev)
+	}
+
+	return err
+}
+
+func (e *Exchange) commit(c *Commitment) error {
+	if !e.enterBid() {
+		return Error{Code: CodeServerEnd, Message: "Invalid time"}
+	}
+	// concurrency lock
+	e.bidConcurrentLock <- struct{}{}
+	defer func() {
+		<-e.bidConcurrentLock
+		e.bidWaitGroup.Done()
+	}()
+
+	// no other commitment or bid of the bidder until stored
+	lock := e.bidderLock(c.Client)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if e.store.GetCommitment(c.Client) != nil {
+		return Error{Code: CodeRequestAttendFirstRound, Message: "Attend first round"}
+	}
+
+	// save to warehouse, saved by applyEntry after committed if replicated
+	c.Time = e.clock.Now()
+	if err := e.saveCommitment(c); err != nil {
+		return err
+	}
+	return e.storeCommitment(c)
+}
+
+// revealTime return the start of reveal window in sealed-bid mode
+func (e *Exchange) revealTime() time.Time {
+	halfTime, _ := e.schedule()
+	return halfTime.Add(-e.config.RevealWindow)
+}
+
+// Bid accept a BidRequest, the result is filled with Serial, and Time, Sequence once saved
+// Retry with the same BidRequest.RequestID return the original outcome without bidding again
+func (e *Exchange) Bid(req BidRequest) (BidResult, error) {
+	return e.BidContext(context.Background(), req)
+}
+
+// BidContext bid like Bid, give up once ctx is done
+// while waiting for concurrency slot or saving to warehouse, with CodeRequestTimeout or CodeRequestCanceled
+func (e *Exchange) BidContext(ctx context.Context, req BidRequest) (BidResult, error) {
 	e.incrRequestCount()
 
+	if req.RequestID != "" {
+		r, loaded := e.requests.acquire(req.Client, req.RequestID)
+		if loaded {
+			tInit := time.Now()
+			select {
+			case <-r.done:
+			case <-ctx.Done():
+				return BidResult{Client: req.Client, Price: req.Price}, contextError(ctx.Err())
+			}
+			e.bidLog.Printf("<<< %d %4d @ %s (%6d) retry %s", r.result.Client, r.result.Price, tInit.Format("15:04:05.000"), r.result.Serial, req.RequestID)
+			e.publish(r.result, tInit, r.err, true)
+			return r.result, r.err
+		}
+
+		result, err := e.bidWithLog(ctx, req)
+		e.requests.release(r, req.RequestID, result, err)
+		return result, err
+	}
+
+	return e.bidWithLog(ctx, req)
+}
+
+func (e *Exchange) bidWithLog(ctx context.Context, req BidRequest) (BidResult, error) {
+	// internal record, owned by Store once saved
+	bid := &Bid{
+		Client:    req.Client,
+		Price:     req.Price,
+		Nonce:     req.Nonce,
+		RequestID: req.RequestID,
+		SourceIP:  req.SourceIP,
+	}
+
 	// assign a serial number
 	bid.Serial = int(atomic.AddUint64(&e.serial, 1))
 	tInit := time.Now()
-	err := e.bid(bid)
+	err := e.bid(ctx, bid)
+	result := newBidResult(bid)
 
 	if err != nil {
 		var pTime time.Time
-		if bid.Time.IsZero() {
+		if result.Time.IsZero() {
 			pTime = time.Now()
 		} else {
-			pTime = bid.Time
+			pTime = result.Time
 		}
-		e.bidLog.Printf("<<< %d %4d @ %s (%6d) %.4fs ✘ %d %s", bid.Client, bid.Price, tInit.Format("15:04:05.000"), bid.Serial, pTime.Sub(tInit).Seconds(), err.(Error).Code, err.(Error).Message)
+		e.bidLog.Printf("<<< %d %4d @ %s (%6d) %.4fs ✘ %d %s", result.Client, result.Price, tInit.Format("15:04:05.000"), result.Serial, pTime.Sub(tInit).Seconds(), err.(Error).Code, err.(Error).Message)
 	} else {
-		e.bidLog.Printf("<<< %d %4d @ %s (%6d) %.4fs ✔ ", bid.Client, bid.Price, tInit.Format("15:04:05.000"), bid.Serial, bid.Time.Sub(tInit).Seconds())
+		e.bidLog.Printf("<<< %d %4d @ %s (%6d) %.4fs ✔ ", result.Client, result.Price, tInit.Format("15:04:05.000"), result.Serial, result.Time.Sub(tInit).Seconds())
+	}
+	e.publish(result, tInit, err, false)
+
+	return result, err
+}
+
+// publish send bid outcome to event sink without blocking
+func (e *Exchange) publish(result BidResult, tInit time.Time, err error, retry bool) {
+	if e.events == nil {
+		return
+	}
+
+	ev := BidEvent{
+		Serial:   result.Serial,
+		Client:   result.Client,
+		Price:    result.Price,
+		Sequence: result.Sequence,
+		Time:     tInit,
+		BidTime:  result.Time,
+		Accepted: err == nil,
+		Retry:    retry,
+		Latency:  time.Since(tInit),
+	}
+	if err != nil {
+		ev.Code = err.(Error).Code
+	}
+	e.events.Publish(ev)
+}
+
+// publishSchedule send session and current schedule to event sink, for Replica
+func (e *Exchange) publishSchedule(session int) {
+	if e.events == nil {
+		return
+	}
+
+	halfTime, endTime := e.schedule()
+	e.events.Publish(BidEvent{Time: time.Now(), Schedule: true, Session: session, HalfTime: halfTime, EndTime: endTime})
+}
+
+// Withdraw withdraw bidder's latest second half bid of serial within Config.WithdrawWindow
+// the previous bid becomes active again
+func (e *Exchange) Withdraw(client, serial int) error {
+	tInit := time.Now()
+	bid, err := e.withdraw(client, serial)
+
+	if err != nil {
+		e.bidLog.Printf("<<< %d withdraw @ %s (%6d) ✘ %d %s", client, tInit.Format("15:04:05.000"), serial, err.(Error).Code, err.(Error).Message)
+	} else {
+		e.bidLog.Printf("<<< %d withdraw @ %s (%6d) ✔ ", client, tInit.Format("15:04:05.000"), serial)
+	}
+
+	if e.events != nil {
+		ev := BidEvent{Serial: serial, Client: client, Time: tInit, Accepted: err == nil, Withdraw: true, Latency: time.Since(tInit)}
+		if bid != nil {
+			ev.Price = bid.Price
+			ev.Sequence = bid.Sequence
+		}
+		if err != nil {
+			ev.Code = err.(Error).Code
+		}
+		e.events.Publish(ev)
 	}
 
 	return err
 }
 
-// traffic control
-func (e *Exchange) bid(bid *Bid) error {
-	if !bid.Time.IsZero() || bid.Sequence != 0 || bid.Active {
-		return Error{Code: CodeRequestInvalid, Message: "Invalid request"}
+func (e *Exchange) withdraw(client, serial int) (*Bid, error) {
+	if e.config.WithdrawWindow <= 0 {
+		return nil, Error{Code: CodeRequestInvalid, Message: "Invalid request"}
 	}
 
-	if e.session == SessionUnprepared {
-		return Error{Code: CodeServerNotReady, Message: "Not ready"}
-	} else if e.session == SessionFinished {
-		return Error{Code: CodeServerEnd, Message: "Invalid time"}
+	if session := e.session.Current(); session == SessionUnprepared {
+		return nil, Error{Code: CodeServerNotReady, Message: "Not ready"}
+	} else if session >= SessionFinished {
+		return nil, Error{Code: CodeServerEnd, Message: "Invalid time"}
+	} else if session != SessionSecondHalf {
+		return nil, Error{Code: CodeRequestInvalidTime, Message: "Invalid time"}
+	}
+
+	if e.Paused() {
+		return nil, Error{Code: CodeServerPaused, Message: "Paused"}
 	}
 
+	if e.raft != nil && !e.raft.IsLeader() {
+		return nil, Error{Code: CodeServerNotLeader, Message: "Not leader"}
+	}
+
+	if !e.enterBid() {
+		return nil, Error{Code: CodeServerEnd, Message: "Invalid time"}
+	}
 	// concurrency lock
 	e.bidConcurrentLock <- struct{}{}
+	defer func() {
+		<-e.bidConcurrentLock
+		e.bidWaitGroup.Done()
+	}()
+
+	// no other bid or withdrawal of the bidder until withdrawn
+	lock := e.bidderLock(client)
+	lock.Lock()
+	defer lock.Unlock()
+
+	bids := e.store.Bids(client)
+	if len(bids) == 0 {
+		return nil, Error{Code: CodeRequestNotAttend, Message: "Not attend"}
+	}
+
+	bid := &bids[len(bids)-1]
+	if bid.Serial != serial || !bid.Active || bid.Sequence < 2 {
+		return nil, Error{Code: CodeRequestNotWithdrawable, Message: "Not withdrawable"}
+	}
+	if time.Since(bid.Time) > e.config.WithdrawWindow {
+		return bid, Error{Code: CodeRequestWithdrawExpired, Message: "Withdraw expired"}
+	}
+
+	// save to warehouse, saved by applyEntry after committed if replicated
+	if err := e.saveWithdraw(bid); err != nil {
+		return bid, err
+	}
+	if err := e.storeWithdraw(bid); err != nil {
+		return bid, err
+	}
+
+	// previous bid reactivated, update TailBid, extend EndTime like a bid moving it
+	if e.collectLowestPrice() {
+		e.notifySoftClose()
+	}
+
+	return bid, nil
+}
+
+// enterBid add a bid in flight to bidWaitGroup, false if session finished
+func (e *Exchange) enterBid() bool {
+	e.bidGate.RLock()
+	defer e.bidGate.RUnlock()
+
+	if e.session.Current() >= SessionFinished {
+		return false
+	}
 	e.bidWaitGroup.Add(1)
+	return true
+}
+
+// closeBids move to SessionFinished, bids in flight are all in bidWaitGroup from now on
+func (e *Exchange) closeBids() {
+	e.bidGate.Lock()
+	defer e.bidGate.Unlock()
 
-	err := e.bidProcess(bid)
+	e.session.Transit(SessionFinished)
+}
+
+// traffic control
+func (e *Exchange) bid(ctx context.Context, bid *Bid) error {
+	if session := e.session.Current(); session == SessionUnprepared {
+		return Error{Code: CodeServerNotReady, Message: "Not ready"}
+	} else if session >= SessionFinished {
+		return Error{Code: CodeServerEnd, Message: "Invalid time"}
+	}
+
+	if e.Paused() {
+		return Error{Code: CodeServerPaused, Message: "Paused"}
+	}
+
+	if !e.ownClient(bid.Client) {
+		return Error{Code: CodeRequestWrongShard, Message: "Wrong shard"}
+	}
+
+	if e.raft != nil && !e.raft.IsLeader() {
+		return Error{Code: CodeServerNotLeader, Message: "Not leader"}
+	}
+
+	// retry of a bid committed after Propose timed out
+	if e.raft != nil {
+		if saved := e.appliedBid(bid); saved != nil {
+			replayBid(bid, saved)
+			return nil
+		}
+	}
+
+	if !e.enterBid() {
+		return Error{Code: CodeServerEnd, Message: "Invalid time"}
+	}
+	// concurrency lock
+	select {
+	case e.bidConcurrentLock <- struct{}{}:
+	case <-ctx.Done():
+		e.bidWaitGroup.Done()
+		return contextError(ctx.Err())
+	}
+
+	err := e.bidProcess(ctx, bid)
 	// concurrency release
 	<-e.bidConcurrentLock
 	e.bidWaitGroup.Done()
@@ -404,22 +1192,34 @@ func (e *Exchange) bid(bid *Bid) error {
 }
 
 // actually bid process
-func (e *Exchange) bidProcess(bid *Bid) error {
+func (e *Exchange) bidProcess(ctx context.Context, bid *Bid) error {
 	if bid.Price < 1 {
 		return Error{Code: CodeRequestInvalidPrice, Message: "Invalid price"}
 	}
 
+	if bid.Price < e.config.ReservePrice {
+		return Error{Code: CodeRequestLTReserve, Message: "Less than ReservePrice"}
+	}
+
+	if bid.Price%e.config.Tick() != 0 {
+		return Error{Code: CodeRequestInvalidTick, Message: "Invalid tick"}
+	}
+
 	bid.Active = true
 
+	// bids of the bidder are checked and stored one by one
+	lock := e.bidderLock(bid.Client)
+	lock.Lock()
 	var err error
-	if e.session == SessionFirstHalf {
-		err = e.bidSession1(bid)
-	} else if e.session == SessionSecondHalf {
-		err = e.bidSession2(bid)
+	session := e.session.Current()
+	if session == SessionFirstHalf {
+		err = e.bidSession1(ctx, bid)
+	} else if session == SessionSecondHalf {
+		err = e.bidSession2(ctx, bid)
 	} else {
-		bid.Active = false
-		return Error{Code: CodeRequestInvalidTime, Message: "Invalid time"}
+		err = Error{Code: CodeRequestInvalidTime, Message: "Invalid time"}
 	}
+	lock.Unlock()
 
 	if err != nil {
 		bid.Active = false
@@ -429,149 +1229,274 @@ func (e *Exchange) bidProcess(bid *Bid) error {
 	// bid success, update TailBid
 	// only if bidders gte capacity in first half
 	// and second half
-	if e.session == SessionSecondHalf || e.BiddersCount() >= e.config.Capacity {
-		e.lowestPrice = e.store.TailBid.Price
-		e.lowestTime = e.store.TailBid.Time
+	if session == SessionSecondHalf || e.BiddersCount() >= e.config.Capacity {
+		if e.collectLowestPrice() && session == SessionSecondHalf {
+			e.notifySoftClose()
+		}
 	}
 
 	return nil
 }
 
-func (e *Exchange) bidSession1(bid *Bid) error {
+// bidderLock return the lock of bidder, bidders may share a lock
+func (e *Exchange) bidderLock(client int) *sync.Mutex {
+	return &e.bidderLocks[uint(client)%uint(len(e.bidderLocks))]
+}
+
+// notifySoftClose notify Serve to extend EndTime, never block bidding
+func (e *Exchange) notifySoftClose() {
+	if e.config.SoftCloseWindow <= 0 {
+		return
+	}
+
+	select {
+	case e.softCloseSign <- struct{}{}:
+	default:
+	}
+}
+
+func (e *Exchange) bidSession1(ctx context.Context, bid *Bid) error {
 	if b := e.store.GetBidderBlock(bid.Client); b != nil {
 		return Error{Code: CodeRequestAttendFirstRound, Message: "Attend first round"}
 	}
 
+	// sealed-bid mode, only accept revealed bid matching commitment
+	var c *Commitment
+	if e.config.RevealWindow > 0 {
+		if c = e.store.GetCommitment(bid.Client); c == nil {
+			return Error{Code: CodeRequestNotCommit, Message: "Not commit"}
+		}
+		if time.Now().Before(e.revealTime()) {
+			return Error{Code: CodeRequestRevealWindow, Message: "Reveal window"}
+		}
+		if !c.Match(bid) {
+			return Error{Code: CodeRequestCommitMismatch, Message: "Commitment mismatch"}
+		}
+	}
+
 	if e.config.WarningPrice > 0 && bid.Price > e.config.WarningPrice {
 		return Error{Code: CodeRequestGTWarningPrice, Message: "Greater than WarningPrice"}
 	}
 
-	// save to warehouse
+	// save to warehouse, saved by applyEntry after committed if replicated
 	bid.Sequence = 1
-	if err := e.warehouse.Add(bid); err != nil {
+	bid.Time = e.clock.Now()
+	if err := e.saveBid(ctx, bid); err != nil {
 		return err
 	}
 
 	// check db save time
-	if bid.Time.After(e.config.HalfTime) || bid.Time.Equal(e.config.HalfTime) {
+	halfTime, _ := e.schedule()
+	if bid.Time.After(halfTime) || bid.Time.Equal(halfTime) {
 		return Error{Code: CodeRequestEnd1, Message: "End"}
 	}
 
-	// save to store
-	e.store.Add(bid)
+	// save to store, unless retry replayed by warehouse is stored already
+	if e.storedBid(bid) {
+		return nil
+	}
+	if err := e.storeBid(bid); err != nil {
+		return err
+	}
 	atomic.AddUint64(&e.counterProcess, 1)
 
 	return nil
 }
 
-func (e *Exchange) bidSession2(bid *Bid) error {
-	b := e.store.GetBidderBlock(bid.Client) // bidder's block
-	if b == nil {
+func (e *Exchange) bidSession2(ctx context.Context, bid *Bid) error {
+	bids := e.store.Bids(bid.Client) // bidder's bids
+	if len(bids) == 0 {
+		if e.store.GetCommitment(bid.Client) != nil {
+			return Error{Code: CodeRequestNotReveal, Message: "Not reveal"}
+		}
 		return Error{Code: CodeRequestNotAttendFirstRound, Message: "Not attend first round"}
 	}
 
-	if b.Total >= BidsPerBidder {
+	if len(bids) >= BidsPerBidder {
 		return Error{Code: CodeRequestAllIn, Message: "Allin"}
 	}
 
 	// compare with previous bid
-	for _, preBid := range b.Bids {
+	for _, preBid := range bids {
 		if preBid.Price == bid.Price {
 			return Error{Code: CodeRequestSamePrice, Message: "Same price"}
 		}
 	}
 
 	// check price in bound
-	if bid.Price-e.lowestPrice > PricingDelta || e.lowestPrice-bid.Price > PricingDelta {
+	delta := PricingDelta * e.config.Tick()
+	lowestPrice, _ := e.lowest()
+	if bid.Price-lowestPrice > delta || lowestPrice-bid.Price > delta {
 		return Error{Code: CodeRequestOutOfRange, Message: "Out of Range"}
 	}
 
-	// save to warehouse
-	bid.Sequence = int(b.Total) + 1
-	if err := e.warehouse.Add(bid); err != nil {
+	// save to warehouse, saved by applyEntry after committed if replicated
+	bid.Sequence = len(bids) + 1
+	bid.Time = e.clock.Now()
+	if err := e.saveBid(ctx, bid); err != nil {
 		return err
 	}
 
 	// check db save time
-	if bid.Time.After(e.config.EndTime) || bid.Time.Equal(e.config.EndTime) {
+	_, endTime := e.schedule()
+	if bid.Time.After(endTime) || bid.Time.Equal(endTime) {
 		return Error{Code: CodeRequestEnd2, Message: "End"}
 	}
 
-	// save to store
-	e.store.Add(bid)
+	// save to store, unless retry replayed by warehouse is stored already
+	if e.storedBid(bid) {
+		return nil
+	}
+	if err := e.storeBid(bid); err != nil {
+		return err
+	}
 	atomic.AddUint64(&e.counterProcess, 1)
 
 	return nil
 }
 
-func (e *Exchange) toggleStart() {
-	e.sysLog.Println("===============================")
-	e.sysLog.Printf(">>> Session %d @ %s", e.session, time.Now().Format("15:04:05.000000"))
-	e.sysLog.Println("===============================")
+// saveBid save bid to warehouse, or decide time by leader if replicated
+func (e *Exchange) saveBid(ctx context.Context, bid *Bid) error {
+	if e.raft == nil {
+		return e.warehouse.Add(ctx, bid)
+	}
+
+	if bid.Time.IsZero() {
+		bid.Time = time.Now().Truncate(time.Microsecond)
+	}
+	return nil
 }
 
-func (e *Exchange) toggleHalf() {
-	e.sysLog.Println("===============================")
-	e.sysLog.Printf(">>> Session %d @ %s", e.session, time.Now().Format("15:04:05.000000"))
-	e.sysLog.Println("===============================")
+// saveWithdraw save withdrawal to warehouse, or decide time by leader if replicated
+func (e *Exchange) saveWithdraw(bid *Bid) error {
+	if e.raft == nil {
+		return e.warehouse.Withdraw(context.Background(), bid)
+	}
+
+	if bid.WithdrawTime.IsZero() {
+		bid.WithdrawTime = time.Now().Truncate(time.Microsecond)
+	}
+	return nil
+}
+
+// saveCommitment save commitment to warehouse, or decide time by leader if replicated
+func (e *Exchange) saveCommitment(c *Commitment) error {
+	if e.raft == nil {
+		return e.warehouse.AddCommitment(context.Background(), c)
+	}
+
+	if c.Time.IsZero() {
+		c.Time = time.Now().Truncate(time.Microsecond)
+	}
+	return nil
+}
+
+// storedBid check bid is in store, eg, a retry with Bid.RequestID saved by previous attempt
+func (e *Exchange) storedBid(bid *Bid) bool {
+	bids := e.store.Bids(bid.Client)
+	return len(bids) >= bid.Sequence && bids[bid.Sequence-1].Serial == bid.Serial
 }
 
-func (e *Exchange) toggleEnd() {
+// logSession log each session change
+func (e *Exchange) logSession(from, to int) {
 	e.sysLog.Println("===============================")
-	e.sysLog.Printf(">>> Session %d @ %s", e.session, time.Now().Format("15:04:05.000000"))
+	e.sysLog.Printf(">>> Session %d → %d @ %s", from, to, time.Now().Format("15:04:05.000000"))
 	e.sysLog.Println("===============================")
 }
 
-// startCollector start a time.Ticker to collect system state per second
-func (e *Exchange) startCollector() {
+// startCollector collect system state per tick of ticker, ticker is owned by Serve
+func (e *Exchange) startCollector(ticker *time.Ticker) {
 	e.collectStat()
 	defer e.collectStat()
 
-	e.stateTicker = time.NewTicker(time.Millisecond * 1000)
 	for {
 		select {
-		case <-e.stateTicker.C:
+		case <-ticker.C:
 			e.collectStat()
 		case <-e.quitStateTickerSign:
 			// release resources avoid memory leak
-			e.stateTicker.Stop()
-			e.stateTicker = nil
+			ticker.Stop()
 			return
 		}
 	}
 }
 
+// stopCollector must be called in Serve
 func (e *Exchange) stopCollector() {
 	if e.stateTicker != nil {
 		e.quitStateTickerSign <- struct{}{}
+		e.stateTicker = nil
 	}
 }
 
 func (e *Exchange) collectStat() {
-	if e.session == SessionFirstHalf {
+	session := e.session.Current()
+	if session == SessionFirstHalf {
 		e.collectCountBidders()
 	}
+	_, endTime := e.schedule()
 
+	e.statLock.Lock()
 	e.state.Time = time.Now()
-	e.state.Session = e.session
+	e.state.Session = session
+	e.state.EndTime = endTime
 	e.state.Bidders = e.bidders
 	e.state.LowestPrice = e.lowestPrice
 	e.state.LowestTime = e.lowestTime
+	state := *e.state
+	e.history = append(e.history, state)
+	e.statLock.Unlock()
 
-	e.sysLog.Printf("%s %3.0f %4d @ %s, B %6d, O %6d, G %6d, H %6d, P %6d\n", time.Now().Format("15:04:05.000000"), e.config.EndTime.Sub(time.Now()).Seconds(), e.state.LowestPrice, e.state.LowestTime.Format("15:04:05"), e.state.Bidders, e.BidsCount(), runtime.NumGoroutine(), atomic.SwapUint64(&e.counterHit, 0), atomic.SwapUint64(&e.counterProcess, 0))
+	e.sysLog.Printf("%s %3.0f %4d @ %s, B %6d, O %6d, G %6d, H %6d, P %6d\n", time.Now().Format("15:04:05.000000"), endTime.Sub(time.Now()).Seconds(), state.LowestPrice, state.LowestTime.Format("15:04:05"), state.Bidders, e.BidsCount(), runtime.NumGoroutine(), atomic.SwapUint64(&e.counterHit, 0), atomic.SwapUint64(&e.counterProcess, 0))
 }
 
-func (e *Exchange) collectLowestPrice() {
-	if e.store.TailBid != nil {
-		e.lowestPrice = e.store.TailBid.Price
-		e.lowestTime = e.store.TailBid.Time
+// collectLowestPrice update lowest price by TailBid, return true if changed
+func (e *Exchange) collectLowestPrice() bool {
+	if e.config.ShardCount > 0 {
+		return false // pushed by Coordinator
+	}
+
+	tail, ok := e.store.Tail()
+
+	e.statLock.Lock()
+	defer e.statLock.Unlock()
+
+	preLowestPrice := e.lowestPrice
+	if ok {
+		e.lowestPrice = tail.Price
+		e.lowestTime = tail.Time
+	} else if e.config.ReservePrice > 0 {
+		// bidders less than capacity, price range of second half starts from reserve price
+		e.lowestPrice = e.config.ReservePrice
 	} else {
 		// no one attend...
 	}
+	return preLowestPrice != e.lowestPrice
+}
+
+// setLowest set lowest price and bidders computed by Coordinator in cluster mode
+func (e *Exchange) setLowest(price int, t time.Time, bidders int) {
+	e.statLock.Lock()
+	preLowestPrice := e.lowestPrice
+	e.lowestPrice = price
+	e.lowestTime = t
+	e.bidders = bidders
+	e.statLock.Unlock()
+
+	if e.session.Current() == SessionSecondHalf && preLowestPrice != price {
+		e.notifySoftClose()
+	}
 }
 
 func (e *Exchange) collectCountBidders() {
-	e.bidders = e.store.CountBidders()
+	if e.config.ShardCount > 0 {
+		return // pushed by Coordinator
+	}
+
+	bidders := e.store.CountBidders()
+	e.statLock.Lock()
+	e.bidders = bidders
+	e.statLock.Unlock()
 }
 
 // Dump save all final result to log
@@ -582,6 +1507,6 @@ func (e *Exchange) dump() {
 // save final tender to storage
 func (e *Exchange) commitResults() {
 	for _, bid := range e.store.FinalBids {
-		e.warehouse.Commit(bid)
+		e.warehouse.Commit(context.Background(), bid)
 	}
 }
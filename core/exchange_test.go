@@ -0,0 +1,595 @@
+package auccore
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newServingExchange return an *Exchange with MemoryWarehouse serving in first half
+func newServingExchange(t *testing.T, conf Config) *Exchange {
+	t.Setenv("DB_DRIVER", "")
+	e, err := NewExchange(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go e.Serve()
+
+	for i := 0; i < 100 && e.session.Current() == SessionUnprepared; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if e.session.Current() != SessionFirstHalf {
+		t.Fatal("e.session.Current() != SessionFirstHalf")
+	}
+	return e
+}
+
+func bidCode(_ BidResult, err error) int {
+	return errorCode(err)
+}
+
+func errorCode(err error) int {
+	if err == nil {
+		return CodeSuccess
+	}
+	return err.(Error).Code
+}
+
+func TestSealedBid(t *testing.T) {
+	now := time.Now()
+	e := newServingExchange(t, Config{
+		StartTime:    now,
+		HalfTime:     now.Add(time.Millisecond * 800),
+		EndTime:      now.Add(time.Millisecond * 1600),
+		Capacity:     1,
+		RevealWindow: time.Millisecond * 400,
+	})
+	defer e.Halt()
+
+	if code := bidCode(e.Bid(BidRequest{Client: 1, Price: 100})); code != CodeRequestNotCommit {
+		t.Errorf("bid without commitment, code %d", code)
+	}
+	if code := errorCode(e.Commit(1, CommitmentHash(1, 100, "a"))); code != CodeSuccess {
+		t.Errorf("commit, code %d", code)
+	}
+	if code := errorCode(e.Commit(2, CommitmentHash(2, 100, "b"))); code != CodeSuccess {
+		t.Errorf("commit, code %d", code)
+	}
+	if code := bidCode(e.Bid(BidRequest{Client: 1, Price: 100, Nonce: "a"})); code != CodeRequestRevealWindow {
+		t.Errorf("reveal before window, code %d", code)
+	}
+
+	time.Sleep(time.Until(e.revealTime()))
+	if code := errorCode(e.Commit(3, CommitmentHash(3, 100, "c"))); code != CodeRequestRevealWindow {
+		t.Errorf("commit in reveal window, code %d", code)
+	}
+	if code := bidCode(e.Bid(BidRequest{Client: 1, Price: 101, Nonce: "a"})); code != CodeRequestCommitMismatch {
+		t.Errorf("reveal wrong price, code %d", code)
+	}
+	if code := bidCode(e.Bid(BidRequest{Client: 1, Price: 100, Nonce: "a"})); code != CodeSuccess {
+		t.Errorf("reveal, code %d", code)
+	}
+
+	if _, err := e.Enquiry(2); errorCode(err) != CodeRequestNotReveal {
+		t.Errorf("enquiry unrevealed, code %d", errorCode(err))
+	}
+
+	// commitments survive restart
+	restored := NewStore(1)
+	e.warehouse.Restore(restored, e.Config())
+	if d := e.store.Diff(restored); !d.Empty() {
+		t.Errorf("restored store differs %s", d)
+	}
+	if c := restored.GetCommitment(1); c == nil || !c.Revealed {
+		t.Errorf("revealed commitment restored %+v", c)
+	}
+	if c := restored.GetCommitment(2); c == nil || c.Revealed || !c.Match(&Bid{Client: 2, Price: 100, Nonce: "b"}) {
+		t.Errorf("unrevealed commitment restored %+v", c)
+	}
+	if restored.GetCommitment(3) != nil {
+		t.Error("rejected commitment restored")
+	}
+}
+
+func TestIdempotentBid(t *testing.T) {
+	now := time.Now()
+	e := newServingExchange(t, Config{
+		StartTime: now,
+		HalfTime:  now.Add(time.Second * 2),
+		EndTime:   now.Add(time.Second * 4),
+		Capacity:  1,
+	})
+	defer e.Halt()
+
+	first, err := e.Bid(BidRequest{Client: 1, Price: 100, RequestID: "r1"})
+	if code := errorCode(err); code != CodeSuccess {
+		t.Errorf("bid, code %d", code)
+	}
+
+	retry, err := e.Bid(BidRequest{Client: 1, Price: 100, RequestID: "r1"})
+	if code := errorCode(err); code != CodeSuccess {
+		t.Errorf("retry, code %d", code)
+	}
+	if retry.Serial != first.Serial || !retry.Time.Equal(first.Time) || retry.Sequence != first.Sequence {
+		t.Error("retry receipt differs from the original")
+	}
+	if e.BidsCount() != 1 {
+		t.Error("e.BidsCount() != 1")
+	}
+
+	if code := bidCode(e.Bid(BidRequest{Client: 1, Price: 100, RequestID: "r2"})); code != CodeRequestAttendFirstRound {
+		t.Errorf("new request, code %d", code)
+	}
+	if code := bidCode(e.Bid(BidRequest{Client: 1, Price: 100, RequestID: "r2"})); code != CodeRequestAttendFirstRound {
+		t.Errorf("retry rejected request, code %d", code)
+	}
+
+	// saved by warehouse but outcome lost, eg, timeout after saving
+	lost := &Bid{Serial: 100, Client: 2, Price: 100, Sequence: 1, RequestID: "r3"}
+	if err := e.warehouse.Add(context.Background(), lost); err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := e.Bid(BidRequest{Client: 2, Price: 100, RequestID: "r3"})
+	if code := errorCode(err); code != CodeSuccess {
+		t.Errorf("retry saved request, code %d", code)
+	}
+	if replayed.Serial != lost.Serial || !replayed.Time.Equal(lost.Time) {
+		t.Errorf("retry receipt %+v differs from the saved %+v", replayed, lost)
+	}
+	if bids := e.store.Bids(2); len(bids) != 1 || bids[0].Serial != lost.Serial {
+		t.Errorf("saved request not applied to store %+v", bids)
+	}
+}
+
+func TestReservePrice(t *testing.T) {
+	now := time.Now()
+	e := newServingExchange(t, Config{
+		StartTime:    now,
+		HalfTime:     now.Add(time.Second * 2),
+		EndTime:      now.Add(time.Second * 4),
+		Capacity:     2,
+		ReservePrice: 100,
+	})
+	defer e.Halt()
+
+	if code := bidCode(e.Bid(BidRequest{Client: 1, Price: 99})); code != CodeRequestLTReserve {
+		t.Errorf("bid below reserve, code %d", code)
+	}
+	if code := bidCode(e.Bid(BidRequest{Client: 1, Price: 100})); code != CodeSuccess {
+		t.Errorf("bid at reserve, code %d", code)
+	}
+}
+
+func TestTickSize(t *testing.T) {
+	now := time.Now()
+	e := newServingExchange(t, Config{
+		StartTime: now,
+		HalfTime:  now.Add(time.Second * 2),
+		EndTime:   now.Add(time.Second * 4),
+		Capacity:  2,
+		TickSize:  100,
+		PriceUnit: 1,
+	})
+	defer e.Halt()
+
+	if code := bidCode(e.Bid(BidRequest{Client: 1, Price: 86350})); code != CodeRequestInvalidTick {
+		t.Errorf("bid off tick, code %d", code)
+	}
+	if code := bidCode(e.Bid(BidRequest{Client: 1, Price: 86300})); code != CodeSuccess {
+		t.Errorf("bid on tick, code %d", code)
+	}
+}
+
+func TestPauseAndExtend(t *testing.T) {
+	now := time.Now()
+	e := newServingExchange(t, Config{
+		StartTime: now,
+		HalfTime:  now.Add(time.Millisecond * 500),
+		EndTime:   now.Add(time.Millisecond * 1000),
+		Capacity:  1,
+	})
+	defer e.Halt()
+
+	if err := e.Pause("incident"); err != nil {
+		t.Error(err)
+	}
+	if code := bidCode(e.Bid(BidRequest{Client: 1, Price: 100})); code != CodeServerPaused {
+		t.Errorf("bid while paused, code %d", code)
+	}
+	if err := e.Resume("recovered"); err != nil {
+		t.Error(err)
+	}
+	if code := bidCode(e.Bid(BidRequest{Client: 1, Price: 100})); code != CodeSuccess {
+		t.Errorf("bid after resume, code %d", code)
+	}
+
+	if code := errorCode(e.Extend(now.Add(time.Millisecond*100), time.Time{}, "shrink")); code != CodeRequestInvalidTime {
+		t.Errorf("bring HalfTime forward, code %d", code)
+	}
+	if code := errorCode(e.Extend(now.Add(time.Millisecond*1500), time.Time{}, "after end")); code != CodeRequestInvalidTime {
+		t.Errorf("HalfTime after EndTime, code %d", code)
+	}
+	if err := e.Extend(now.Add(time.Millisecond*1500), now.Add(time.Millisecond*3000), "compensate"); err != nil {
+		t.Error(err)
+	}
+
+	time.Sleep(time.Until(now.Add(time.Millisecond * 800)))
+	if e.session.Current() != SessionFirstHalf {
+		t.Error("HalfTime not extended")
+	}
+	if len(e.ScheduleChanges()) != 3 {
+		t.Error("len(e.ScheduleChanges()) != 3")
+	}
+}
+
+func TestSoftClose(t *testing.T) {
+	now := time.Now()
+	e := newServingExchange(t, Config{
+		StartTime:          now,
+		HalfTime:           now.Add(time.Millisecond * 300),
+		EndTime:            now.Add(time.Millisecond * 800),
+		Capacity:           1,
+		SoftCloseWindow:    time.Millisecond * 300,
+		SoftCloseExtension: time.Millisecond * 200,
+		SoftCloseCap:       time.Millisecond * 300,
+	})
+	defer e.Halt()
+
+	e.Bid(BidRequest{Client: 1, Price: 100})
+	e.Bid(BidRequest{Client: 2, Price: 100})
+
+	// price change before window does not extend
+	time.Sleep(time.Until(now.Add(time.Millisecond * 350)))
+	if code := bidCode(e.Bid(BidRequest{Client: 1, Price: 101})); code != CodeSuccess {
+		t.Errorf("bid, code %d", code)
+	}
+
+	time.Sleep(time.Until(now.Add(time.Millisecond * 600)))
+	if code := bidCode(e.Bid(BidRequest{Client: 2, Price: 102})); code != CodeSuccess {
+		t.Errorf("bid, code %d", code)
+	}
+	time.Sleep(time.Until(now.Add(time.Millisecond * 750)))
+	if code := bidCode(e.Bid(BidRequest{Client: 1, Price: 103})); code != CodeSuccess {
+		t.Errorf("bid, code %d", code)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+	changes := e.ScheduleChanges()
+	if len(changes) != 2 {
+		t.Fatalf("len(changes) != 2, %v", changes)
+	}
+	if !changes[1].EndTime.Equal(now.Add(time.Millisecond * 1100)) {
+		t.Error("soft close extension exceeds cap")
+	}
+}
+
+func TestSoftCloseWithdraw(t *testing.T) {
+	now := time.Now()
+	e := newServingExchange(t, Config{
+		StartTime:          now,
+		HalfTime:           now.Add(time.Millisecond * 300),
+		EndTime:            now.Add(time.Millisecond * 800),
+		Capacity:           1,
+		WithdrawWindow:     time.Millisecond * 400,
+		SoftCloseWindow:    time.Millisecond * 300,
+		SoftCloseExtension: time.Millisecond * 200,
+		SoftCloseCap:       time.Millisecond * 300,
+	})
+	defer e.Halt()
+
+	e.Bid(BidRequest{Client: 1, Price: 100})
+	e.Bid(BidRequest{Client: 2, Price: 100})
+	time.Sleep(time.Until(now.Add(time.Millisecond * 350)))
+	tail, err := e.Bid(BidRequest{Client: 1, Price: 102})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// withdrawal of TailBid in window moves the lowest price
+	time.Sleep(time.Until(now.Add(time.Millisecond * 600)))
+	if err := e.Withdraw(1, tail.Serial); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 50)
+	changes := e.ScheduleChanges()
+	if len(changes) != 1 || !changes[0].EndTime.After(now.Add(time.Millisecond*800)) {
+		t.Errorf("withdrawal not extending EndTime, %v", changes)
+	}
+}
+
+func TestBidContext(t *testing.T) {
+	now := time.Now()
+	e := newServingExchange(t, Config{
+		StartTime: now,
+		HalfTime:  now.Add(time.Second * 2),
+		EndTime:   now.Add(time.Second * 4),
+		Capacity:  1,
+	})
+	defer e.Halt()
+
+	// warehouse latency is at least 10ms
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if code := bidCode(e.BidContext(ctx, BidRequest{Client: 1, Price: 100})); code != CodeRequestTimeout {
+		t.Errorf("bid exceeding deadline, code %d", code)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if code := bidCode(e.BidContext(ctx, BidRequest{Client: 1, Price: 100})); code != CodeRequestCanceled {
+		t.Errorf("bid canceled, code %d", code)
+	}
+
+	if code := bidCode(e.BidContext(context.Background(), BidRequest{Client: 1, Price: 100})); code != CodeSuccess {
+		t.Errorf("bid after timeout, code %d", code)
+	}
+}
+
+func TestWarehouseChaos(t *testing.T) {
+	now := time.Now()
+	e := newServingExchange(t, Config{
+		StartTime: now,
+		HalfTime:  now.Add(time.Millisecond * 500),
+		EndTime:   now.Add(time.Second * 3),
+		Capacity:  1,
+	})
+	defer e.Halt()
+	w := e.warehouse.(*MemoryWarehouse)
+
+	w.SetChaos(Chaos{ErrorRate: 1})
+	if code := bidCode(e.Bid(BidRequest{Client: 1, Price: 100})); code < CodeServerSaveError0 || code > CodeServerSaveError4 {
+		t.Errorf("bid with failing warehouse, code %d", code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	w.SetChaos(Chaos{TimeoutRate: 1})
+	if code := bidCode(e.BidContext(ctx, BidRequest{Client: 1, Price: 100})); code != CodeRequestTimeout {
+		t.Errorf("bid with hanging warehouse, code %d", code)
+	}
+
+	// warehouse clock ahead, saved after HalfTime
+	w.SetChaos(Chaos{Skew: time.Second})
+	if code := bidCode(e.Bid(BidRequest{Client: 1, Price: 100})); code != CodeRequestEnd1 {
+		t.Errorf("bid saved after HalfTime, code %d", code)
+	}
+	w.SetChaos(Chaos{})
+	if code := bidCode(e.Bid(BidRequest{Client: 2, Price: 100})); code != CodeSuccess {
+		t.Errorf("bid, code %d", code)
+	}
+
+	time.Sleep(time.Until(now.Add(time.Millisecond * 600)))
+	w.SetChaos(Chaos{Skew: time.Second * 3})
+	if code := bidCode(e.Bid(BidRequest{Client: 2, Price: 101})); code != CodeRequestEnd2 {
+		t.Errorf("bid saved after EndTime, code %d", code)
+	}
+
+	// rejected bids saved in warehouse are ignored on restore
+	restored := NewStore(0)
+	w.Restore(restored, e.Config())
+	if !e.store.Equal(restored) || restored.CountBids() != 1 {
+		t.Error("restored store differs")
+	}
+}
+
+func TestExchangeWithdraw(t *testing.T) {
+	now := time.Now()
+	e := newServingExchange(t, Config{
+		StartTime:      now,
+		HalfTime:       now.Add(time.Millisecond * 300),
+		EndTime:        now.Add(time.Second * 3),
+		Capacity:       1,
+		WithdrawWindow: time.Millisecond * 200,
+	})
+	defer e.Halt()
+	w := e.warehouse.(*MemoryWarehouse)
+
+	first, _ := e.Bid(BidRequest{Client: 1, Price: 100})
+	e.Bid(BidRequest{Client: 2, Price: 100})
+	time.Sleep(time.Until(now.Add(time.Millisecond * 350)))
+
+	second, err := e.Bid(BidRequest{Client: 1, Price: 102})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if price, _ := e.lowest(); price != 102 {
+		t.Errorf("lowest price %d before withdrawal", price)
+	}
+	for _, serial := range []int{first.Serial, second.Serial + 100} {
+		if code := errorCode(e.Withdraw(1, serial)); code != CodeRequestNotWithdrawable {
+			t.Errorf("withdraw serial %d, code %d", serial, code)
+		}
+	}
+	if err := e.Withdraw(1, second.Serial); err != nil {
+		t.Fatal(err)
+	}
+	if price, _ := e.lowest(); price != 100 {
+		t.Errorf("lowest price %d after withdrawal", price)
+	}
+	if code := errorCode(e.Withdraw(1, second.Serial)); code != CodeRequestNotWithdrawable {
+		t.Errorf("withdraw twice, code %d", code)
+	}
+
+	// concurrent withdrawals of a bid, only one is saved
+	third, _ := e.Bid(BidRequest{Client: 2, Price: 101})
+	var wg sync.WaitGroup
+	var succeeded int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if e.Withdraw(2, third.Serial) == nil {
+				atomic.AddInt32(&succeeded, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	w.withdrawalsLock.Lock()
+	saved := len(w.withdrawals)
+	w.withdrawalsLock.Unlock()
+	if succeeded != 1 || saved != 2 {
+		t.Errorf("concurrent withdrawals, %d succeeded, %d saved", succeeded, saved)
+	}
+
+	late, _ := e.Bid(BidRequest{Client: 1, Price: 103})
+	time.Sleep(time.Millisecond * 250)
+	if code := errorCode(e.Withdraw(1, late.Serial)); code != CodeRequestWithdrawExpired {
+		t.Errorf("withdraw after window, code %d", code)
+	}
+
+	// withdrawals replayed on restore
+	restored := NewStore(1)
+	w.Restore(restored, e.Config())
+	restored.SortAllBlocks()
+	if !e.store.Equal(restored) {
+		t.Errorf("restored store differs %s", e.store.Diff(restored))
+	}
+	if bids := restored.Bids(2); len(bids) != 2 || !bids[1].Withdrawn || !bids[0].Active {
+		t.Errorf("withdrawal not restored %+v", bids)
+	}
+	// same code as bid once sealed
+	e.Seal()
+	if code := errorCode(e.Withdraw(1, late.Serial)); code != CodeServerEnd {
+		t.Errorf("withdraw after seal, code %d", code)
+	}
+}
+
+func TestSealInFlight(t *testing.T) {
+	now := time.Now()
+	e := newServingExchange(t, Config{
+		StartTime: now,
+		HalfTime:  now.Add(time.Second * 5),
+		EndTime:   now.Add(time.Second * 10),
+		Capacity:  10,
+	})
+	defer e.Halt()
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	accepted := 0
+	for client := 1; client <= 200; client++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			if _, err := e.Bid(BidRequest{Client: client, Price: 100}); err == nil {
+				lock.Lock()
+				accepted++
+				lock.Unlock()
+			}
+		}(client)
+	}
+	time.Sleep(time.Millisecond * 5)
+	e.Seal()
+	n := e.store.CountBids()
+	wg.Wait()
+
+	// accepted bids are all judged, none is added after sealing
+	if n != accepted || e.store.CountBids() != accepted {
+		t.Errorf("judged %d, stored %d, accepted %d", n, e.store.CountBids(), accepted)
+	}
+}
+
+func TestSealReconcile(t *testing.T) {
+	now := time.Now()
+	e := newServingExchange(t, Config{
+		StartTime: now,
+		HalfTime:  now.Add(time.Millisecond * 300),
+		EndTime:   now.Add(time.Millisecond * 600),
+		Capacity:  1,
+		Reconcile: ReconcileWarehouse,
+	})
+	defer e.Close()
+
+	for client := 1; client <= 2; client++ {
+		if code := bidCode(e.Bid(BidRequest{Client: client, Price: 100 * client})); code != CodeSuccess {
+			t.Fatalf("bid, code %d", code)
+		}
+	}
+	// lost by warehouse
+	e.store.Add(&Bid{Client: 3, Price: 300, Time: time.Now(), Sequence: 1, Active: true})
+
+	for e.Session() < SessionFinished {
+		time.Sleep(time.Millisecond * 10)
+	}
+	final := e.Seal()
+	if d := e.SealDiff(); d == nil || len(d.Missing) != 1 || d.Missing[0] != 3 {
+		t.Errorf("unexpected diff %s", d)
+	}
+	if final == nil || final.LowestPrice != 200 {
+		t.Fatalf("final not judged from warehouse %+v", final)
+	}
+	changes := e.Reconciled()
+	if len(changes) != 2 {
+		t.Fatalf("unexpected changes %v", changes)
+	}
+	if c := changes[0]; c.Client != 2 || c.Before != BidStatusLost || c.After != BidStatusWon {
+		t.Errorf("unexpected change %v", c)
+	}
+	if c := changes[1]; c.Client != 3 || c.Before != BidStatusWon || c.After != BidStatusMissing {
+		t.Errorf("unexpected change %v", c)
+	}
+	if bids := e.SuccessfulBids(); len(bids) != 1 || bids[0].Client != 2 {
+		t.Errorf("unexpected successful bids %v", bids)
+	}
+}
+
+func TestExchangeTimeSource(t *testing.T) {
+	now := time.Now()
+	e := newServingExchange(t, Config{
+		StartTime: now,
+		HalfTime:  now.Add(time.Second * 2),
+		EndTime:   now.Add(time.Second * 4),
+		Capacity:  1,
+	})
+	defer e.Halt()
+	e.SetTimeSource(NewHybridClock(NewLocalClock()))
+
+	r1, err1 := e.Bid(BidRequest{Client: 1, Price: 100})
+	r2, err2 := e.Bid(BidRequest{Client: 2, Price: 100})
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	if !r2.Time.After(r1.Time) || r1.Time.Before(now) {
+		t.Errorf("unexpected time %s, %s", r1.Time, r2.Time)
+	}
+
+	// warehouse keeps time of TimeSource
+	restored := NewStore(0)
+	e.warehouse.Restore(restored, e.Config())
+	if d := e.store.Diff(restored); len(d.Bids) > 0 || len(d.Missing) > 0 {
+		t.Errorf("warehouse differs %s", d)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	now := time.Now()
+	valid := Config{StartTime: now, HalfTime: now.Add(time.Second), EndTime: now.Add(time.Second * 2), Capacity: 1, TickSize: 100, ReservePrice: 8000, WarningPrice: 9000}
+	if err := valid.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	invalid := []func(c *Config){
+		func(c *Config) { c.ReservePrice = 8050 },
+		func(c *Config) { c.WarningPrice = 9050 },
+		func(c *Config) { c.ReservePrice = 10000 },
+		func(c *Config) { c.PriceUnit = -1 },
+		func(c *Config) { c.EndTime = c.HalfTime },
+		func(c *Config) { c.RevealWindow = time.Second },
+	}
+	for i, f := range invalid {
+		c := valid
+		f(&c)
+		if code := errorCode(c.Validate()); code != CodeServerInvalidConfig {
+			t.Errorf("invalid config %d, code %d", i, code)
+		}
+	}
+
+	c := valid
+	c.ReservePrice = 8050
+	t.Setenv("DB_DRIVER", "")
+	if e, err := NewExchange(c); e != nil || errorCode(err) != CodeServerInvalidConfig {
+		t.Errorf("NewExchange accepted invalid config, code %d", errorCode(err))
+	}
+}
@@ -0,0 +1,698 @@
+package auccore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Kafka wire protocol, only Produce and Fetch API v0 with message format v0 are implemented,
+// which are supported by Kafka brokers from 0.10 to 3.x, Kafka 4.0 removed them,
+// versions are checked by ApiVersions on connect and fail with ErrKafkaUnsupportedVersion
+const (
+	kafkaApiProduce            = 0
+	kafkaApiFetch              = 1
+	kafkaApiVersions           = 18
+	kafkaErrNone               = 0
+	kafkaErrCorrupt            = 2
+	kafkaErrUnsupportedVersion = 35
+	kafkaClientID              = "aucser"
+	kafkaMaxRequestBytes       = 100 << 20
+)
+
+var errKafkaProtocol = errors.New("kafka: malformed message")
+
+// ErrKafkaUnsupportedVersion is returned if broker does not support API v0, eg, Kafka 4.0
+var ErrKafkaUnsupportedVersion = errors.New("kafka: unsupported version, need broker from 0.10 to 3.x")
+
+// KafkaSink produce BidEvent as JSON to a Kafka topic, keyed by client
+type KafkaSink struct {
+	Broker     string
+	Topic      string
+	Partitions int // events partitioned by client, 0 for 1
+	Timeout    time.Duration
+
+	conn          net.Conn
+	correlationID int32
+}
+
+func NewKafkaSink(broker, topic string, partitions int) *KafkaSink {
+	return &KafkaSink{
+		Broker:     broker,
+		Topic:      topic,
+		Partitions: partitions,
+		Timeout:    time.Second * 5,
+	}
+}
+
+// Publish produce events with acks=1, reconnect next time if failed
+func (s *KafkaSink) Publish(events []BidEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	partitions := s.Partitions
+	if partitions < 1 {
+		partitions = 1
+	}
+	sets := make(map[int32]*kafkaWriter)
+	for i := range events {
+		value, err := json.Marshal(&events[i])
+		if err != nil {
+			return err
+		}
+		p := int32(ShardOf(events[i].Client, partitions))
+		if sets[p] == nil {
+			sets[p] = &kafkaWriter{}
+		}
+		sets[p].message(0, []byte(strconv.Itoa(events[i].Client)), value)
+	}
+
+	s.correlationID++
+	req := &kafkaWriter{}
+	req.int16(kafkaApiProduce)
+	req.int16(0) // version
+	req.int32(s.correlationID)
+	req.string(kafkaClientID)
+	req.int16(1) // acks
+	req.int32(int32(s.Timeout / time.Millisecond))
+	req.int32(1) // topics
+	req.string(s.Topic)
+	req.int32(int32(len(sets)))
+	for p, set := range sets {
+		req.int32(p)
+		req.bytes(set.Bytes())
+	}
+
+	if err := s.roundTrip(req); err != nil {
+		if s.conn != nil {
+			s.conn.Close()
+			s.conn = nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *KafkaSink) Close() error {
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
+
+func (s *KafkaSink) roundTrip(req *kafkaWriter) error {
+	if s.conn == nil {
+		conn, err := dialKafka(s.Broker, s.Timeout, kafkaApiProduce)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	s.conn.SetDeadline(time.Now().Add(s.Timeout))
+
+	if err := writeKafkaFrame(s.conn, req.Bytes()); err != nil {
+		return err
+	}
+	resp, err := readKafkaFrame(s.conn)
+	if err != nil {
+		return err
+	}
+
+	r := &kafkaReader{b: resp}
+	if r.int32() != s.correlationID {
+		return errKafkaProtocol
+	}
+	for topics := r.int32(); topics > 0 && r.err == nil; topics-- {
+		topic := r.string()
+		for partitions := r.int32(); partitions > 0 && r.err == nil; partitions-- {
+			p := r.int32()
+			code := r.int16()
+			r.int64() // base offset
+			if code == kafkaErrUnsupportedVersion {
+				return ErrKafkaUnsupportedVersion
+			} else if code != kafkaErrNone {
+				return fmt.Errorf("kafka: produce %s/%d error code %d", topic, p, code)
+			}
+		}
+	}
+
+	return r.err
+}
+
+// dialKafka connect to broker and check it supports v0 of api by ApiVersions v0
+func dialKafka(broker string, timeout time.Duration, api int16) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", broker, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	req := &kafkaWriter{}
+	req.int16(kafkaApiVersions)
+	req.int16(0) // version
+	req.int32(0) // correlation id
+	req.string(kafkaClientID)
+	if err := writeKafkaFrame(conn, req.Bytes()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := readKafkaFrame(conn)
+	if err != nil {
+		// brokers before 0.10 close the connection on ApiVersions
+		conn.Close()
+		return nil, fmt.Errorf("kafka: ApiVersions failed, need broker from 0.10 to 3.x: %w", err)
+	}
+
+	r := &kafkaReader{b: resp}
+	r.int32() // correlation id
+	code := r.int16()
+	supported := false
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		key, min := r.int16(), r.int16()
+		r.int16() // max version
+		if key == api && min == 0 {
+			supported = true
+		}
+	}
+	if r.err != nil {
+		conn.Close()
+		return nil, r.err
+	}
+	if code != kafkaErrNone || !supported {
+		conn.Close()
+		return nil, ErrKafkaUnsupportedVersion
+	}
+
+	return conn, nil
+}
+
+// KafkaMessage is a message kept by LocalBroker
+type KafkaMessage struct {
+	Offset int64
+	Key    []byte
+	Value  []byte
+}
+
+// LocalBroker is an in-process stand-in of Kafka broker for test and local run,
+// accept ApiVersions, Produce and Fetch API v0 and keep all messages in memory
+type LocalBroker struct {
+	sync.RWMutex
+	listener net.Listener
+	logs     map[string]map[int32][]KafkaMessage
+	wg       sync.WaitGroup
+}
+
+// NewLocalBroker listen on addr, eg, "127.0.0.1:0" for a random port
+func NewLocalBroker(addr string) (*LocalBroker, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &LocalBroker{
+		listener: l,
+		logs:     make(map[string]map[int32][]KafkaMessage),
+	}
+	b.wg.Add(1)
+	go b.serve()
+
+	return b, nil
+}
+
+// Addr return the listening address
+func (b *LocalBroker) Addr() string {
+	return b.listener.Addr().String()
+}
+
+// Messages return messages of topic partition from offset
+func (b *LocalBroker) Messages(topic string, partition int32, offset int64) []KafkaMessage {
+	b.RLock()
+	defer b.RUnlock()
+
+	msgs := b.logs[topic][partition]
+	if offset >= int64(len(msgs)) {
+		return nil
+	}
+	return append([]KafkaMessage(nil), msgs[offset:]...)
+}
+
+func (b *LocalBroker) Close() error {
+	err := b.listener.Close()
+	b.wg.Wait()
+
+	return err
+}
+
+func (b *LocalBroker) serve() {
+	defer b.wg.Done()
+
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *LocalBroker) handle(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		frame, err := readKafkaFrame(conn)
+		if err != nil {
+			return
+		}
+
+		r := &kafkaReader{b: frame}
+		apiKey, version, correlationID := r.int16(), r.int16(), r.int32()
+		r.string() // client id
+		if r.err != nil || version != 0 {
+			return // unsupported request
+		}
+
+		resp := &kafkaWriter{}
+		resp.int32(correlationID)
+		reply := true
+		if apiKey == kafkaApiProduce {
+			reply = b.produce(r, resp)
+		} else if apiKey == kafkaApiFetch {
+			b.fetch(r, resp)
+		} else if apiKey == kafkaApiVersions {
+			resp.int16(kafkaErrNone)
+			resp.int32(3)
+			for _, api := range []int16{kafkaApiProduce, kafkaApiFetch, kafkaApiVersions} {
+				resp.int16(api)
+				resp.int16(0) // min version
+				resp.int16(0) // max version
+			}
+		} else {
+			return // unsupported request
+		}
+		if r.err != nil {
+			return
+		}
+
+		if reply {
+			if err := writeKafkaFrame(conn, resp.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// produce handle Produce request v0, return false if acks=0
+func (b *LocalBroker) produce(r *kafkaReader, resp *kafkaWriter) bool {
+	acks := r.int16()
+	r.int32() // timeout
+	topics := r.int32()
+	resp.int32(topics)
+	for ; topics > 0 && r.err == nil; topics-- {
+		topic := r.string()
+		resp.string(topic)
+		partitions := r.int32()
+		resp.int32(partitions)
+		for ; partitions > 0 && r.err == nil; partitions-- {
+			p := r.int32()
+			offset, code := b.append(topic, p, r.bytes())
+			resp.int32(p)
+			resp.int16(code)
+			resp.int64(offset)
+		}
+	}
+
+	return acks != 0
+}
+
+// fetch handle Fetch request v0, never wait for new messages
+func (b *LocalBroker) fetch(r *kafkaReader, resp *kafkaWriter) {
+	r.int32() // replica id
+	r.int32() // max wait
+	r.int32() // min bytes
+	topics := r.int32()
+	resp.int32(topics)
+	for ; topics > 0 && r.err == nil; topics-- {
+		topic := r.string()
+		resp.string(topic)
+		partitions := r.int32()
+		resp.int32(partitions)
+		for ; partitions > 0 && r.err == nil; partitions-- {
+			p, offset, maxBytes := r.int32(), r.int64(), r.int32()
+
+			b.RLock()
+			msgs := b.logs[topic][p]
+			highWatermark := int64(len(msgs))
+			set := &kafkaWriter{}
+			for i := offset; i >= 0 && i < highWatermark; i++ {
+				m := msgs[i]
+				if set.Len() > 0 && set.Len()+len(m.Key)+len(m.Value)+26 > int(maxBytes) {
+					break
+				}
+				set.message(m.Offset, m.Key, m.Value)
+			}
+			b.RUnlock()
+
+			resp.int32(p)
+			resp.int16(kafkaErrNone)
+			resp.int64(highWatermark)
+			resp.bytes(set.Bytes())
+		}
+	}
+}
+
+// append decode message set and save to log, return base offset
+func (b *LocalBroker) append(topic string, partition int32, set []byte) (int64, int16) {
+	msgs, err := decodeMessageSet(set, false)
+	if err != nil {
+		return -1, kafkaErrCorrupt
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.logs[topic] == nil {
+		b.logs[topic] = make(map[int32][]KafkaMessage)
+	}
+	base := int64(len(b.logs[topic][partition]))
+	for i := range msgs {
+		msgs[i].Offset = base + int64(i)
+	}
+	b.logs[topic][partition] = append(b.logs[topic][partition], msgs...)
+
+	return base, kafkaErrNone
+}
+
+// decodeMessageSet decode v0 messages, offset assigned by producer is meaningless.
+// A fetched message set may end with a partial message which is ignored
+func decodeMessageSet(set []byte, fetched bool) ([]KafkaMessage, error) {
+	var msgs []KafkaMessage
+	r := &kafkaReader{b: set}
+	for r.pos < len(r.b) {
+		offset := r.int64()
+		raw := r.bytes()
+		if r.err != nil {
+			if fetched {
+				break
+			}
+			return nil, r.err
+		}
+
+		m := &kafkaReader{b: raw}
+		crc := uint32(m.int32())
+		if m.err != nil || crc != crc32.ChecksumIEEE(m.b[4:]) {
+			return nil, errKafkaProtocol
+		}
+		m.int8() // magic
+		m.int8() // attributes
+		key, value := m.bytes(), m.bytes()
+		if m.err != nil {
+			return nil, errKafkaProtocol
+		}
+		msgs = append(msgs, KafkaMessage{Offset: offset, Key: key, Value: value})
+	}
+
+	return msgs, nil
+}
+
+// KafkaSource consume BidEvent produced by KafkaSink from all partitions
+type KafkaSource struct {
+	Broker     string
+	Topic      string
+	Partitions int // 0 for 1
+	MaxBytes   int32
+	Timeout    time.Duration
+
+	offsets       []int64 // next offset of each partition
+	conn          net.Conn
+	correlationID int32
+}
+
+func NewKafkaSource(broker, topic string, partitions int) *KafkaSource {
+	if partitions < 1 {
+		partitions = 1
+	}
+	return &KafkaSource{
+		Broker:     broker,
+		Topic:      topic,
+		Partitions: partitions,
+		MaxBytes:   1 << 20,
+		Timeout:    time.Second * 5,
+		offsets:    make([]int64, partitions),
+	}
+}
+
+// Poll fetch new events of all partitions, order is kept within a partition
+func (s *KafkaSource) Poll() ([]BidEvent, error) {
+	s.correlationID++
+	req := &kafkaWriter{}
+	req.int16(kafkaApiFetch)
+	req.int16(0) // version
+	req.int32(s.correlationID)
+	req.string(kafkaClientID)
+	req.int32(-1) // replica id of consumer
+	req.int32(0)  // max wait
+	req.int32(1)  // min bytes
+	req.int32(1)  // topics
+	req.string(s.Topic)
+	req.int32(int32(len(s.offsets)))
+	for p, offset := range s.offsets {
+		req.int32(int32(p))
+		req.int64(offset)
+		req.int32(s.MaxBytes)
+	}
+
+	events, err := s.roundTrip(req)
+	if err != nil && s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return events, err
+}
+
+func (s *KafkaSource) Close() error {
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
+
+func (s *KafkaSource) roundTrip(req *kafkaWriter) ([]BidEvent, error) {
+	if s.conn == nil {
+		conn, err := dialKafka(s.Broker, s.Timeout, kafkaApiFetch)
+		if err != nil {
+			return nil, err
+		}
+		s.conn = conn
+	}
+	s.conn.SetDeadline(time.Now().Add(s.Timeout))
+
+	if err := writeKafkaFrame(s.conn, req.Bytes()); err != nil {
+		return nil, err
+	}
+	resp, err := readKafkaFrame(s.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []BidEvent
+	r := &kafkaReader{b: resp}
+	if r.int32() != s.correlationID {
+		return nil, errKafkaProtocol
+	}
+	for topics := r.int32(); topics > 0 && r.err == nil; topics-- {
+		topic := r.string()
+		for partitions := r.int32(); partitions > 0 && r.err == nil; partitions-- {
+			p, code := r.int32(), r.int16()
+			r.int64() // high watermark
+			set := r.bytes()
+			if r.err != nil {
+				break
+			}
+			if code == kafkaErrUnsupportedVersion {
+				return nil, ErrKafkaUnsupportedVersion
+			} else if code != kafkaErrNone {
+				return nil, fmt.Errorf("kafka: fetch %s/%d error code %d", topic, p, code)
+			}
+			if p < 0 || int(p) >= len(s.offsets) {
+				return nil, errKafkaProtocol
+			}
+
+			msgs, err := decodeMessageSet(set, true)
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range msgs {
+				if m.Offset < s.offsets[p] {
+					continue // broker may return from the start of a batch
+				}
+				ev, err := DecodeBidEvent(m.Value)
+				if err != nil {
+					return nil, err
+				}
+				events = append(events, ev)
+				s.offsets[p] = m.Offset + 1
+			}
+		}
+	}
+
+	return events, r.err
+}
+
+// DecodeBidEvent decode BidEvent from KafkaMessage.Value
+func DecodeBidEvent(value []byte) (BidEvent, error) {
+	var ev BidEvent
+	err := json.Unmarshal(value, &ev)
+	return ev, err
+}
+
+func writeKafkaFrame(w io.Writer, payload []byte) error {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(payload)))
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func readKafkaFrame(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > kafkaMaxRequestBytes {
+		return nil, errKafkaProtocol
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// kafkaWriter encode primitive types of Kafka protocol in big endian
+type kafkaWriter struct {
+	bytes.Buffer
+}
+
+func (w *kafkaWriter) int8(v int8) {
+	w.WriteByte(byte(v))
+}
+
+func (w *kafkaWriter) int16(v int16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(v))
+	w.Write(b[:])
+}
+
+func (w *kafkaWriter) int32(v int32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	w.Write(b[:])
+}
+
+func (w *kafkaWriter) int64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	w.Write(b[:])
+}
+
+func (w *kafkaWriter) string(s string) {
+	w.int16(int16(len(s)))
+	w.WriteString(s)
+}
+
+func (w *kafkaWriter) bytes(b []byte) {
+	if b == nil {
+		w.int32(-1)
+		return
+	}
+	w.int32(int32(len(b)))
+	w.Write(b)
+}
+
+// message append a v0 message with offset to message set
+func (w *kafkaWriter) message(offset int64, key, value []byte) {
+	m := &kafkaWriter{}
+	m.int32(0) // crc placeholder
+	m.int8(0)  // magic
+	m.int8(0)  // attributes, no compression
+	m.bytes(key)
+	m.bytes(value)
+	msg := m.Bytes()
+	binary.BigEndian.PutUint32(msg[:4], crc32.ChecksumIEEE(msg[4:]))
+
+	w.int64(offset)
+	w.bytes(msg)
+}
+
+// kafkaReader decode primitive types of Kafka protocol, err is sticky
+type kafkaReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.pos+n > len(r.b) {
+		r.err = errKafkaProtocol
+		return nil
+	}
+	b := r.b[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *kafkaReader) int8() int8 {
+	if b := r.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (r *kafkaReader) int16() int16 {
+	if b := r.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int32() int32 {
+	if b := r.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int64() int64 {
+	if b := r.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) string() string {
+	return string(r.next(int(r.int16())))
+}
+
+func (r *kafkaReader) bytes() []byte {
+	n := r.int32()
+	if n == -1 || r.err != nil {
+		return nil
+	}
+	return append([]byte(nil), r.next(int(n))...)
+}
@@ -0,0 +1,218 @@
+package auccore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Migration is a versioned change of SQL warehouse schema, applied once in Version ASC order
+type Migration struct {
+	Version     int
+	Description string
+	Statements  func(s schema) []string
+}
+
+// schema is table names and options of a SQL warehouse
+type schema struct {
+	prefix     string
+	shards     []string // bid tables
+	result     string
+	withdrawal string
+	commitment string // sealed bids of first half
+	version    string // applied migrations
+	engine     string // MySQL storage engine
+}
+
+func newSchema(prefix, engine string) schema {
+	s := schema{prefix: prefix, result: prefix + "f", withdrawal: prefix + "w", commitment: prefix + "c", version: prefix + "v", engine: engine}
+	for i := 0; i < TableShards; i++ {
+		s.shards = append(s.shards, prefix+fmt.Sprintf("%04d", i))
+	}
+	return s
+}
+
+// each statement for every bid table
+func (s schema) eachShard(format string) []string {
+	stmts := make([]string, len(s.shards))
+	for i, t := range s.shards {
+		stmts[i] = strings.Replace(format, "{table}", t, -1)
+	}
+	return stmts
+}
+
+var engineName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// IsValidEngine check MySQL storage engine name, eg, MyISAM, InnoDB
+func IsValidEngine(engine string) bool {
+	return engineName.MatchString(engine)
+}
+
+var postgresMigrations = []Migration{
+	{1, "create tables", func(s schema) []string {
+		return append(s.eachShard(`CREATE TABLE IF NOT EXISTS {table} (
+			id BIGSERIAL PRIMARY KEY,
+			client INT,
+			price INT,
+			sequence SMALLINT,
+			ts TIMESTAMP(6) DEFAULT now());`),
+			`CREATE TABLE IF NOT EXISTS `+s.result+` (
+			id BIGSERIAL PRIMARY KEY,
+			client INT,
+			price INT,
+			sequence SMALLINT,
+			ts TIMESTAMP(6) DEFAULT now());`,
+			`CREATE TABLE IF NOT EXISTS `+s.withdrawal+` (
+			id BIGSERIAL PRIMARY KEY,
+			client INT,
+			sequence SMALLINT,
+			ts TIMESTAMP(6) DEFAULT now());`)
+	}},
+	{2, "add serial", func(s schema) []string {
+		return append(s.eachShard(`ALTER TABLE {table} ADD COLUMN IF NOT EXISTS serial BIGINT NULL;`),
+			`ALTER TABLE `+s.result+` ADD COLUMN IF NOT EXISTS serial BIGINT NULL;`)
+	}},
+	{3, "add source ip", func(s schema) []string {
+		return s.eachShard(`ALTER TABLE {table} ADD COLUMN IF NOT EXISTS source_ip VARCHAR(45) NULL;`)
+	}},
+	{4, "index client and price", func(s schema) []string {
+		return append(append(s.eachShard(`CREATE INDEX IF NOT EXISTS {table}_client ON {table} (client, sequence);`),
+			s.eachShard(`CREATE INDEX IF NOT EXISTS {table}_price ON {table} (price);`)...),
+			`CREATE INDEX IF NOT EXISTS `+s.result+`_client ON `+s.result+` (client);`)
+	}},
+	{5, "add request id", func(s schema) []string {
+		// named as Postgres names a UNIQUE (client, request_id) constraint
+		return append(s.eachShard(`ALTER TABLE {table} ADD COLUMN IF NOT EXISTS request_id VARCHAR(64) NULL;`),
+			s.eachShard(`CREATE UNIQUE INDEX IF NOT EXISTS {table}_client_request_id_key ON {table} (client, request_id);`)...)
+	}},
+	{6, "create commitment table", func(s schema) []string {
+		return []string{`CREATE TABLE IF NOT EXISTS ` + s.commitment + ` (
+			id BIGSERIAL PRIMARY KEY,
+			client INT,
+			hash VARCHAR(64),
+			ts TIMESTAMP(6) DEFAULT now(),
+			UNIQUE (client));`}
+	}},
+}
+
+// MySQL has no IF NOT EXISTS for columns and indexes, errors of existing ones are ignored by isSchemaApplied
+var mysqlMigrations = []Migration{
+	{1, "create tables", func(s schema) []string {
+		return append(s.eachShard(`CREATE TABLE IF NOT EXISTS {table} (
+			id INT(10) UNSIGNED NOT NULL AUTO_INCREMENT,
+			client INT(10) UNSIGNED NOT NULL,
+			price INT(10) UNSIGNED NOT NULL,
+			sequence TINYINT(3) UNSIGNED NOT NULL,
+			ts TIMESTAMP(6) DEFAULT CURRENT_TIMESTAMP(6),
+			PRIMARY KEY (id)) ENGINE = `+s.engine+`;`),
+			`CREATE TABLE IF NOT EXISTS `+s.result+` (
+			id INT(10) UNSIGNED NOT NULL AUTO_INCREMENT,
+			client INT(10) UNSIGNED NOT NULL,
+			price INT(10) UNSIGNED NOT NULL,
+			sequence TINYINT(3) UNSIGNED NOT NULL,
+			ts TIMESTAMP(6) DEFAULT CURRENT_TIMESTAMP(6),
+			PRIMARY KEY (id)) ENGINE = `+s.engine+`;`,
+			`CREATE TABLE IF NOT EXISTS `+s.withdrawal+` (
+			id INT(10) UNSIGNED NOT NULL AUTO_INCREMENT,
+			client INT(10) UNSIGNED NOT NULL,
+			sequence TINYINT(3) UNSIGNED NOT NULL,
+			ts TIMESTAMP(6) DEFAULT CURRENT_TIMESTAMP(6),
+			PRIMARY KEY (id)) ENGINE = `+s.engine+`;`)
+	}},
+	{2, "add serial", func(s schema) []string {
+		return append(s.eachShard(`ALTER TABLE {table} ADD COLUMN serial BIGINT UNSIGNED NULL;`),
+			`ALTER TABLE `+s.result+` ADD COLUMN serial BIGINT UNSIGNED NULL;`)
+	}},
+	{3, "add source ip", func(s schema) []string {
+		return s.eachShard(`ALTER TABLE {table} ADD COLUMN source_ip VARCHAR(45) NULL;`)
+	}},
+	{4, "index client and price", func(s schema) []string {
+		return append(append(s.eachShard(`ALTER TABLE {table} ADD INDEX idx_client (client, sequence);`),
+			s.eachShard(`ALTER TABLE {table} ADD INDEX idx_price (price);`)...),
+			`ALTER TABLE `+s.result+` ADD INDEX idx_client (client);`)
+	}},
+	{5, "add request id", func(s schema) []string {
+		return append(s.eachShard(`ALTER TABLE {table} ADD COLUMN request_id VARCHAR(64) NULL;`),
+			s.eachShard(`ALTER TABLE {table} ADD UNIQUE KEY client (client, request_id);`)...)
+	}},
+	{6, "create commitment table", func(s schema) []string {
+		return []string{`CREATE TABLE IF NOT EXISTS ` + s.commitment + ` (
+			id INT(10) UNSIGNED NOT NULL AUTO_INCREMENT,
+			client INT(10) UNSIGNED NOT NULL,
+			hash VARCHAR(64) NOT NULL,
+			ts TIMESTAMP(6) DEFAULT CURRENT_TIMESTAMP(6),
+			PRIMARY KEY (id),
+			UNIQUE KEY (client)) ENGINE = ` + s.engine + `;`}
+	}},
+}
+
+// SchemaVersion is the latest version of SQL warehouse schema
+var SchemaVersion = len(postgresMigrations)
+
+// migrate apply migrations not applied yet, safe to run again,
+// each migration is applied with its version in a transaction if transactional, ie, DDL of Postgres
+func migrate(db *sql.DB, s schema, migrations []Migration, createVersion string, transactional bool) (int, error) {
+	if _, err := db.Exec(createVersion); err != nil {
+		return 0, err
+	}
+
+	var version int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM " + s.version).Scan(&version); err != nil {
+		return 0, err
+	}
+
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		if err := applyMigration(db, s, m, transactional); err != nil {
+			return version, err
+		}
+		version = m.Version
+	}
+	return version, nil
+}
+
+// execer is *sql.DB or *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func applyMigration(db *sql.DB, s schema, m Migration, transactional bool) error {
+	var ex execer = db
+	var tx *sql.Tx
+	if transactional {
+		var err error
+		if tx, err = db.Begin(); err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		ex = tx
+	}
+
+	for _, stmt := range m.Statements(s) {
+		if _, err := ex.Exec(stmt); err != nil && !isSchemaApplied(err) {
+			return fmt.Errorf("migration %d %s: %v", m.Version, m.Description, err)
+		}
+	}
+	// descriptions are constants, no escape required
+	if _, err := ex.Exec(fmt.Sprintf("INSERT INTO %s (version, description) VALUES (%d, '%s')", s.version, m.Version, m.Description)); err != nil {
+		return err
+	}
+
+	if tx != nil {
+		return tx.Commit()
+	}
+	return nil
+}
+
+// isSchemaApplied check MySQL error 1050 table exists, 1060 duplicate column or 1061 duplicate key
+// of a migration partly applied before, DDL of MySQL is not transactional
+func isSchemaApplied(err error) bool {
+	var me *mysql.MySQLError
+	return errors.As(err, &me) && (me.Number == 1050 || me.Number == 1060 || me.Number == 1061)
+}
@@ -0,0 +1,221 @@
+package auccore
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// fakeSchemaDB record statements and applied versions of migrate
+type fakeSchemaDB struct {
+	sync.Mutex
+	stmts    []string
+	versions []int
+	commits  int
+	fail     string // statements containing it fail
+}
+
+var fakeSchemaDBs sync.Map
+
+var versionInsert = regexp.MustCompile(`VALUES \((\d+),`)
+
+type fakeSchemaDriver struct{}
+
+func (fakeSchemaDriver) Open(name string) (driver.Conn, error) {
+	db, _ := fakeSchemaDBs.Load(name)
+	return &fakeSchemaConn{db: db.(*fakeSchemaDB)}, nil
+}
+
+type fakeSchemaConn struct {
+	db *fakeSchemaDB
+	tx *fakeSchemaTx
+}
+
+func (c *fakeSchemaConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSchemaStmt{conn: c, query: query}, nil
+}
+func (c *fakeSchemaConn) Close() error { return nil }
+func (c *fakeSchemaConn) Begin() (driver.Tx, error) {
+	c.tx = &fakeSchemaTx{conn: c}
+	return c.tx, nil
+}
+
+// fakeSchemaTx keep statements and versions until Commit
+type fakeSchemaTx struct {
+	conn     *fakeSchemaConn
+	stmts    []string
+	versions []int
+}
+
+func (tx *fakeSchemaTx) Commit() error {
+	db := tx.conn.db
+	db.Lock()
+	defer db.Unlock()
+
+	db.stmts = append(db.stmts, tx.stmts...)
+	db.versions = append(db.versions, tx.versions...)
+	db.commits++
+	tx.conn.tx = nil
+	return nil
+}
+
+func (tx *fakeSchemaTx) Rollback() error {
+	tx.conn.tx = nil
+	return nil
+}
+
+type fakeSchemaStmt struct {
+	conn  *fakeSchemaConn
+	query string
+}
+
+func (s *fakeSchemaStmt) Close() error  { return nil }
+func (s *fakeSchemaStmt) NumInput() int { return -1 }
+
+func (s *fakeSchemaStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db := s.conn.db
+	db.Lock()
+	defer db.Unlock()
+
+	if db.fail != "" && strings.Contains(s.query, db.fail) {
+		return nil, errors.New("fake error")
+	}
+	stmts, versions := &db.stmts, &db.versions
+	if tx := s.conn.tx; tx != nil {
+		stmts, versions = &tx.stmts, &tx.versions
+	}
+	*stmts = append(*stmts, s.query)
+	if m := versionInsert.FindStringSubmatch(s.query); m != nil {
+		v, _ := strconv.Atoi(m[1])
+		*versions = append(*versions, v)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeSchemaStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := s.conn.db
+	db.Lock()
+	defer db.Unlock()
+
+	max := 0
+	for _, v := range db.versions {
+		if v > max {
+			max = v
+		}
+	}
+	return &fakeSchemaRows{version: max}, nil
+}
+
+type fakeSchemaRows struct {
+	version int
+	done    bool
+}
+
+func (r *fakeSchemaRows) Columns() []string { return []string{"version"} }
+func (r *fakeSchemaRows) Close() error      { return nil }
+func (r *fakeSchemaRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = int64(r.version)
+	return nil
+}
+
+func init() {
+	sql.Register("fakeschema", fakeSchemaDriver{})
+}
+
+func TestMigrate(t *testing.T) {
+	fake := &fakeSchemaDB{}
+	fakeSchemaDBs.Store(t.Name(), fake)
+	db, _ := sql.Open("fakeschema", t.Name())
+	defer db.Close()
+
+	s := newSchema("pp_test_", "InnoDB")
+	version, err := migrate(db, s, mysqlMigrations, "CREATE TABLE IF NOT EXISTS "+s.version, false)
+	if err != nil || version != SchemaVersion {
+		t.Fatalf("migrate version %d, err %v", version, err)
+	}
+	for _, stmt := range fake.stmts {
+		if strings.Contains(stmt, "ENGINE") && !strings.Contains(stmt, "ENGINE = InnoDB") {
+			t.Errorf("unexpected engine %s", stmt)
+		}
+	}
+	if len(fake.versions) != len(mysqlMigrations) {
+		t.Errorf("applied versions %v", fake.versions)
+	}
+
+	// nothing applied again
+	applied := len(fake.stmts)
+	if version, err := migrate(db, s, mysqlMigrations, "CREATE TABLE IF NOT EXISTS "+s.version, false); err != nil || version != SchemaVersion {
+		t.Fatalf("migrate again version %d, err %v", version, err)
+	}
+	if len(fake.stmts) != applied+1 {
+		t.Errorf("migrations applied again %v", fake.stmts[applied:])
+	}
+
+	if len(postgresMigrations) != len(mysqlMigrations) {
+		t.Error("postgres and mysql schema versions differ")
+	}
+	for i, m := range postgresMigrations {
+		if m.Version != i+1 || mysqlMigrations[i].Version != i+1 {
+			t.Errorf("unexpected migration version %d", m.Version)
+		}
+	}
+	if IsValidEngine("MyISAM; DROP TABLE x") || !IsValidEngine("InnoDB") {
+		t.Error("IsValidEngine")
+	}
+}
+
+func TestMigrateTransaction(t *testing.T) {
+	fake := &fakeSchemaDB{fail: "request_id"}
+	fakeSchemaDBs.Store(t.Name(), fake)
+	db, _ := sql.Open("fakeschema", t.Name())
+	defer db.Close()
+
+	// failed migration rolled back with its version
+	s := newSchema("pp_test_", "")
+	version, err := migrate(db, s, postgresMigrations, "CREATE TABLE IF NOT EXISTS "+s.version, true)
+	if err == nil || version != 4 {
+		t.Fatalf("migrate version %d, err %v", version, err)
+	}
+	for _, stmt := range fake.stmts {
+		if strings.Contains(stmt, "request_id") || strings.Contains(stmt, "VALUES (5,") {
+			t.Errorf("failed migration not rolled back %s", stmt)
+		}
+	}
+	if fake.commits != 4 {
+		t.Errorf("commits %d", fake.commits)
+	}
+
+	fake.fail = ""
+	if version, err := migrate(db, s, postgresMigrations, "CREATE TABLE IF NOT EXISTS "+s.version, true); err != nil || version != SchemaVersion {
+		t.Fatalf("migrate again version %d, err %v", version, err)
+	}
+	if fake.commits != SchemaVersion || fake.versions[len(fake.versions)-1] != SchemaVersion {
+		t.Errorf("commits %d, versions %v", fake.commits, fake.versions)
+	}
+}
+
+func TestMysqlErrorNumber(t *testing.T) {
+	wrapped := fmt.Errorf("exec: %w", &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"})
+	if !isDuplicateEntry(wrapped) || isSchemaApplied(wrapped) {
+		t.Error("error 1062 not detected by number")
+	}
+	if !isSchemaApplied(&mysql.MySQLError{Number: 1061, Message: "Duplicate key name"}) {
+		t.Error("error 1061 not detected by number")
+	}
+	if isDuplicateEntry(errors.New("Error 1062: Duplicate entry")) {
+		t.Error("error detected by message")
+	}
+}
@@ -0,0 +1,370 @@
+package auccore
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	walAdd        = "add"
+	walCommit     = "commit"
+	walWithdraw   = "withdraw"
+	walCommitment = "commitment"
+)
+
+type walRecord struct {
+	Op         string
+	Bid        Bid
+	Commitment *Commitment `json:",omitempty"`
+}
+
+// FileWarehouse append bids to a write-ahead log file as JSON lines,
+// Bid.Time and Bid.WithdrawTime are kept if already set, eg, by primary of MirrorWarehouse
+type FileWarehouse struct {
+	name string
+	lock sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	log  *log.Logger
+}
+
+func NewFileWarehouse(name string, logger *log.Logger) *FileWarehouse {
+	return &FileWarehouse{name: name, log: logger}
+}
+
+func (w *FileWarehouse) Initialize() {
+	f, err := os.OpenFile(w.name, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		w.log.Println(err)
+		return
+	}
+	w.file = f
+	w.w = bufio.NewWriter(f)
+}
+
+func (w *FileWarehouse) Terminate() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file != nil {
+		w.w.Flush()
+		w.file.Close()
+		w.file = nil
+	}
+}
+
+func (w *FileWarehouse) append(ctx context.Context, r walRecord, code int) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return Error{Code: code, Message: "WAL err"}
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file == nil {
+		return Error{Code: CodeServerSaveError0, Message: "WAL closed"}
+	}
+	if err := ctx.Err(); err != nil {
+		return contextError(err)
+	}
+	w.w.Write(line)
+	w.w.WriteByte('\n')
+	if err := w.w.Flush(); err != nil {
+		w.log.Println("ERR:WAL")
+		w.log.Println(err)
+		return Error{Code: code, Message: "WAL err"}
+	}
+	return nil
+}
+
+func (w *FileWarehouse) Add(ctx context.Context, bid *Bid) error {
+	if bid.Time.IsZero() {
+		bid.Time = time.Now().Truncate(time.Microsecond)
+	}
+	record := *bid
+	record.Active = false
+	record.Nonce = ""
+	return w.append(ctx, walRecord{Op: walAdd, Bid: record}, CodeServerSaveError1)
+}
+
+func (w *FileWarehouse) Commit(ctx context.Context, bid *Bid) error {
+	return w.append(ctx, walRecord{Op: walCommit, Bid: *bid}, CodeServerSaveError5)
+}
+
+func (w *FileWarehouse) Withdraw(ctx context.Context, bid *Bid) error {
+	if bid.WithdrawTime.IsZero() {
+		bid.WithdrawTime = time.Now().Truncate(time.Microsecond)
+	}
+	record := Bid{Client: bid.Client, Sequence: bid.Sequence, Time: bid.WithdrawTime}
+	return w.append(ctx, walRecord{Op: walWithdraw, Bid: record}, CodeServerSaveError1)
+}
+
+func (w *FileWarehouse) AddCommitment(ctx context.Context, c *Commitment) error {
+	if c.Time.IsZero() {
+		c.Time = time.Now().Truncate(time.Microsecond)
+	}
+	record := *c
+	record.Revealed = false
+	return w.append(ctx, walRecord{Op: walCommitment, Commitment: &record}, CodeServerSaveError1)
+}
+
+func (w *FileWarehouse) Restore(store *Store, c *Config) error {
+	w.lock.Lock()
+	if w.w != nil {
+		w.w.Flush()
+	}
+	w.lock.Unlock()
+
+	f, err := os.Open(w.name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var withdrawals []Bid
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var r walRecord
+		if err := dec.Decode(&r); err != nil {
+			// last line may be partly written by a crash
+			w.log.Println(err)
+			break
+		}
+
+		bid := r.Bid
+		bid.Active = true
+		if r.Op == walCommitment && r.Commitment != nil {
+			// commitments are written before bids revealing them
+			if r.Commitment.Time.After(c.StartTime) && r.Commitment.Time.Before(c.HalfTime) {
+				store.AddCommitment(r.Commitment)
+			}
+		} else if r.Op == walAdd {
+			if bid.Sequence == 1 && bid.Time.After(c.StartTime) && bid.Time.Before(c.HalfTime) {
+				store.Add(&bid)
+			} else if bid.Sequence > 1 && bid.Time.After(c.HalfTime) && bid.Time.Before(c.EndTime) {
+				store.Add(&bid)
+			}
+		} else if r.Op == walWithdraw && bid.Time.After(c.HalfTime) && bid.Time.Before(c.EndTime) {
+			withdrawals = append(withdrawals, bid)
+		}
+	}
+
+	for _, wd := range withdrawals {
+		store.Withdraw(wd.Client, wd.Sequence)
+	}
+	return nil
+}
+
+// MirrorWarehouse write to primary and mirror, primary decides Bid.Time and Bid.WithdrawTime
+// and is the source of truth, mirror failures are logged and reported but never fail the request
+type MirrorWarehouse struct {
+	Primary Warehouse
+	Mirror  Warehouse     // must keep Bid.Time and Bid.WithdrawTime set by primary
+	Timeout time.Duration // give up waiting for a mirror write and report it as failure, 0 for no limit
+
+	log      *log.Logger
+	lock     sync.Mutex
+	failures []Bid // bids failed to mirror
+}
+
+func NewMirrorWarehouse(primary, mirror Warehouse, logger *log.Logger) *MirrorWarehouse {
+	return &MirrorWarehouse{Primary: primary, Mirror: mirror, Timeout: time.Millisecond * 100, log: logger}
+}
+
+func (w *MirrorWarehouse) Initialize() {
+	w.Primary.Initialize()
+	w.Mirror.Initialize()
+}
+
+func (w *MirrorWarehouse) Terminate() {
+	w.Primary.Terminate()
+	w.Mirror.Terminate()
+}
+
+func (w *MirrorWarehouse) Add(ctx context.Context, bid *Bid) error {
+	if err := w.Primary.Add(ctx, bid); err != nil {
+		return err
+	}
+
+	w.mirror(bid, w.Mirror.Add)
+	return nil
+}
+
+func (w *MirrorWarehouse) Commit(ctx context.Context, bid *Bid) error {
+	if err := w.Primary.Commit(ctx, bid); err != nil {
+		return err
+	}
+
+	w.mirror(bid, w.Mirror.Commit)
+	return nil
+}
+
+func (w *MirrorWarehouse) Withdraw(ctx context.Context, bid *Bid) error {
+	if err := w.Primary.Withdraw(ctx, bid); err != nil {
+		return err
+	}
+
+	w.mirror(bid, w.Mirror.Withdraw)
+	return nil
+}
+
+// AddCommitment mirror commitment like bids, a failure is reported as a bid of sequence 0
+func (w *MirrorWarehouse) AddCommitment(ctx context.Context, c *Commitment) error {
+	if err := w.Primary.AddCommitment(ctx, c); err != nil {
+		return err
+	}
+
+	mirrored := *c
+	w.mirror(&Bid{Client: c.Client, Time: c.Time}, func(ctx context.Context, _ *Bid) error {
+		return w.Mirror.AddCommitment(ctx, &mirrored)
+	})
+	return nil
+}
+
+// mirror write a copy of bid saved by primary, a write slower than Timeout is reported as failure
+// and left running without holding the request
+func (w *MirrorWarehouse) mirror(bid *Bid, write func(ctx context.Context, bid *Bid) error) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if w.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), w.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	mirrored := *bid
+	done := make(chan error, 1)
+	go func() {
+		defer cancel()
+		done <- write(ctx, &mirrored)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// done is sent before cancel
+		select {
+		case err = <-done:
+		default:
+			err = contextError(context.DeadlineExceeded)
+		}
+	}
+	if err == nil {
+		return
+	}
+
+	w.log.Printf("ERR:Mirror %d %d (%d), %s", bid.Client, bid.Price, bid.Sequence, err)
+	w.lock.Lock()
+	w.failures = append(w.failures, *bid)
+	w.lock.Unlock()
+}
+
+func (w *MirrorWarehouse) Restore(store *Store, c *Config) error {
+	return w.Primary.Restore(store, c)
+}
+
+// Failures return bids failed to mirror
+func (w *MirrorWarehouse) Failures() []Bid {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return append([]Bid(nil), w.failures...)
+}
+
+// MirrorDiff is a bid differs among primary, mirror and memory, nil if missing in the source
+type MirrorDiff struct {
+	Client   int
+	Sequence int
+	Primary  *Bid
+	Mirror   *Bid
+	Memory   *Bid
+}
+
+// MirrorReport compare bids of primary, mirror and memory
+type MirrorReport struct {
+	Primary int // count of bids
+	Mirror  int
+	Memory  int
+	Diffs   []MirrorDiff
+}
+
+// Report restore mirror and compare with primary restored by Seal and memory bid by bid,
+// no report if mirror fails to restore
+func (w *MirrorWarehouse) Report(primary, memory *Store, c *Config) (*MirrorReport, error) {
+	mirror := NewStore(0)
+	if err := w.Mirror.Restore(mirror, c); err != nil {
+		return nil, err
+	}
+
+	return newMirrorReport(primary, mirror, memory), nil
+}
+
+type bidKey struct {
+	client   int
+	sequence int
+}
+
+func bidsByKey(store *Store) map[bidKey]Bid {
+	bids := make(map[bidKey]Bid)
+	store.RLock()
+	defer store.RUnlock()
+	for _, key := range store.BidderChain.Index {
+		for _, bid := range store.BidderChain.Blocks[key].Bids {
+			bids[bidKey{bid.Client, bid.Sequence}] = *bid
+		}
+	}
+	return bids
+}
+
+func newMirrorReport(primary, mirror, memory *Store) *MirrorReport {
+	sources := []map[bidKey]Bid{bidsByKey(primary), bidsByKey(mirror), bidsByKey(memory)}
+	r := &MirrorReport{Primary: len(sources[0]), Mirror: len(sources[1]), Memory: len(sources[2])}
+
+	keys := make(map[bidKey]bool)
+	for _, bids := range sources {
+		for k := range bids {
+			keys[k] = true
+		}
+	}
+	for k := range keys {
+		found := make([]*Bid, len(sources))
+		same := true
+		for i, bids := range sources {
+			if bid, ok := bids[k]; ok {
+				found[i] = &bid
+			}
+			if found[i] == nil || (found[0] != nil && len(diffBid(found[0], found[i])) > 0) {
+				same = false
+			}
+		}
+		if !same {
+			r.Diffs = append(r.Diffs, MirrorDiff{Client: k.client, Sequence: k.sequence, Primary: found[0], Mirror: found[1], Memory: found[2]})
+		}
+	}
+
+	sort.Slice(r.Diffs, func(i, j int) bool {
+		if r.Diffs[i].Client != r.Diffs[j].Client {
+			return r.Diffs[i].Client < r.Diffs[j].Client
+		}
+		return r.Diffs[i].Sequence < r.Diffs[j].Sequence
+	})
+	return r
+}
+
+func (r *MirrorReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "primary %d, mirror %d, memory %d, diff %d", r.Primary, r.Mirror, r.Memory, len(r.Diffs))
+	for _, d := range r.Diffs {
+		fmt.Fprintf(&b, "\n%d (%d): primary %s, mirror %s, memory %s", d.Client, d.Sequence, formatDiffBid(d.Primary), formatDiffBid(d.Mirror), formatDiffBid(d.Memory))
+	}
+	return b.String()
+}
@@ -0,0 +1,151 @@
+package auccore
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMirrorWarehouse(t *testing.T) {
+	now := time.Now()
+	conf := &Config{StartTime: now.Add(-time.Second), HalfTime: now.Add(time.Hour), EndTime: now.Add(time.Hour * 2)}
+	logger := log.New(ioutil.Discard, "", 0)
+
+	primary := NewMemoryWarehouse()
+	primary.SetSimulator(NewConcurrencySimulatorWithModel(10, ConstantLatency{}, 1))
+	file := NewFileWarehouse(filepath.Join(t.TempDir(), "wal.jsonl"), logger)
+	w := NewMirrorWarehouse(primary, file, logger)
+	w.Initialize()
+	defer w.Terminate()
+
+	memory := NewStore(0)
+	for i := 1; i <= 4; i++ {
+		bid := &Bid{Client: i, Price: 100 * i, Sequence: 1}
+		if i == 3 {
+			// lost by mirror
+			primary.Add(context.Background(), bid)
+		} else if err := w.Add(context.Background(), bid); err != nil {
+			t.Fatal(err)
+		}
+		if i == 4 {
+			bid.Price = 1
+		}
+		bid.Active = true
+		memory.Add(bid)
+	}
+
+	restored := NewStore(0)
+	if err := w.Restore(restored, conf); err != nil {
+		t.Fatal(err)
+	}
+	r, err := w.Report(restored, memory, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Primary != 4 || r.Mirror != 3 || r.Memory != 4 {
+		t.Fatalf("unexpected counts %s", r)
+	}
+	if len(r.Diffs) != 2 {
+		t.Fatalf("unexpected diffs %s", r)
+	}
+	if d := r.Diffs[0]; d.Client != 3 || d.Primary == nil || d.Mirror != nil || d.Memory == nil {
+		t.Errorf("unexpected diff %s", r)
+	}
+	if d := r.Diffs[1]; d.Client != 4 || d.Primary.Price != 400 || d.Mirror.Price != 400 || d.Memory.Price != 1 {
+		t.Errorf("unexpected diff %s", r)
+	}
+
+	// no report if mirror fails to restore
+	lost := NewMirrorWarehouse(primary, NewFileWarehouse(filepath.Join(t.TempDir(), "lost", "wal.jsonl"), logger), logger)
+	if r, err := lost.Report(restored, memory, conf); err == nil || r != nil {
+		t.Errorf("report of unrestored mirror %v", r)
+	}
+
+	// mirror failure never fails the bid
+	flaky := newFlakyWarehouse(1, CodeServerSaveError1)
+	w = NewMirrorWarehouse(primary, flaky, logger)
+	if err := w.Add(context.Background(), &Bid{Client: 5, Price: 100, Sequence: 1}); err != nil {
+		t.Error(err)
+	}
+	if len(w.Failures()) != 1 {
+		t.Error("mirror failure not recorded")
+	}
+}
+
+// slowWarehouse hang Add until ctx is done
+type slowWarehouse struct {
+	*MemoryWarehouse
+}
+
+func (w *slowWarehouse) Add(ctx context.Context, bid *Bid) error {
+	<-ctx.Done()
+	return contextError(ctx.Err())
+}
+
+func TestMirrorWarehouseWithdraw(t *testing.T) {
+	now := time.Now()
+	conf := &Config{StartTime: now.Add(-time.Second), HalfTime: now.Add(time.Minute * 30), EndTime: now.Add(time.Hour * 2)}
+	logger := log.New(ioutil.Discard, "", 0)
+
+	// withdrawal time of primary is in second half, of mirror clock is not
+	primary := NewMemoryWarehouse()
+	primary.SetSimulator(NewConcurrencySimulatorWithModel(10, ConstantLatency{}, 1))
+	primary.SetChaos(Chaos{Skew: time.Hour})
+	file := NewFileWarehouse(filepath.Join(t.TempDir(), "wal.jsonl"), logger)
+	w := NewMirrorWarehouse(primary, file, logger)
+	w.Initialize()
+	defer w.Terminate()
+
+	w.Add(context.Background(), &Bid{Client: 1, Price: 100, Sequence: 1, Time: now})
+	bid := &Bid{Client: 1, Price: 101, Sequence: 2}
+	w.Add(context.Background(), bid)
+	if err := w.Withdraw(context.Background(), bid); err != nil {
+		t.Fatal(err)
+	}
+	if bid.WithdrawTime.Before(conf.HalfTime) {
+		t.Error("withdrawal time not decided by primary", bid.WithdrawTime)
+	}
+
+	restored := NewStore(0)
+	if err := w.Restore(restored, conf); err != nil {
+		t.Fatal(err)
+	}
+	r, err := w.Report(restored, NewStore(0), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Mirror != 2 || len(r.Diffs) != 2 {
+		t.Fatalf("unexpected report %s", r)
+	}
+	for _, d := range r.Diffs {
+		if d.Mirror == nil || d.Primary.Withdrawn != d.Mirror.Withdrawn || d.Primary.Active != d.Mirror.Active {
+			t.Errorf("mirror differs from primary %s", r)
+		}
+	}
+
+	// commitments are mirrored and restored from the log
+	if err := w.AddCommitment(context.Background(), &Commitment{Client: 3, Hash: "c", Time: now}); err != nil {
+		t.Fatal(err)
+	}
+	mirrored := NewStore(0)
+	if err := file.Restore(mirrored, conf); err != nil {
+		t.Fatal(err)
+	}
+	if c := mirrored.GetCommitment(3); c == nil || c.Hash != "c" || !c.Time.Equal(now) {
+		t.Errorf("commitment not mirrored %+v", c)
+	}
+
+	// slow mirror never holds the bid
+	w = NewMirrorWarehouse(primary, &slowWarehouse{primary}, logger)
+	w.Timeout = time.Millisecond * 20
+	start := time.Now()
+	if err := w.Add(context.Background(), &Bid{Client: 2, Price: 100, Sequence: 1}); err != nil {
+		t.Error(err)
+	}
+	if time.Since(start) > time.Millisecond*200 || len(w.Failures()) != 1 {
+		t.Error("slow mirror not timed out")
+	}
+}
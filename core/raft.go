@@ -0,0 +1,750 @@
+package auccore
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	RaftFollower = iota
+	RaftCandidate
+	RaftLeader
+)
+
+// RaftEntry is an entry of replicated bid log
+type RaftEntry struct {
+	Term       int
+	Bid        Bid
+	Withdraw   bool        // withdrawal of Bid.Sequence
+	Commitment *Commitment // sealed bid of first half instead of Bid
+	Noop       bool        // committed by new leader to commit entries of previous terms
+}
+
+type RequestVoteArgs struct {
+	Term         int
+	CandidateID  int
+	LastLogIndex int
+	LastLogTerm  int
+}
+
+type RequestVoteReply struct {
+	Term        int
+	VoteGranted bool
+}
+
+type AppendEntriesArgs struct {
+	Term         int
+	LeaderID     int
+	PrevLogIndex int
+	PrevLogTerm  int
+	Entries      []RaftEntry
+	LeaderCommit int
+}
+
+type AppendEntriesReply struct {
+	Term          int
+	Success       bool
+	ConflictIndex int // next index to try if failed
+}
+
+// RaftTransport deliver RPC between raft nodes
+type RaftTransport interface {
+	RequestVote(from, to int, args RequestVoteArgs) (RequestVoteReply, error)
+	AppendEntries(from, to int, args AppendEntriesArgs) (AppendEntriesReply, error)
+}
+
+type raftWaiter struct {
+	term int
+	done chan error
+}
+
+// RaftNode replicate bid log by Raft consensus, entries are applied in order on every node.
+// Leader steps down once it has not heard from a majority within ElectionTimeout (check quorum),
+// and followers hearing from a leader within ElectionTimeout reject votes, so the leader holds a lease
+type RaftNode struct {
+	ID                int
+	HeartbeatInterval time.Duration
+	ElectionTimeout   time.Duration // randomized in [ElectionTimeout, 2*ElectionTimeout)
+	ProposeTimeout    time.Duration
+
+	peers     []int // all node ids including self
+	transport RaftTransport
+	apply     func(entry RaftEntry) error
+
+	mu               sync.Mutex
+	state            int
+	term             int
+	votedFor         int
+	leader           int
+	log              []RaftEntry // log[0] is a sentinel
+	commitIndex      int
+	lastApplied      int
+	nextIndex        map[int]int
+	matchIndex       map[int]int
+	electionDeadline time.Time
+	lastBroadcast    time.Time
+	lastHeard        time.Time         // last AppendEntries from leader
+	lastAck          map[int]time.Time // by peer, send time of last replied AppendEntries
+	waiters          map[int]raftWaiter
+
+	applyMu sync.Mutex
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+func NewRaftNode(id int, peers []int, transport RaftTransport) *RaftNode {
+	return &RaftNode{
+		ID:                id,
+		HeartbeatInterval: time.Millisecond * 50,
+		ElectionTimeout:   time.Millisecond * 150,
+		ProposeTimeout:    time.Second,
+		peers:             peers,
+		transport:         transport,
+		votedFor:          -1,
+		leader:            -1,
+		log:               make([]RaftEntry, 1),
+		waiters:           make(map[int]raftWaiter),
+		quit:              make(chan struct{}),
+		done:              make(chan struct{}),
+	}
+}
+
+// Start run election and heartbeat, committed entries are passed to apply in order,
+// the error returned by apply is the result of Propose on leader
+func (n *RaftNode) Start(apply func(entry RaftEntry) error) {
+	n.apply = apply
+	n.mu.Lock()
+	n.resetElectionDeadline()
+	n.mu.Unlock()
+
+	go n.run()
+}
+
+// Stop stop the node, pending proposals fail
+func (n *RaftNode) Stop() {
+	close(n.quit)
+	<-n.done
+
+	n.mu.Lock()
+	n.stepDown(n.term)
+	n.mu.Unlock()
+}
+
+// IsLeader return whether the node is the leader and its lease is valid
+func (n *RaftNode) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.state == RaftLeader && n.hasQuorum()
+}
+
+// hasQuorum check a majority replied AppendEntries sent within ElectionTimeout, must hold n.mu
+func (n *RaftNode) hasQuorum() bool {
+	cnt := 0
+	for _, peer := range n.peers {
+		if peer == n.ID || time.Since(n.lastAck[peer]) < n.ElectionTimeout {
+			cnt++
+		}
+	}
+	return cnt*2 > len(n.peers)
+}
+
+// Leader return id of known leader, -1 if unknown
+func (n *RaftNode) Leader() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.leader
+}
+
+// Propose append entry to log and wait until it is committed and applied on this node,
+// return the result of apply. The entry may still commit after CodeServerReplicateError
+func (n *RaftNode) Propose(entry RaftEntry) error {
+	n.mu.Lock()
+	if n.state != RaftLeader || !n.hasQuorum() {
+		n.mu.Unlock()
+		return Error{Code: CodeServerNotLeader, Message: "Not leader"}
+	}
+	entry.Term = n.term
+	n.log = append(n.log, entry)
+	idx := len(n.log) - 1
+	w := raftWaiter{term: n.term, done: make(chan error, 1)}
+	n.waiters[idx] = w
+	n.broadcast()
+	n.mu.Unlock()
+
+	timer := time.NewTimer(n.ProposeTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-w.done:
+		return err
+	case <-timer.C:
+		n.mu.Lock()
+		delete(n.waiters, idx)
+		n.mu.Unlock()
+		return Error{Code: CodeServerReplicateError, Message: "Replicate timeout"}
+	}
+}
+
+func (n *RaftNode) run() {
+	defer close(n.done)
+
+	ticker := time.NewTicker(n.HeartbeatInterval / 5)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.mu.Lock()
+			if n.state == RaftLeader {
+				if !n.hasQuorum() {
+					// check quorum, eg, partitioned from majority
+					n.stepDown(n.term)
+				} else if time.Since(n.lastBroadcast) >= n.HeartbeatInterval {
+					n.broadcast()
+				}
+			} else if time.Now().After(n.electionDeadline) {
+				n.startElection()
+			}
+			n.mu.Unlock()
+		case <-n.quit:
+			return
+		}
+	}
+}
+
+func (n *RaftNode) resetElectionDeadline() {
+	n.electionDeadline = time.Now().Add(n.ElectionTimeout + time.Duration(rand.Int63n(int64(n.ElectionTimeout))))
+}
+
+// stepDown become follower of term, must hold n.mu
+func (n *RaftNode) stepDown(term int) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = -1
+	}
+	if n.state == RaftLeader {
+		n.leader = -1
+	}
+	n.state = RaftFollower
+	n.resetElectionDeadline()
+
+	for idx, w := range n.waiters {
+		w.done <- Error{Code: CodeServerNotLeader, Message: "Not leader"}
+		delete(n.waiters, idx)
+	}
+}
+
+// startElection must hold n.mu
+func (n *RaftNode) startElection() {
+	n.state = RaftCandidate
+	n.term++
+	n.votedFor = n.ID
+	n.leader = -1
+	n.resetElectionDeadline()
+
+	args := RequestVoteArgs{
+		Term:         n.term,
+		CandidateID:  n.ID,
+		LastLogIndex: len(n.log) - 1,
+		LastLogTerm:  n.log[len(n.log)-1].Term,
+	}
+	votes := 1
+	for _, peer := range n.peers {
+		if peer == n.ID {
+			continue
+		}
+		go func(peer int) {
+			reply, err := n.transport.RequestVote(n.ID, peer, args)
+			if err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if reply.Term > n.term {
+				n.stepDown(reply.Term)
+				return
+			}
+			if n.state != RaftCandidate || n.term != args.Term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if votes*2 > len(n.peers) {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader must hold n.mu
+func (n *RaftNode) becomeLeader() {
+	n.state = RaftLeader
+	n.leader = n.ID
+	n.nextIndex = make(map[int]int)
+	n.matchIndex = make(map[int]int)
+	n.lastAck = make(map[int]time.Time)
+	now := time.Now()
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = len(n.log)
+		// voters reset election deadline on granting vote
+		n.lastAck[peer] = now
+	}
+	n.log = append(n.log, RaftEntry{Term: n.term, Noop: true})
+	n.matchIndex[n.ID] = len(n.log) - 1
+	n.broadcast()
+}
+
+// broadcast send AppendEntries to all followers, must hold n.mu
+func (n *RaftNode) broadcast() {
+	n.lastBroadcast = time.Now()
+	n.matchIndex[n.ID] = len(n.log) - 1
+	for _, peer := range n.peers {
+		if peer != n.ID {
+			go n.replicate(peer)
+		}
+	}
+}
+
+func (n *RaftNode) replicate(peer int) {
+	n.mu.Lock()
+	if n.state != RaftLeader {
+		n.mu.Unlock()
+		return
+	}
+	next := n.nextIndex[peer]
+	args := AppendEntriesArgs{
+		Term:         n.term,
+		LeaderID:     n.ID,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  n.log[next-1].Term,
+		Entries:      append([]RaftEntry(nil), n.log[next:]...),
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+
+	sent := time.Now()
+	reply, err := n.transport.AppendEntries(n.ID, peer, args)
+	if err != nil {
+		return
+	}
+
+	n.mu.Lock()
+	if reply.Term > n.term {
+		n.stepDown(reply.Term)
+		n.mu.Unlock()
+		return
+	}
+	if n.state != RaftLeader || n.term != args.Term {
+		n.mu.Unlock()
+		return
+	}
+	if sent.After(n.lastAck[peer]) {
+		n.lastAck[peer] = sent
+	}
+
+	committed := false
+	if reply.Success {
+		if match := args.PrevLogIndex + len(args.Entries); match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+			n.nextIndex[peer] = match + 1
+		}
+		committed = n.advanceCommit()
+	} else if reply.ConflictIndex < n.nextIndex[peer] {
+		n.nextIndex[peer] = reply.ConflictIndex
+		if n.nextIndex[peer] < 1 {
+			n.nextIndex[peer] = 1
+		}
+		go n.replicate(peer)
+	}
+	n.mu.Unlock()
+
+	if committed {
+		n.applyCommitted()
+	}
+}
+
+// advanceCommit commit entries of current term replicated on majority, must hold n.mu
+func (n *RaftNode) advanceCommit() bool {
+	for idx := len(n.log) - 1; idx > n.commitIndex; idx-- {
+		if n.log[idx].Term != n.term {
+			break
+		}
+		cnt := 0
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= idx {
+				cnt++
+			}
+		}
+		if cnt*2 > len(n.peers) {
+			n.commitIndex = idx
+			return true
+		}
+	}
+	return false
+}
+
+// applyCommitted pass committed entries to apply in order and wake up proposers
+func (n *RaftNode) applyCommitted() {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	n.mu.Lock()
+	from := n.lastApplied + 1
+	entries := append([]RaftEntry(nil), n.log[from:n.commitIndex+1]...)
+	n.lastApplied = n.commitIndex
+	n.mu.Unlock()
+
+	for i, entry := range entries {
+		var err error
+		if !entry.Noop && n.apply != nil {
+			err = n.apply(entry)
+		}
+
+		n.mu.Lock()
+		w, ok := n.waiters[from+i]
+		delete(n.waiters, from+i)
+		n.mu.Unlock()
+		if !ok {
+			continue
+		}
+		if w.term == entry.Term {
+			w.done <- err
+		} else {
+			// overwritten by another leader
+			w.done <- Error{Code: CodeServerNotLeader, Message: "Not leader"}
+		}
+	}
+}
+
+// HandleRequestVote handle RequestVote RPC
+func (n *RaftNode) HandleRequestVote(args RequestVoteArgs) RequestVoteReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// leader is alive, candidate is partitioned from it
+	if n.leader != -1 && n.leader != args.CandidateID && time.Since(n.lastHeard) < n.ElectionTimeout {
+		return RequestVoteReply{Term: n.term}
+	}
+	if args.Term > n.term {
+		n.stepDown(args.Term)
+	}
+
+	lastIndex := len(n.log) - 1
+	lastTerm := n.log[lastIndex].Term
+	upToDate := args.LastLogTerm > lastTerm || (args.LastLogTerm == lastTerm && args.LastLogIndex >= lastIndex)
+	if args.Term == n.term && (n.votedFor == -1 || n.votedFor == args.CandidateID) && upToDate {
+		n.votedFor = args.CandidateID
+		n.resetElectionDeadline()
+		return RequestVoteReply{Term: n.term, VoteGranted: true}
+	}
+
+	return RequestVoteReply{Term: n.term}
+}
+
+// HandleAppendEntries handle AppendEntries RPC
+func (n *RaftNode) HandleAppendEntries(args AppendEntriesArgs) AppendEntriesReply {
+	n.mu.Lock()
+
+	if args.Term < n.term {
+		n.mu.Unlock()
+		return AppendEntriesReply{Term: n.term}
+	}
+	if args.Term > n.term || n.state != RaftFollower {
+		n.stepDown(args.Term)
+	}
+	n.leader = args.LeaderID
+	n.lastHeard = time.Now()
+	n.resetElectionDeadline()
+
+	if args.PrevLogIndex >= len(n.log) {
+		reply := AppendEntriesReply{Term: n.term, ConflictIndex: len(n.log)}
+		n.mu.Unlock()
+		return reply
+	}
+	if n.log[args.PrevLogIndex].Term != args.PrevLogTerm {
+		// skip the whole conflicting term
+		conflict := args.PrevLogIndex
+		for conflict > 1 && n.log[conflict-1].Term == n.log[args.PrevLogIndex].Term {
+			conflict--
+		}
+		n.mu.Unlock()
+		return AppendEntriesReply{Term: n.term, ConflictIndex: conflict}
+	}
+
+	for i, entry := range args.Entries {
+		idx := args.PrevLogIndex + 1 + i
+		if idx < len(n.log) {
+			if n.log[idx].Term == entry.Term {
+				continue
+			}
+			n.log = n.log[:idx]
+		}
+		n.log = append(n.log, entry)
+	}
+
+	// entries after last new entry are not verified by this request
+	commit := args.LeaderCommit
+	if last := args.PrevLogIndex + len(args.Entries); last < commit {
+		commit = last
+	}
+	committed := false
+	if commit > n.commitIndex {
+		n.commitIndex = commit
+		committed = true
+	}
+	reply := AppendEntriesReply{Term: n.term, Success: true}
+	n.mu.Unlock()
+
+	if committed {
+		n.applyCommitted()
+	}
+	return reply
+}
+
+// MemoryTransport connect raft nodes in process, nodes can be disconnected for failover test
+type MemoryTransport struct {
+	sync.RWMutex
+	nodes        map[int]*RaftNode
+	disconnected map[int]bool
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{
+		nodes:        make(map[int]*RaftNode),
+		disconnected: make(map[int]bool),
+	}
+}
+
+// Register make node reachable
+func (t *MemoryTransport) Register(n *RaftNode) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.nodes[n.ID] = n
+}
+
+// Disconnect drop all RPC from or to the node
+func (t *MemoryTransport) Disconnect(id int) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.disconnected[id] = true
+}
+
+// Connect restore RPC of the node
+func (t *MemoryTransport) Connect(id int) {
+	t.Lock()
+	defer t.Unlock()
+
+	delete(t.disconnected, id)
+}
+
+func (t *MemoryTransport) node(from, to int) (*RaftNode, error) {
+	t.RLock()
+	defer t.RUnlock()
+
+	n := t.nodes[to]
+	if n == nil || t.disconnected[from] || t.disconnected[to] {
+		return nil, Error{Code: CodeServerReplicateError, Message: "Unreachable"}
+	}
+	return n, nil
+}
+
+func (t *MemoryTransport) RequestVote(from, to int, args RequestVoteArgs) (RequestVoteReply, error) {
+	n, err := t.node(from, to)
+	if err != nil {
+		return RequestVoteReply{}, err
+	}
+	return n.HandleRequestVote(args), nil
+}
+
+func (t *MemoryTransport) AppendEntries(from, to int, args AppendEntriesArgs) (AppendEntriesReply, error) {
+	n, err := t.node(from, to)
+	if err != nil {
+		return AppendEntriesReply{}, err
+	}
+	return n.HandleAppendEntries(args), nil
+}
+
+// SetRaft replicate accepted bids through the raft node before saving,
+// bids are only accepted by leader and decided time by leader,
+// committed entries are saved to warehouse and store by applyEntry on every node.
+// Must be called before Serve, node is started with the exchange as state machine
+func (e *Exchange) SetRaft(node *RaftNode) {
+	e.applied = make(map[string]*Bid)
+	e.raft = node
+	node.Start(e.applyEntry)
+}
+
+// Raft return the raft node, nil if not replicated
+func (e *Exchange) Raft() *RaftNode {
+	return e.raft
+}
+
+// storeBid save accepted bid to store, through raft log if replicated
+func (e *Exchange) storeBid(bid *Bid) error {
+	if e.raft == nil {
+		e.store.Add(bid)
+		return nil
+	}
+
+	if err := e.raft.Propose(RaftEntry{Bid: *bid}); err != nil {
+		return err
+	}
+	// duplicate of a bid committed earlier with the same RequestID
+	if saved := e.appliedBid(bid); saved != nil {
+		replayBid(bid, saved)
+	}
+	return nil
+}
+
+// storeWithdraw withdraw bid from store, through raft log if replicated
+func (e *Exchange) storeWithdraw(bid *Bid) error {
+	if e.raft == nil {
+		e.store.Withdraw(bid.Client, bid.Sequence)
+		return nil
+	}
+
+	return e.raft.Propose(RaftEntry{Bid: *bid, Withdraw: true})
+}
+
+// storeCommitment add commitment to store, through raft log if replicated
+func (e *Exchange) storeCommitment(c *Commitment) error {
+	if e.raft == nil {
+		if !e.store.AddCommitment(c) {
+			return Error{Code: CodeRequestAttendFirstRound, Message: "Attend first round"}
+		}
+		return nil
+	}
+
+	copied := *c
+	return e.raft.Propose(RaftEntry{Commitment: &copied})
+}
+
+// staleBidError return the error of bid checked before other bids of the bidder committed,
+// like the error of bidding after them, or replicate error for client to retry
+func staleBidError(bids []Bid, bid *Bid) error {
+	if bid.Sequence == 1 {
+		return Error{Code: CodeRequestAttendFirstRound, Message: "Attend first round"}
+	}
+	if len(bids) >= BidsPerBidder {
+		return Error{Code: CodeRequestAllIn, Message: "Allin"}
+	}
+	for _, preBid := range bids {
+		if preBid.Price == bid.Price {
+			return Error{Code: CodeRequestSamePrice, Message: "Same price"}
+		}
+	}
+	return Error{Code: CodeServerReplicateError, Message: "Replicate conflict"}
+}
+
+// addUnsaved keep committed entry failed to save to warehouse
+func (e *Exchange) addUnsaved(entry RaftEntry) {
+	e.appliedLock.Lock()
+	e.unsaved = append(e.unsaved, entry)
+	e.appliedLock.Unlock()
+}
+
+// saveUnsaved save committed entries failed to save again, return the count still failed
+func (e *Exchange) saveUnsaved() int {
+	e.appliedLock.Lock()
+	defer e.appliedLock.Unlock()
+
+	var failed []RaftEntry
+	for _, entry := range e.unsaved {
+		bid := entry.Bid
+		var err error
+		if entry.Commitment != nil {
+			c := *entry.Commitment
+			bid = Bid{Client: c.Client}
+			err = e.warehouse.AddCommitment(context.Background(), &c)
+		} else if entry.Withdraw {
+			err = e.warehouse.Withdraw(context.Background(), &bid)
+		} else {
+			err = e.warehouse.Add(context.Background(), &bid)
+		}
+		if err != nil {
+			e.sysLog.Printf("ERR:Save committed %d %d (%d), %s", bid.Client, bid.Price, bid.Sequence, err)
+			failed = append(failed, entry)
+		}
+	}
+	e.unsaved = failed
+	return len(failed)
+}
+
+// appliedBid return the bid committed with the same client and RequestID, nil if none
+func (e *Exchange) appliedBid(bid *Bid) *Bid {
+	if bid.RequestID == "" {
+		return nil
+	}
+
+	e.appliedLock.Lock()
+	defer e.appliedLock.Unlock()
+
+	return e.applied[strconv.Itoa(bid.Client)+":"+bid.RequestID]
+}
+
+// applyEntry save committed entry to warehouse and store, on leader and followers,
+// rejected entries are never saved, failures are saved again by Seal
+func (e *Exchange) applyEntry(entry RaftEntry) error {
+	bid := entry.Bid
+	if entry.Commitment != nil {
+		c := *entry.Commitment
+		// commitment of the bidder proposed by another leader, the first committed wins
+		if e.store.GetCommitment(c.Client) != nil {
+			return Error{Code: CodeRequestAttendFirstRound, Message: "Attend first round"}
+		}
+		if err := e.warehouse.AddCommitment(context.Background(), &c); err != nil {
+			e.sysLog.Printf("ERR:Apply commitment %d, %s", c.Client, err)
+			e.addUnsaved(entry)
+		}
+		e.store.AddCommitment(&c)
+		return nil
+	} else if entry.Withdraw {
+		if err := e.warehouse.Withdraw(context.Background(), &bid); err != nil {
+			e.sysLog.Printf("ERR:Apply withdraw %d (%d), %s", bid.Client, bid.Sequence, err)
+			e.addUnsaved(entry)
+		}
+		e.store.Withdraw(bid.Client, bid.Sequence)
+	} else {
+		// retry after Propose timeout, the first committed wins
+		if e.appliedBid(&bid) != nil {
+			return nil
+		}
+		// bid of the bidder proposed by another leader, the first committed wins
+		if bids := e.store.Bids(bid.Client); len(bids)+1 != bid.Sequence {
+			return staleBidError(bids, &bid)
+		}
+
+		copied := bid
+		if err := e.warehouse.Add(context.Background(), &copied); err != nil {
+			e.sysLog.Printf("ERR:Apply %d %d (%d), %s", bid.Client, bid.Price, bid.Sequence, err)
+			e.addUnsaved(entry)
+		}
+		bid.Active = true
+		e.store.Add(&bid)
+		if bid.RequestID != "" {
+			e.appliedLock.Lock()
+			e.applied[strconv.Itoa(bid.Client)+":"+bid.RequestID] = &bid
+			e.appliedLock.Unlock()
+		}
+		if c, ok := e.clock.(*HybridClock); ok {
+			c.Observe(bid.Time)
+		}
+	}
+
+	// leader updates in bidProcess, followers keep TailBid for taking over
+	if e.raft.IsLeader() {
+		return nil
+	}
+	session := e.session.Current()
+	if entry.Withdraw || session == SessionSecondHalf || e.BiddersCount() >= e.config.Capacity {
+		if e.collectLowestPrice() && session == SessionSecondHalf {
+			e.notifySoftClose()
+		}
+	}
+	return nil
+}
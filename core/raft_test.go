@@ -0,0 +1,377 @@
+package auccore
+
+import (
+	"testing"
+	"time"
+)
+
+func waitLeader(exchanges []*Exchange, except int) *Exchange {
+	for i := 0; i < 200; i++ {
+		for j, e := range exchanges {
+			if j != except && e.Raft().IsLeader() {
+				return e
+			}
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return nil
+}
+
+func TestRaftFailover(t *testing.T) {
+	now := time.Now()
+	conf := Config{
+		StartTime: now,
+		HalfTime:  now.Add(time.Second * 5),
+		EndTime:   now.Add(time.Second * 10),
+		Capacity:  10,
+	}
+
+	transport := NewMemoryTransport()
+	peers := []int{0, 1, 2}
+	exchanges := make([]*Exchange, len(peers))
+	for i := range peers {
+		node := NewRaftNode(i, peers, transport)
+		node.ProposeTimeout = time.Millisecond * 500
+		transport.Register(node)
+
+		exchanges[i] = newServingExchange(t, conf)
+		exchanges[i].SetRaft(node)
+		defer exchanges[i].Halt()
+		defer node.Stop()
+	}
+
+	leader := waitLeader(exchanges, -1)
+	if leader == nil {
+		t.Fatal("no leader elected")
+	}
+	for _, e := range exchanges {
+		if e != leader && bidCode(e.Bid(BidRequest{Client: 1, Price: 100})) != CodeServerNotLeader {
+			t.Error("follower accepted bid")
+		}
+	}
+	if code := bidCode(leader.Bid(BidRequest{Client: 1, Price: 100})); code != CodeSuccess {
+		t.Fatalf("bid on leader, code %d", code)
+	}
+
+	// committed bid is applied on followers
+	time.Sleep(time.Millisecond * 200)
+	for i, e := range exchanges {
+		if bid, err := e.Enquiry(1); err != nil || bid.Price != 100 {
+			t.Errorf("node %d store not rebuilt", i)
+		}
+		saved := NewStore(0)
+		e.warehouse.Restore(saved, e.config)
+		if saved.CountBids() != 1 {
+			t.Errorf("node %d warehouse not saved", i)
+		}
+	}
+
+	old := leader.Raft().ID
+	transport.Disconnect(old)
+	if code := bidCode(leader.Bid(BidRequest{Client: 2, Price: 100})); code != CodeServerReplicateError && code != CodeServerNotLeader {
+		t.Errorf("bid on partitioned leader, code %d", code)
+	}
+	// check quorum
+	time.Sleep(leader.Raft().ElectionTimeout * 2)
+	if leader.Raft().IsLeader() {
+		t.Error("partitioned leader still leading")
+	}
+
+	leader = waitLeader(exchanges, old)
+	if leader == nil {
+		t.Fatal("no leader elected after failover")
+	}
+	if code := bidCode(leader.Bid(BidRequest{Client: 3, Price: 200})); code != CodeSuccess {
+		t.Fatalf("bid on new leader, code %d", code)
+	}
+	if _, err := leader.Enquiry(1); err != nil {
+		t.Error("bid of previous leader lost")
+	}
+
+	// old leader rejoins and catches up
+	transport.Connect(old)
+	caughtUp := false
+	for i := 0; i < 100 && !caughtUp; i++ {
+		time.Sleep(time.Millisecond * 20)
+		bid, err := exchanges[old].Enquiry(3)
+		caughtUp = err == nil && bid.Price == 200
+	}
+	if !caughtUp {
+		t.Error("old leader not caught up")
+	}
+	if exchanges[old].Raft().IsLeader() {
+		t.Error("old leader not stepped down")
+	}
+}
+
+func TestRaftFailedProposalSeal(t *testing.T) {
+	now := time.Now()
+	conf := Config{
+		StartTime: now,
+		HalfTime:  now.Add(time.Second * 5),
+		EndTime:   now.Add(time.Second * 10),
+		Capacity:  10,
+		Reconcile: ReconcileWarehouse,
+	}
+
+	transport := NewMemoryTransport()
+	peers := []int{0, 1, 2}
+	exchanges := make([]*Exchange, len(peers))
+	for i := range peers {
+		node := NewRaftNode(i, peers, transport)
+		node.ProposeTimeout = time.Millisecond * 200
+		transport.Register(node)
+
+		exchanges[i] = newServingExchange(t, conf)
+		exchanges[i].SetRaft(node)
+		defer exchanges[i].Halt()
+		defer node.Stop()
+	}
+
+	leader := waitLeader(exchanges, -1)
+	if leader == nil {
+		t.Fatal("no leader elected")
+	}
+	old := leader.Raft().ID
+
+	// proposal of partitioned leader fails and is overwritten by the new leader
+	transport.Disconnect(old)
+	if code := bidCode(leader.Bid(BidRequest{Client: 2, Price: 100})); code != CodeServerReplicateError && code != CodeServerNotLeader {
+		t.Fatalf("bid on partitioned leader, code %d", code)
+	}
+	if leader = waitLeader(exchanges, old); leader == nil {
+		t.Fatal("no leader elected after failover")
+	}
+	if code := bidCode(leader.Bid(BidRequest{Client: 1, Price: 200})); code != CodeSuccess {
+		t.Fatalf("bid on new leader, code %d", code)
+	}
+
+	transport.Connect(old)
+	caughtUp := false
+	for i := 0; i < 100 && !caughtUp; i++ {
+		time.Sleep(time.Millisecond * 20)
+		bid, err := exchanges[old].Enquiry(1)
+		caughtUp = err == nil && bid.Price == 200
+	}
+	if !caughtUp {
+		t.Fatal("old leader not caught up")
+	}
+
+	// warehouse of old leader holds committed bids only
+	exchanges[old].Seal()
+	if d := exchanges[old].SealDiff(); d == nil || !d.Empty() {
+		t.Errorf("warehouse of old leader differs %s", d)
+	}
+	if changes := exchanges[old].Reconciled(); len(changes) != 0 {
+		t.Errorf("reconciled %v", changes)
+	}
+	if bid, err := exchanges[old].Enquiry(1); err != nil || bid.Price != 200 {
+		t.Errorf("enquiry after seal %+v, %v", bid, err)
+	}
+	if _, err := exchanges[old].Enquiry(2); errorCode(err) != CodeRequestNotAttend {
+		t.Errorf("failed proposal judged, code %d", errorCode(err))
+	}
+}
+
+func TestRaftLateCommit(t *testing.T) {
+	now := time.Now()
+	conf := Config{
+		StartTime: now,
+		HalfTime:  now.Add(time.Second * 5),
+		EndTime:   now.Add(time.Second * 10),
+		Capacity:  10,
+	}
+
+	transport := NewMemoryTransport()
+	peers := []int{0, 1, 2}
+	exchanges := make([]*Exchange, len(peers))
+	for i := range peers {
+		node := NewRaftNode(i, peers, transport)
+		node.ProposeTimeout = time.Millisecond * 100
+		transport.Register(node)
+
+		exchanges[i] = newServingExchange(t, conf)
+		exchanges[i].SetRaft(node)
+		defer exchanges[i].Halt()
+		defer node.Stop()
+	}
+
+	leader := waitLeader(exchanges, -1)
+	if leader == nil {
+		t.Fatal("no leader elected")
+	}
+
+	// proposal fails without majority, but stays in log of leader
+	for _, e := range exchanges {
+		if e != leader {
+			transport.Disconnect(e.Raft().ID)
+		}
+	}
+	req := BidRequest{Client: 1, Price: 100, RequestID: "r1"}
+	if code := bidCode(leader.Bid(req)); code != CodeServerReplicateError && code != CodeServerNotLeader {
+		t.Fatalf("bid without majority, code %d", code)
+	}
+	for _, e := range exchanges {
+		transport.Connect(e.Raft().ID)
+	}
+
+	// retry returns the same outcome whether the first proposal committed late or not
+	var result BidResult
+	var err error
+	for i := 0; i < 50; i++ {
+		if leader = waitLeader(exchanges, -1); leader == nil {
+			t.Fatal("no leader elected")
+		}
+		if result, err = leader.Bid(req); errorCode(err) != CodeServerNotLeader {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal("retry failed", err)
+	}
+	again, err := leader.Bid(req)
+	if err != nil || again.Serial != result.Serial || !again.Time.Equal(result.Time) {
+		t.Error("retry outcome differs", result, again, err)
+	}
+
+	time.Sleep(time.Millisecond * 200)
+	for i, e := range exchanges {
+		bids := e.store.Bids(1)
+		if len(bids) != 1 || bids[0].Serial != result.Serial {
+			t.Errorf("node %d bids %+v", i, bids)
+		}
+	}
+}
+
+func TestRaftApplyDuplicate(t *testing.T) {
+	now := time.Now()
+	e := newServingExchange(t, Config{
+		StartTime: now,
+		HalfTime:  now.Add(time.Second * 5),
+		EndTime:   now.Add(time.Second * 10),
+		Capacity:  10,
+	})
+	defer e.Halt()
+	e.raft = NewRaftNode(0, []int{0}, nil)
+	e.applied = make(map[string]*Bid)
+
+	first := Bid{Serial: 1, Client: 1, Price: 100, Sequence: 1, Time: now.Add(time.Millisecond), RequestID: "r1"}
+	if err := e.applyEntry(RaftEntry{Bid: first}); err != nil {
+		t.Fatal(err)
+	}
+	retry := first
+	retry.Serial, retry.Time = 2, now.Add(time.Millisecond*2)
+	if err := e.applyEntry(RaftEntry{Bid: retry}); err != nil {
+		t.Error("retry of committed request rejected", err)
+	}
+	if saved := e.appliedBid(&retry); saved == nil || saved.Serial != 1 {
+		t.Error("retry not resolved to the first bid")
+	}
+	// bids of the same bidder proposed by different leaders, rejected like bidding after the first
+	other := Bid{Serial: 3, Client: 1, Price: 101, Sequence: 1, Time: now.Add(time.Millisecond * 3)}
+	if err := e.applyEntry(RaftEntry{Bid: other}); errorCode(err) != CodeRequestAttendFirstRound {
+		t.Error("concurrent bid of the same bidder applied", err)
+	}
+	if len(e.store.Bids(1)) != 1 {
+		t.Error("len(e.store.Bids(1)) != 1")
+	}
+	second := Bid{Serial: 4, Client: 1, Price: 102, Sequence: 2, Time: now.Add(time.Millisecond * 4)}
+	e.applyEntry(RaftEntry{Bid: second})
+	stale := Bid{Serial: 5, Client: 1, Price: 102, Sequence: 2, Time: now.Add(time.Millisecond * 5)}
+	if err := e.applyEntry(RaftEntry{Bid: stale}); errorCode(err) != CodeRequestSamePrice {
+		t.Error("stale bid of the same price", err)
+	}
+	stale.Price = 103
+	if err := e.applyEntry(RaftEntry{Bid: stale}); errorCode(err) != CodeServerReplicateError {
+		t.Error("stale bid", err)
+	}
+}
+
+func TestRaftUnsaved(t *testing.T) {
+	now := time.Now()
+	e := newServingExchange(t, Config{
+		StartTime: now,
+		HalfTime:  now.Add(time.Second * 5),
+		EndTime:   now.Add(time.Second * 10),
+		Capacity:  10,
+	})
+	defer e.Halt()
+	e.raft = NewRaftNode(0, []int{0, 1, 2}, nil)
+	e.applied = make(map[string]*Bid)
+	w := e.warehouse.(*MemoryWarehouse)
+
+	// committed bid is saved, stale bid rejected is not
+	first := Bid{Serial: 1, Client: 1, Price: 100, Sequence: 1, Time: now.Add(time.Millisecond)}
+	e.applyEntry(RaftEntry{Bid: first})
+	stale := Bid{Serial: 3, Client: 1, Price: 101, Sequence: 1, Time: now.Add(time.Millisecond * 3)}
+	if err := e.applyEntry(RaftEntry{Bid: stale}); err == nil {
+		t.Error("stale bid applied")
+	}
+	if saved := NewStore(0); w.Restore(saved, e.config) != nil || saved.CountBids() != 1 {
+		t.Error("stale bid saved")
+	}
+
+	// committed bid is kept until saved
+	w.SetChaos(Chaos{ErrorRate: 1})
+	other := Bid{Serial: 2, Client: 2, Price: 100, Sequence: 1, Time: now.Add(time.Millisecond * 2)}
+	if err := e.applyEntry(RaftEntry{Bid: other}); err != nil {
+		t.Error("committed bid rejected", err)
+	}
+	if e.store.CountBids() != 2 || e.saveUnsaved() != 1 {
+		t.Error("unsaved bid not kept")
+	}
+	w.SetChaos(Chaos{})
+	if e.saveUnsaved() != 0 {
+		t.Error("unsaved bid not saved again")
+	}
+	if saved := NewStore(0); w.Restore(saved, e.config) != nil || saved.CountBids() != 2 {
+		t.Error("unsaved bid not in warehouse")
+	}
+}
+
+func TestRaftApplyCommitment(t *testing.T) {
+	now := time.Now()
+	e := newServingExchange(t, Config{
+		StartTime:    now,
+		HalfTime:     now.Add(time.Second * 5),
+		EndTime:      now.Add(time.Second * 10),
+		Capacity:     10,
+		RevealWindow: time.Second,
+	})
+	defer e.Halt()
+	e.raft = NewRaftNode(0, []int{0, 1, 2}, nil)
+	e.applied = make(map[string]*Bid)
+	w := e.warehouse.(*MemoryWarehouse)
+
+	// committed commitment is saved
+	c := Commitment{Client: 1, Hash: CommitmentHash(1, 100, "a"), Time: now.Add(time.Millisecond)}
+	if err := e.applyEntry(RaftEntry{Commitment: &c}); err != nil {
+		t.Fatal(err)
+	}
+	if e.store.GetCommitment(1) == nil {
+		t.Error("commitment not applied")
+	}
+	other := Commitment{Client: 1, Hash: CommitmentHash(1, 101, "a"), Time: now.Add(time.Millisecond * 2)}
+	if err := e.applyEntry(RaftEntry{Commitment: &other}); errorCode(err) != CodeRequestAttendFirstRound {
+		t.Error("concurrent commitment of the same bidder applied", err)
+	}
+
+	w.SetChaos(Chaos{ErrorRate: 1})
+	failed := Commitment{Client: 2, Hash: CommitmentHash(2, 100, "b"), Time: now.Add(time.Millisecond * 3)}
+	e.applyEntry(RaftEntry{Commitment: &failed})
+	if e.saveUnsaved() != 1 {
+		t.Error("unsaved commitment not kept")
+	}
+	w.SetChaos(Chaos{})
+	if e.saveUnsaved() != 0 {
+		t.Error("unsaved commitment not saved again")
+	}
+
+	saved := NewStore(0)
+	if err := w.Restore(saved, e.config); err != nil {
+		t.Fatal(err)
+	}
+	if d := e.store.Diff(saved); !d.Empty() {
+		t.Errorf("warehouse differs %s", d)
+	}
+}
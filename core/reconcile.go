@@ -0,0 +1,86 @@
+package auccore
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	ReconcileNone      = iota // log the difference only, judge from memory
+	ReconcileWarehouse        // judge from store restored from warehouse
+)
+
+const (
+	BidStatusMissing = iota
+	BidStatusLost
+	BidStatusWon
+)
+
+var bidStatusNames = []string{"missing", "lost", "won"}
+
+// BidChange is a bid changed status by reconciliation
+type BidChange struct {
+	Client   int
+	Sequence int
+	Price    int
+	Before   int // BidStatus* judged from memory
+	After    int // BidStatus* judged from warehouse
+}
+
+func (c BidChange) String() string {
+	return fmt.Sprintf("%d (%d) %d: %s -> %s", c.Client, c.Sequence, c.Price, bidStatusNames[c.Before], bidStatusNames[c.After])
+}
+
+// bidStatus return status of all bids of a judged store
+func bidStatus(store *Store) (map[bidKey]int, map[bidKey]int) {
+	status := make(map[bidKey]int)
+	prices := make(map[bidKey]int)
+	store.RLock()
+	defer store.RUnlock()
+
+	for _, key := range store.BidderChain.Index {
+		for _, bid := range store.BidderChain.Blocks[key].Bids {
+			k := bidKey{bid.Client, bid.Sequence}
+			status[k] = BidStatusLost
+			prices[k] = bid.Price
+		}
+	}
+	for _, bid := range store.FinalBids {
+		status[bidKey{bid.Client, bid.Sequence}] = BidStatusWon
+	}
+	return status, prices
+}
+
+// statusChanges compare status of bids in two judged stores
+func statusChanges(before, after *Store) []BidChange {
+	statusBefore, prices := bidStatus(before)
+	statusAfter, pricesAfter := bidStatus(after)
+	for k, price := range pricesAfter {
+		prices[k] = price
+	}
+
+	var changes []BidChange
+	for k, price := range prices {
+		// missing bid gets zero value BidStatusMissing
+		if statusBefore[k] != statusAfter[k] {
+			changes = append(changes, BidChange{Client: k.client, Sequence: k.sequence, Price: price, Before: statusBefore[k], After: statusAfter[k]})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Client != changes[j].Client {
+			return changes[i].Client < changes[j].Client
+		}
+		return changes[i].Sequence < changes[j].Sequence
+	})
+	return changes
+}
+
+func formatBidChanges(changes []BidChange) string {
+	lines := make([]string, len(changes))
+	for i, c := range changes {
+		lines[i] = c.String()
+	}
+	return strings.Join(lines, "\n")
+}
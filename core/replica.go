@@ -0,0 +1,312 @@
+package auccore
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Replica is a read-only exchange rebuilding its own Store from events of primary,
+// serves Enquiry, State and Rank queries without competing with bidding,
+// session and schedule follow schedule events of primary
+type Replica struct {
+	Interval  time.Duration // poll interval of EventSource
+	Warehouse Warehouse     // restore store from it if events are lost, only Restore is called
+
+	config *Config
+	store  *Store
+	source EventSource
+	log    *log.Logger
+
+	lock    sync.RWMutex
+	state   State
+	serials map[int]bool   // applied events, source may deliver at least once
+	held    map[int][]*Bid // by client, bids received before the previous Sequence
+	applied int
+
+	seq     int          // all events up to seq are received
+	pending map[int]bool // received events after a gap
+	gap     int          // Seq missing since last Sync, 0 if none
+	gaps    int
+	resyncs int
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+func NewReplica(conf Config, source EventSource, logger *log.Logger) *Replica {
+	return &Replica{
+		Interval: time.Millisecond * 200,
+		config:   &conf,
+		store:    NewStore(conf.Capacity),
+		source:   source,
+		log:      logger,
+		serials:  make(map[int]bool),
+		held:     make(map[int][]*Bid),
+		pending:  make(map[int]bool),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Serve poll events from primary until Close
+func (r *Replica) Serve() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.Sync(); err != nil && r.log != nil {
+				r.log.Printf("ERR:Replica sync, %s", err)
+			}
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+// Close stop serving
+func (r *Replica) Close() {
+	close(r.quit)
+	<-r.done
+}
+
+// Sync poll new events and apply to store once
+func (r *Replica) Sync() error {
+	events, err := r.source.Poll()
+	r.apply(events)
+
+	return err
+}
+
+func (r *Replica) apply(events []BidEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var keys []int
+	for _, ev := range events {
+		r.receive(ev.Seq)
+		if ev.Schedule {
+			r.state.Session = ev.Session
+			r.config.HalfTime, r.config.EndTime = ev.HalfTime, ev.EndTime
+			continue
+		}
+		if !ev.Accepted || ev.Retry {
+			continue
+		}
+
+		if ev.Commit {
+			r.store.AddCommitment(&Commitment{Client: ev.Client, Hash: ev.Hash, Time: ev.BidTime, Revealed: r.store.GetBidderBlock(ev.Client) != nil})
+		} else if ev.Withdraw {
+			r.store.Withdraw(ev.Client, ev.Sequence)
+			keys = append(keys, ev.Price)
+		} else if !r.serials[ev.Serial] {
+			r.serials[ev.Serial] = true
+			keys = append(keys, r.addBid(&Bid{
+				Serial:   ev.Serial,
+				Client:   ev.Client,
+				Price:    ev.Price,
+				Time:     ev.BidTime,
+				Sequence: ev.Sequence,
+				Active:   true,
+			})...)
+		}
+		r.applied++
+	}
+
+	// events of different partitions arrive out of order
+	if len(keys) > 0 {
+		r.store.SortBlocks(keys)
+	}
+	r.checkGap()
+	r.collectState()
+}
+
+// addBid add bid to store in Sequence order of the bidder and return prices of bids added,
+// events of a bidder are published after its lock is released and may arrive in reverse order,
+// bid is held until the previous one is added
+func (r *Replica) addBid(bid *Bid) []int {
+	client := bid.Client
+	if n := len(r.store.Bids(client)); bid.Sequence <= n {
+		// restored by resync
+		return nil
+	} else if bid.Sequence > n+1 {
+		r.held[client] = append(r.held[client], bid)
+		return nil
+	}
+
+	var keys []int
+	for bid != nil {
+		r.store.Add(bid)
+		keys = append(keys, bid.Price)
+
+		// held bid following it
+		next := bid.Sequence + 1
+		held := r.held[client]
+		bid = nil
+		for i, b := range held {
+			if b.Sequence == next {
+				bid = b
+				held = append(held[:i], held[i+1:]...)
+				break
+			}
+		}
+		if len(held) > 0 {
+			r.held[client] = held
+		} else {
+			delete(r.held, client)
+		}
+	}
+	return keys
+}
+
+// receive track Seq of events, events of different partitions arrive out of order
+func (r *Replica) receive(seq int) {
+	if seq <= r.seq {
+		return
+	}
+	r.pending[seq] = true
+	for r.pending[r.seq+1] {
+		delete(r.pending, r.seq+1)
+		r.seq++
+	}
+}
+
+// checkGap resync if an event is still missing after one more Sync, it is lost by primary
+func (r *Replica) checkGap() {
+	if len(r.pending) == 0 {
+		r.gap = 0
+		return
+	}
+	if r.gap != r.seq+1 {
+		r.gap = r.seq + 1
+		return
+	}
+
+	last := r.seq
+	for seq := range r.pending {
+		if seq > last {
+			last = seq
+		}
+	}
+	if r.log != nil {
+		r.log.Printf("ERR:Replica events %d-%d lost", r.seq+1, last)
+	}
+	if err := r.resync(); err != nil {
+		// retry by next Sync
+		if r.log != nil {
+			r.log.Printf("ERR:Replica resync, %s", err)
+		}
+		return
+	}
+	r.gaps++
+	r.seq, r.gap = last, 0
+	r.pending = make(map[int]bool)
+}
+
+// resync rebuild store from Warehouse, bids applied later are skipped by serial,
+// store is kept if Warehouse fails
+func (r *Replica) resync() error {
+	if r.Warehouse == nil {
+		return nil
+	}
+
+	store := NewStore(r.config.Capacity)
+	if err := r.Warehouse.Restore(store, r.config); err != nil {
+		return err
+	}
+	store.SortAllBlocks()
+	r.store = store
+	r.serials = make(map[int]bool)
+	for _, bid := range bidsByKey(store) {
+		r.serials[bid.Serial] = true
+	}
+
+	// held bids not saved yet when restored
+	held := r.held
+	r.held = make(map[int][]*Bid)
+	var keys []int
+	for _, bids := range held {
+		for _, bid := range bids {
+			if !r.serials[bid.Serial] {
+				r.serials[bid.Serial] = true
+				keys = append(keys, r.addBid(bid)...)
+			}
+		}
+	}
+	if len(keys) > 0 {
+		store.SortBlocks(keys)
+	}
+	r.resyncs++
+	return nil
+}
+
+// collectState update State like Exchange.collectStat
+func (r *Replica) collectState() {
+	r.state.Time = time.Now()
+	r.state.EndTime = r.config.EndTime
+	r.state.Bidders = r.store.CountBidders()
+	if r.store.TailBid != nil {
+		r.state.LowestPrice = r.store.TailBid.Price
+		r.state.LowestTime = r.store.TailBid.Time
+	}
+}
+
+// Enquiry enquiries bidder's latest Bid
+func (r *Replica) Enquiry(client int) (BidResult, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	bid, err := enquiry(r.store, client)
+	if err != nil {
+		return BidResult{}, err
+	}
+	return newBidResult(bid), nil
+}
+
+// State return a copy of state at last Sync
+func (r *Replica) State() *State {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	state := r.state
+	return &state
+}
+
+// Rank return the position of bidder's active bid, 1 for the highest price
+// position not greater than Capacity means successful for now
+func (r *Replica) Rank(client int) (int, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	rank, bid := r.store.Rank(client)
+	if bid == nil {
+		return 0, Error{Code: CodeRequestNotAttend, Message: "Not attend"}
+	}
+	return rank, nil
+}
+
+// Gaps return the count of lost events detected, Resyncs the count of store rebuilt from Warehouse
+func (r *Replica) Gaps() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.gaps
+}
+
+func (r *Replica) Resyncs() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.resyncs
+}
+
+// Applied return the count of events applied
+func (r *Replica) Applied() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.applied
+}
@@ -0,0 +1,339 @@
+package auccore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReplica(t *testing.T) {
+	broker, err := NewLocalBroker("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	now := time.Now()
+	conf := Config{
+		StartTime: now,
+		HalfTime:  now.Add(time.Millisecond * 300),
+		EndTime:   now.Add(time.Second * 2),
+		Capacity:  2,
+	}
+
+	t.Setenv("DB_DRIVER", "")
+	e, err := NewExchange(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.SetEventSink(NewKafkaSink(broker.Addr(), "bids", 2))
+	go e.Serve()
+	for i := 0; i < 100 && e.Session() == SessionUnprepared; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	e.Bid(BidRequest{Client: 1, Price: 100})
+	e.Bid(BidRequest{Client: 2, Price: 100})
+	e.Bid(BidRequest{Client: 3, Price: 101})
+	e.Bid(BidRequest{Client: 3, Price: 102}) // rejected
+	time.Sleep(time.Until(conf.HalfTime.Add(time.Millisecond * 50)))
+	e.Bid(BidRequest{Client: 1, Price: 102})
+	e.Halt() // flush events
+
+	source := NewKafkaSource(broker.Addr(), "bids", 2)
+	defer source.Close()
+	r := NewReplica(conf, source, nil)
+	if err := r.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Applied() != 4 {
+		t.Errorf("r.Applied() != 4, %d", r.Applied())
+	}
+	if r.store.CountBids() != e.store.CountBids() || !e.store.Equal(r.store) {
+		t.Error("replica store differs from primary")
+	}
+	if state := r.State(); state.LowestPrice != 101 || state.Bidders != 3 {
+		t.Errorf("unexpected state %+v", state)
+	}
+
+	bid, err := r.Enquiry(1)
+	if err != nil || bid.Price != 102 || bid.Sequence != 2 {
+		t.Error("unexpected enquiry", bid, err)
+	}
+	if rank, _ := r.Rank(1); rank != 1 {
+		t.Errorf("rank of client 1 is %d", rank)
+	}
+	if rank, _ := r.Rank(2); rank != 3 {
+		t.Errorf("rank of client 2 is %d", rank)
+	}
+	if _, err := r.Rank(4); errorCode(err) != CodeRequestNotAttend {
+		t.Error("rank of absent bidder")
+	}
+	if state := r.State(); state.Session != SessionFinished || !state.EndTime.Equal(conf.EndTime) {
+		t.Errorf("session not replicated %+v", state)
+	}
+	if r.Gaps() != 0 {
+		t.Errorf("r.Gaps() != 0, %d", r.Gaps())
+	}
+}
+
+func TestReplicaGap(t *testing.T) {
+	now := time.Now()
+	conf := Config{
+		StartTime: now,
+		HalfTime:  now.Add(time.Second),
+		EndTime:   now.Add(time.Second * 2),
+		Capacity:  2,
+	}
+
+	w := NewMemoryWarehouse()
+	w.Initialize()
+	bids := []*Bid{
+		{Serial: 1, Client: 1, Price: 100, Sequence: 1},
+		{Serial: 2, Client: 2, Price: 101, Sequence: 1},
+		{Serial: 3, Client: 3, Price: 102, Sequence: 1},
+	}
+	for _, bid := range bids {
+		bid.Time = now.Add(time.Millisecond * time.Duration(bid.Serial))
+		if err := w.Add(context.Background(), bid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	event := func(seq int, bid *Bid) BidEvent {
+		return BidEvent{Seq: seq, Serial: bid.Serial, Client: bid.Client, Price: bid.Price, Sequence: bid.Sequence, BidTime: bid.Time, Accepted: true}
+	}
+
+	source := NewMemorySink()
+	r := NewReplica(conf, NewMemorySource(source), nil)
+	r.Warehouse = w
+
+	// event 2 of bid 2 arrives late from another partition
+	source.Publish([]BidEvent{{Seq: 1, Schedule: true, Session: SessionFirstHalf, HalfTime: conf.HalfTime, EndTime: conf.EndTime}, event(3, bids[0])})
+	r.Sync()
+	source.Publish([]BidEvent{event(2, bids[1])})
+	r.Sync()
+	if r.Gaps() != 0 || r.store.CountBids() != 2 {
+		t.Error("late event taken as lost")
+	}
+	if r.State().Session != SessionFirstHalf {
+		t.Error("session not replicated")
+	}
+
+	// event 4 of bid 3 is dropped by primary
+	source.Publish([]BidEvent{{Seq: 5, Schedule: true, Session: SessionSecondHalf, HalfTime: conf.HalfTime, EndTime: conf.EndTime.Add(time.Second)}})
+	r.Sync()
+	if r.Gaps() != 0 {
+		t.Error("gap reported before next Sync")
+	}
+	r.Sync()
+	if r.Gaps() != 1 || r.Resyncs() != 1 {
+		t.Fatalf("gap not resynced, %d %d", r.Gaps(), r.Resyncs())
+	}
+	if bid, err := r.Enquiry(3); err != nil || bid.Price != 102 || r.store.CountBids() != 3 {
+		t.Error("store not restored from warehouse", bid, err)
+	}
+	if state := r.State(); state.Session != SessionSecondHalf || !state.EndTime.Equal(conf.EndTime.Add(time.Second)) {
+		t.Errorf("schedule not replicated %+v", state)
+	}
+
+	// bid already restored is skipped
+	source.Publish([]BidEvent{event(6, bids[2])})
+	r.Sync()
+	if r.store.CountBids() != 3 || r.Gaps() != 1 {
+		t.Error("restored bid applied twice")
+	}
+}
+
+func TestReplicaBidOrder(t *testing.T) {
+	now := time.Now()
+	conf := Config{
+		StartTime: now,
+		HalfTime:  now.Add(time.Second),
+		EndTime:   now.Add(time.Second * 2),
+		Capacity:  1,
+	}
+	primary := NewStore(conf.Capacity)
+	bids := []*Bid{
+		{Serial: 1, Client: 1, Price: 100, Sequence: 1, Time: now.Add(time.Millisecond)},
+		{Serial: 2, Client: 2, Price: 100, Sequence: 1, Time: now.Add(time.Millisecond * 2)},
+		{Serial: 3, Client: 1, Price: 101, Sequence: 2, Time: now.Add(time.Second + time.Millisecond)},
+		{Serial: 4, Client: 1, Price: 102, Sequence: 3, Time: now.Add(time.Second + time.Millisecond*2)},
+	}
+	for _, bid := range bids {
+		bidCopy := *bid
+		bidCopy.Active = true
+		primary.Add(&bidCopy)
+	}
+	event := func(seq int, bid *Bid) BidEvent {
+		return BidEvent{Seq: seq, Serial: bid.Serial, Client: bid.Client, Price: bid.Price, Sequence: bid.Sequence, BidTime: bid.Time, Accepted: true}
+	}
+
+	source := NewMemorySink()
+	r := NewReplica(conf, NewMemorySource(source), nil)
+
+	// bids of a bidder published in reverse order, across Syncs
+	source.Publish([]BidEvent{event(1, bids[1]), event(2, bids[3]), event(3, bids[0])})
+	r.Sync()
+	if bid, err := r.Enquiry(1); err != nil || bid.Sequence != 1 {
+		t.Error("bid applied before the previous one", bid, err)
+	}
+	source.Publish([]BidEvent{event(4, bids[2])})
+	r.Sync()
+
+	if bid, err := r.Enquiry(1); err != nil || bid.Sequence != 3 || bid.Price != 102 {
+		t.Error("unexpected enquiry", bid, err)
+	}
+	if d := primary.Diff(r.store); !d.Empty() {
+		t.Errorf("replica store differs from primary %s", d)
+	}
+	if rank, err := r.Rank(1); err != nil || rank != 1 {
+		t.Errorf("rank %d, %v", rank, err)
+	}
+	if state := r.State(); state.LowestPrice != 102 {
+		t.Errorf("unexpected state %+v", state)
+	}
+}
+
+func TestReplicaCommitment(t *testing.T) {
+	now := time.Now()
+	conf := Config{
+		StartTime:    now,
+		HalfTime:     now.Add(time.Second),
+		EndTime:      now.Add(time.Second * 2),
+		Capacity:     2,
+		RevealWindow: time.Millisecond * 500,
+	}
+
+	w := NewMemoryWarehouse()
+	w.Initialize()
+	commitments := []*Commitment{
+		{Client: 1, Hash: CommitmentHash(1, 100, "a"), Time: now.Add(time.Millisecond)},
+		{Client: 2, Hash: CommitmentHash(2, 100, "b"), Time: now.Add(time.Millisecond * 2)},
+	}
+	for _, c := range commitments {
+		if err := w.AddCommitment(context.Background(), c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	source := NewMemorySink()
+	r := NewReplica(conf, NewMemorySource(source), nil)
+	r.Warehouse = w
+
+	source.Publish([]BidEvent{
+		{Seq: 1, Client: 1, BidTime: commitments[0].Time, Accepted: true, Commit: true, Hash: commitments[0].Hash},
+		{Seq: 2, Client: 3, Accepted: false, Commit: true, Hash: "c"},
+	})
+	r.Sync()
+	if _, err := r.Enquiry(1); errorCode(err) != CodeRequestNotReveal {
+		t.Errorf("enquiry unrevealed, code %d", errorCode(err))
+	}
+	if _, err := r.Enquiry(3); errorCode(err) != CodeRequestNotAttend {
+		t.Errorf("enquiry rejected commitment, code %d", errorCode(err))
+	}
+
+	// event 3 of commitment 2 is dropped by primary, restored with bids
+	source.Publish([]BidEvent{{Seq: 4, Schedule: true, Session: SessionFirstHalf, HalfTime: conf.HalfTime, EndTime: conf.EndTime}})
+	r.Sync()
+	r.Sync()
+	if r.Resyncs() != 1 {
+		t.Fatalf("gap not resynced, %d", r.Resyncs())
+	}
+	if c := r.store.GetCommitment(2); c == nil || c.Hash != commitments[1].Hash {
+		t.Errorf("commitment not restored from warehouse %+v", c)
+	}
+}
+
+func TestReplicaResyncLive(t *testing.T) {
+	now := time.Now()
+	conf := Config{
+		StartTime: now.Add(-time.Second),
+		HalfTime:  now.Add(time.Hour),
+		EndTime:   now.Add(time.Hour * 2),
+		Capacity:  2,
+	}
+
+	w := NewMemoryWarehouse()
+	w.SetSimulator(NewConcurrencySimulatorWithModel(10, ConstantLatency{}, 1))
+	w.Initialize()
+
+	source := NewMemorySink()
+	r := NewReplica(conf, NewMemorySource(source), nil)
+	r.Warehouse = w
+
+	// bids keep coming while replica resyncs
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 200; i++ {
+			w.Add(context.Background(), &Bid{Serial: i, Client: i, Price: 100 + i, Sequence: 1, Time: now})
+		}
+	}()
+
+	schedule := func(seq int) {
+		source.Publish([]BidEvent{{Seq: seq, Schedule: true, Session: SessionFirstHalf, HalfTime: conf.HalfTime, EndTime: conf.EndTime}})
+		r.Sync()
+		r.Sync()
+	}
+	seq := 0
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		seq += 2
+		schedule(seq)
+	}
+	seq += 2
+	schedule(seq)
+
+	if r.Resyncs() != seq/2 {
+		t.Errorf("r.Resyncs() != %d, %d", seq/2, r.Resyncs())
+	}
+	if r.store.CountBids() != 200 {
+		t.Errorf("r.store.CountBids() != 200, %d", r.store.CountBids())
+	}
+}
+
+// brokenRestoreWarehouse fail Restore while broken
+type brokenRestoreWarehouse struct {
+	*MemoryWarehouse
+	broken bool
+}
+
+func (w *brokenRestoreWarehouse) Restore(store *Store, c *Config) error {
+	if w.broken {
+		return errors.New("connection refused")
+	}
+	return w.MemoryWarehouse.Restore(store, c)
+}
+
+func TestReplicaResyncError(t *testing.T) {
+	now := time.Now()
+	conf := Config{StartTime: now.Add(-time.Second), HalfTime: now.Add(time.Hour), EndTime: now.Add(time.Hour * 2), Capacity: 2}
+
+	w := &brokenRestoreWarehouse{MemoryWarehouse: NewMemoryWarehouse(), broken: true}
+	w.Initialize()
+	bid := &Bid{Serial: 1, Client: 1, Price: 100, Sequence: 1, Time: now}
+	w.Add(context.Background(), bid)
+
+	source := NewMemorySink()
+	r := NewReplica(conf, NewMemorySource(source), nil)
+	r.Warehouse = w
+	source.Publish([]BidEvent{{Seq: 1, Serial: 1, Client: 1, Price: 100, Sequence: 1, BidTime: now, Accepted: true}, {Seq: 3, Schedule: true, Session: SessionFirstHalf, HalfTime: conf.HalfTime, EndTime: conf.EndTime}})
+	r.Sync()
+	r.Sync()
+	if r.Resyncs() != 0 || r.store.CountBids() != 1 {
+		t.Error("store changed by failed resync")
+	}
+
+	// retried by next Sync
+	w.broken = false
+	r.Sync()
+	if r.Resyncs() != 1 || r.Gaps() != 1 {
+		t.Errorf("resync not retried, %d %d", r.Resyncs(), r.Gaps())
+	}
+}
@@ -0,0 +1,246 @@
+package auccore
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	BreakerClosed = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+// RetryPolicy of RetryWarehouse
+type RetryPolicy struct {
+	MaxRetries int
+	Backoff    time.Duration // delay before first retry, doubled each retry
+	MaxBackoff time.Duration // 0 for no limit
+
+	FailureThreshold int           // consecutive failures opening the breaker, 0 for disable
+	OpenTimeout      time.Duration // breaker stays open before probing again
+
+	// Retryable decide whether the error is safe to retry, nil for IsRetryableSaveError,
+	// or IsSaveError for Add with Bid.RequestID which is replayed by warehouse
+	Retryable func(err error) bool
+}
+
+// RetryStats is metrics of RetryWarehouse
+type RetryStats struct {
+	Calls     uint64 // calls of Add, Commit and Withdraw
+	Retries   uint64 // retry attempts
+	Recovered uint64 // calls succeeded after retry
+	Failed    uint64 // calls failed after all attempts
+	Rejected  uint64 // calls failed fast by open breaker
+	Opens     uint64 // times breaker opened
+}
+
+// RetryWarehouse retry transient errors of a Warehouse with exponential backoff
+// within the remaining session time, and fail fast by circuit breaker when it is down
+type RetryWarehouse struct {
+	Warehouse
+	Policy RetryPolicy
+
+	// Deadline return the end of current session, retries never go beyond it, nil for no limit
+	Deadline func() time.Time
+
+	lock      sync.Mutex
+	state     int
+	failures  int       // consecutive failures
+	openUntil time.Time // end of open state
+	probing   bool      // a call is probing in half-open state
+
+	stats RetryStats // atomic
+}
+
+func NewRetryWarehouse(w Warehouse, policy RetryPolicy) *RetryWarehouse {
+	return &RetryWarehouse{Warehouse: w, Policy: policy}
+}
+
+// RetryPolicyFromEnv read RetryPolicy from env, false if not configured, eg,
+// WAREHOUSE_RETRIES=3 WAREHOUSE_BACKOFF=20ms WAREHOUSE_MAX_BACKOFF=200ms WAREHOUSE_BREAKER=10 WAREHOUSE_BREAKER_OPEN=1s
+func RetryPolicyFromEnv() (RetryPolicy, bool) {
+	retries, err := strconv.Atoi(os.Getenv("WAREHOUSE_RETRIES"))
+	if err != nil {
+		return RetryPolicy{}, false
+	}
+
+	p := RetryPolicy{MaxRetries: retries, Backoff: time.Millisecond * 20, OpenTimeout: time.Second}
+	if d, err := time.ParseDuration(os.Getenv("WAREHOUSE_BACKOFF")); err == nil {
+		p.Backoff = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("WAREHOUSE_MAX_BACKOFF")); err == nil {
+		p.MaxBackoff = d
+	}
+	p.FailureThreshold, _ = strconv.Atoi(os.Getenv("WAREHOUSE_BREAKER"))
+	if d, err := time.ParseDuration(os.Getenv("WAREHOUSE_BREAKER_OPEN")); err == nil {
+		p.OpenTimeout = d
+	}
+	return p, true
+}
+
+// IsRetryableSaveError check the error happened before anything was written, ie, no connection,
+// so retry never saves a bid twice
+func IsRetryableSaveError(err error) bool {
+	e, ok := err.(Error)
+	return ok && e.Code == CodeServerSaveError0
+}
+
+// IsSaveError check the error is a failure of warehouse rather than of the request,
+// the write may or may not be done
+func IsSaveError(err error) bool {
+	e, ok := err.(Error)
+	return !ok || (e.Code >= CodeServerSaveError0 && e.Code <= CodeServerSaveError5)
+}
+
+func (w *RetryWarehouse) Add(ctx context.Context, bid *Bid) error {
+	retryable := w.Policy.Retryable
+	if retryable == nil && bid.RequestID != "" {
+		// saved row is replayed by Bid.RequestID, retry never saves a bid twice
+		retryable = IsSaveError
+	}
+	return w.do(ctx, retryable, func() error { return w.Warehouse.Add(ctx, bid) })
+}
+
+func (w *RetryWarehouse) Commit(ctx context.Context, bid *Bid) error {
+	return w.do(ctx, w.Policy.Retryable, func() error { return w.Warehouse.Commit(ctx, bid) })
+}
+
+func (w *RetryWarehouse) Withdraw(ctx context.Context, bid *Bid) error {
+	return w.do(ctx, w.Policy.Retryable, func() error { return w.Warehouse.Withdraw(ctx, bid) })
+}
+
+func (w *RetryWarehouse) AddCommitment(ctx context.Context, c *Commitment) error {
+	retryable := w.Policy.Retryable
+	if retryable == nil {
+		// saved commitment of the same bidder is kept, retry never saves it twice
+		retryable = IsSaveError
+	}
+	return w.do(ctx, retryable, func() error { return w.Warehouse.AddCommitment(ctx, c) })
+}
+
+// Stats return a snapshot of metrics
+func (w *RetryWarehouse) Stats() RetryStats {
+	return RetryStats{
+		Calls:     atomic.LoadUint64(&w.stats.Calls),
+		Retries:   atomic.LoadUint64(&w.stats.Retries),
+		Recovered: atomic.LoadUint64(&w.stats.Recovered),
+		Failed:    atomic.LoadUint64(&w.stats.Failed),
+		Rejected:  atomic.LoadUint64(&w.stats.Rejected),
+		Opens:     atomic.LoadUint64(&w.stats.Opens),
+	}
+}
+
+// BreakerState return BreakerClosed, BreakerOpen or BreakerHalfOpen
+func (w *RetryWarehouse) BreakerState() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.state == BreakerOpen && !time.Now().Before(w.openUntil) {
+		return BreakerHalfOpen
+	}
+	return w.state
+}
+
+func (w *RetryWarehouse) do(ctx context.Context, retryable func(err error) bool, call func() error) error {
+	atomic.AddUint64(&w.stats.Calls, 1)
+
+	if retryable == nil {
+		retryable = IsRetryableSaveError
+	}
+	deadline := time.Time{}
+	if w.Deadline != nil {
+		deadline = w.Deadline()
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+
+	backoff := w.Policy.Backoff
+	for retries := 0; ; retries++ {
+		if !w.allow() {
+			atomic.AddUint64(&w.stats.Rejected, 1)
+			return Error{Code: CodeServerUnavailable, Message: "Warehouse unavailable"}
+		}
+
+		err := call()
+		if err == nil || !IsSaveError(err) {
+			// request errors, eg, timeout of the request, the warehouse works
+			w.report(true)
+			if err == nil && retries > 0 {
+				atomic.AddUint64(&w.stats.Recovered, 1)
+			}
+			return err
+		}
+		w.report(false)
+
+		if !retryable(err) || retries >= w.Policy.MaxRetries || (!deadline.IsZero() && time.Now().Add(backoff).After(deadline)) {
+			atomic.AddUint64(&w.stats.Failed, 1)
+			return err
+		}
+		if e := sleepContext(ctx, backoff); e != nil {
+			atomic.AddUint64(&w.stats.Failed, 1)
+			return contextError(e)
+		}
+		atomic.AddUint64(&w.stats.Retries, 1)
+
+		backoff *= 2
+		if w.Policy.MaxBackoff > 0 && backoff > w.Policy.MaxBackoff {
+			backoff = w.Policy.MaxBackoff
+		}
+	}
+}
+
+// allow check breaker, only one probe passes in half-open state
+func (w *RetryWarehouse) allow() bool {
+	if w.Policy.FailureThreshold <= 0 {
+		return true
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.state == BreakerOpen {
+		if time.Now().Before(w.openUntil) {
+			return false
+		}
+		w.state = BreakerHalfOpen
+	}
+	if w.state == BreakerHalfOpen {
+		if w.probing {
+			return false
+		}
+		w.probing = true
+	}
+	return true
+}
+
+// report outcome of a call to breaker
+func (w *RetryWarehouse) report(ok bool) {
+	if w.Policy.FailureThreshold <= 0 {
+		return
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.probing = false
+	if ok {
+		w.state = BreakerClosed
+		w.failures = 0
+		return
+	}
+
+	w.failures++
+	if w.state == BreakerHalfOpen || w.failures >= w.Policy.FailureThreshold {
+		if w.state != BreakerOpen {
+			atomic.AddUint64(&w.stats.Opens, 1)
+		}
+		w.state = BreakerOpen
+		w.openUntil = time.Now().Add(w.Policy.OpenTimeout)
+	}
+}
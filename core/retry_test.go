@@ -0,0 +1,119 @@
+package auccore
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyWarehouse fail Add with code while failures > 0
+type flakyWarehouse struct {
+	*MemoryWarehouse
+	failures int32
+	code     int
+}
+
+func (w *flakyWarehouse) Add(ctx context.Context, bid *Bid) error {
+	if atomic.AddInt32(&w.failures, -1) >= 0 {
+		return Error{Code: w.code, Message: "Flaky"}
+	}
+	return w.MemoryWarehouse.Add(ctx, bid)
+}
+
+func newFlakyWarehouse(failures int32, code int) *flakyWarehouse {
+	w := &flakyWarehouse{MemoryWarehouse: NewMemoryWarehouse(), failures: failures, code: code}
+	w.SetSimulator(NewConcurrencySimulatorWithModel(10, ConstantLatency{}, 1))
+	w.Initialize()
+	return w
+}
+
+func TestRetryWarehouse(t *testing.T) {
+	flaky := newFlakyWarehouse(2, CodeServerSaveError0)
+	w := NewRetryWarehouse(flaky, RetryPolicy{MaxRetries: 3, Backoff: time.Millisecond})
+	if err := w.Add(context.Background(), &Bid{Client: 1, Price: 100}); err != nil {
+		t.Error(err)
+	}
+	if stats := w.Stats(); stats.Retries != 2 || stats.Recovered != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// saved bid may be duplicated, never retry
+	for _, code := range []int{CodeServerSaveError1, CodeServerSaveError4, CodeServerSaveError5} {
+		flaky = newFlakyWarehouse(1, code)
+		w = NewRetryWarehouse(flaky, RetryPolicy{MaxRetries: 3, Backoff: time.Millisecond})
+		if errorCode(w.Add(context.Background(), &Bid{Client: 1, Price: 100})) != code || w.Stats().Retries != 0 {
+			t.Errorf("retried error %d after saving", code)
+		}
+	}
+
+	// saved bid is replayed by RequestID, retry is safe
+	flaky = newFlakyWarehouse(1, CodeServerSaveError4)
+	w = NewRetryWarehouse(flaky, RetryPolicy{MaxRetries: 3, Backoff: time.Millisecond})
+	if err := w.Add(context.Background(), &Bid{Client: 1, Price: 100, RequestID: "r1"}); err != nil || w.Stats().Retries != 1 {
+		t.Error("idempotent add not retried", err)
+	}
+
+	// retries stop at session deadline
+	flaky = newFlakyWarehouse(100, CodeServerSaveError0)
+	w = NewRetryWarehouse(flaky, RetryPolicy{MaxRetries: 100, Backoff: time.Millisecond * 10})
+	w.Deadline = func() time.Time { return time.Now().Add(time.Millisecond * 30) }
+	start := time.Now()
+	if errorCode(w.Add(context.Background(), &Bid{Client: 1, Price: 100})) != CodeServerSaveError0 {
+		t.Error("unexpected error")
+	}
+	if time.Since(start) > time.Millisecond*40 {
+		t.Error("retried beyond deadline")
+	}
+}
+
+func TestRetryWarehouseBreaker(t *testing.T) {
+	flaky := newFlakyWarehouse(3, CodeServerSaveError1)
+	w := NewRetryWarehouse(flaky, RetryPolicy{FailureThreshold: 3, OpenTimeout: time.Millisecond * 50})
+
+	for i := 0; i < 3; i++ {
+		w.Add(context.Background(), &Bid{Client: i, Price: 100})
+	}
+	if w.BreakerState() != BreakerOpen {
+		t.Fatal("breaker not open")
+	}
+	if code := errorCode(w.Add(context.Background(), &Bid{Client: 4, Price: 100})); code != CodeServerUnavailable {
+		t.Errorf("open breaker, code %d", code)
+	}
+
+	time.Sleep(time.Millisecond * 60)
+	if w.BreakerState() != BreakerHalfOpen {
+		t.Error("breaker not half-open")
+	}
+	if err := w.Add(context.Background(), &Bid{Client: 5, Price: 100}); err != nil {
+		t.Error(err)
+	}
+	if w.BreakerState() != BreakerClosed {
+		t.Error("breaker not closed after probe")
+	}
+	if stats := w.Stats(); stats.Opens != 1 || stats.Rejected != 1 || stats.Failed != 3 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestRetryWarehouseBreakerErrors(t *testing.T) {
+	// non-retryable save errors are failures of warehouse
+	flaky := newFlakyWarehouse(2, CodeServerSaveError4)
+	w := NewRetryWarehouse(flaky, RetryPolicy{FailureThreshold: 2, OpenTimeout: time.Second})
+	for i := 0; i < 2; i++ {
+		w.Add(context.Background(), &Bid{Client: i, Price: 100})
+	}
+	if w.BreakerState() != BreakerOpen {
+		t.Error("breaker not open by save errors")
+	}
+
+	// request errors keep breaker closed
+	flaky = newFlakyWarehouse(2, CodeRequestTimeout)
+	w = NewRetryWarehouse(flaky, RetryPolicy{FailureThreshold: 2, OpenTimeout: time.Second})
+	for i := 0; i < 2; i++ {
+		w.Add(context.Background(), &Bid{Client: i, Price: 100})
+	}
+	if w.BreakerState() != BreakerClosed {
+		t.Error("breaker open by request errors")
+	}
+}
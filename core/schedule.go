@@ -0,0 +1,188 @@
+package auccore
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ScheduleActionPause  = "pause"
+	ScheduleActionResume = "resume"
+	ScheduleActionExtend = "extend"
+
+	ScheduleActionSoftClose = "softclose"
+)
+
+// ScheduleChange is an audit record of operator intervention on session schedule
+type ScheduleChange struct {
+	Time     time.Time
+	Action   string
+	Reason   string
+	HalfTime time.Time // schedule after change
+	EndTime  time.Time
+}
+
+// scheduleRequest ask Serve to re-arm timers, Serve is the only owner of timers
+type scheduleRequest struct {
+	halfTime time.Time
+	endTime  time.Time
+	reason   string
+	done     chan error
+}
+
+// ScheduleLog keep all schedule changes in order
+type ScheduleLog struct {
+	sync.RWMutex
+	changes []ScheduleChange
+}
+
+func (l *ScheduleLog) append(c ScheduleChange) {
+	l.Lock()
+	l.changes = append(l.changes, c)
+	l.Unlock()
+}
+
+// Pause reject all incoming bids with CodeServerPaused until Resume
+// timers keep running, Extend if the paused time should be compensated
+func (e *Exchange) Pause(reason string) error {
+	if e.session.Current() >= SessionFinished {
+		return Error{Code: CodeServerEnd, Message: "Invalid time"}
+	}
+	if !atomic.CompareAndSwapInt32(&e.paused, 0, 1) {
+		return Error{Code: CodeRequestInvalid, Message: "Already paused"}
+	}
+
+	e.logSchedule(ScheduleActionPause, reason)
+	return nil
+}
+
+// Resume accept bids again after Pause
+func (e *Exchange) Resume(reason string) error {
+	if !atomic.CompareAndSwapInt32(&e.paused, 1, 0) {
+		return Error{Code: CodeRequestInvalid, Message: "Not paused"}
+	}
+
+	e.logSchedule(ScheduleActionResume, reason)
+	return nil
+}
+
+// Paused return whether bidding is paused
+func (e *Exchange) Paused() bool {
+	return atomic.LoadInt32(&e.paused) == 1
+}
+
+// Extend postpone HalfTime and/or EndTime, zero time.Time keep the current one
+// only available while serving, schedule can not be brought forward
+func (e *Exchange) Extend(halfTime, endTime time.Time, reason string) error {
+	req := scheduleRequest{
+		halfTime: halfTime,
+		endTime:  endTime,
+		reason:   reason,
+		done:     make(chan error, 1),
+	}
+
+	select {
+	case e.scheduleSign <- req:
+		return <-req.done
+	case <-e.serveDone:
+		return Error{Code: CodeServerEnd, Message: "Invalid time"}
+	}
+}
+
+// ScheduleChanges return the audit trail of schedule changes
+func (e *Exchange) ScheduleChanges() []ScheduleChange {
+	e.scheduleLog.RLock()
+	defer e.scheduleLog.RUnlock()
+
+	return append([]ScheduleChange(nil), e.scheduleLog.changes...)
+}
+
+// reschedule apply scheduleRequest, must be called in Serve
+func (e *Exchange) reschedule(req scheduleRequest) error {
+	session := e.session.Current()
+	if session >= SessionFinished {
+		return Error{Code: CodeServerEnd, Message: "Invalid time"}
+	}
+
+	halfTime, endTime := e.config.HalfTime, e.config.EndTime
+	if !req.halfTime.IsZero() {
+		if session == SessionSecondHalf {
+			return Error{Code: CodeRequestInvalidTime, Message: "Half passed"}
+		}
+		if !req.halfTime.After(halfTime) {
+			return Error{Code: CodeRequestInvalidTime, Message: "Not extended"}
+		}
+		halfTime = req.halfTime
+	}
+	if !req.endTime.IsZero() {
+		if !req.endTime.After(endTime) {
+			return Error{Code: CodeRequestInvalidTime, Message: "Not extended"}
+		}
+		endTime = req.endTime
+	}
+	if !endTime.After(halfTime) {
+		return Error{Code: CodeRequestInvalidTime, Message: "End before half"}
+	}
+
+	now := time.Now()
+	if halfTime != e.config.HalfTime {
+		rearmTimer(e.halfTimer, halfTime.Sub(now))
+	}
+	if endTime != e.config.EndTime {
+		rearmTimer(e.endTimer, endTime.Sub(now))
+	}
+	e.setSchedule(halfTime, endTime)
+
+	e.logSchedule(ScheduleActionExtend, req.reason)
+	return nil
+}
+
+// softClose extend EndTime if lowest price changed within Config.SoftCloseWindow, must be called in Serve
+func (e *Exchange) softClose() {
+	if e.session.Current() != SessionSecondHalf || time.Until(e.config.EndTime) > e.config.SoftCloseWindow {
+		return
+	}
+
+	d := e.config.SoftCloseExtension
+	if e.config.SoftCloseCap-e.softCloseExtended < d {
+		d = e.config.SoftCloseCap - e.softCloseExtended
+	}
+	if d <= 0 {
+		return
+	}
+
+	e.softCloseExtended += d
+	endTime := e.config.EndTime.Add(d)
+	rearmTimer(e.endTimer, time.Until(endTime))
+	e.setSchedule(e.config.HalfTime, endTime)
+
+	e.logSchedule(ScheduleActionSoftClose, "lowest price changed")
+}
+
+// rearmTimer reset a timer which may have fired but not been received
+func rearmTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+func (e *Exchange) logSchedule(action, reason string) {
+	halfTime, endTime := e.schedule()
+	c := ScheduleChange{
+		Time:     time.Now(),
+		Action:   action,
+		Reason:   reason,
+		HalfTime: halfTime,
+		EndTime:  endTime,
+	}
+	e.scheduleLog.append(c)
+
+	e.sysLog.Println("===============================")
+	e.sysLog.Printf(">>> Schedule %s @ %s, half %s, end %s, %s", c.Action, c.Time.Format("15:04:05.000000"), c.HalfTime.Format("15:04:05"), c.EndTime.Format("15:04:05"), c.Reason)
+	e.sysLog.Println("===============================")
+}
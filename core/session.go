@@ -0,0 +1,89 @@
+package auccore
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// SessionMachine hold the session state of an exchange,
+// session only moves forward: Unprepared → FirstHalf → SecondHalf → Finished → Sealed,
+// and may jump to Finished from any earlier session when halted
+type SessionMachine struct {
+	session int32 // atomic
+
+	hooksLock sync.RWMutex
+	onChange  []func(from, to int)
+	onSealed  []func(final *Final)
+}
+
+func NewSessionMachine() *SessionMachine {
+	return &SessionMachine{}
+}
+
+// Current return current session
+func (m *SessionMachine) Current() int {
+	return int(atomic.LoadInt32(&m.session))
+}
+
+// Transit move to session, run OnSessionChange hooks in caller's goroutine if success
+// return false if the transition is not allowed or already happened
+func (m *SessionMachine) Transit(to int) bool {
+	for {
+		from := m.Current()
+		if !validTransition(from, to) {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&m.session, int32(from), int32(to)) {
+			m.hooksLock.RLock()
+			hooks := m.onChange
+			m.hooksLock.RUnlock()
+			for _, h := range hooks {
+				h(from, to)
+			}
+			return true
+		}
+	}
+}
+
+// Seal move to SessionSealed, then run OnSealed hooks with final result
+func (m *SessionMachine) Seal(final *Final) bool {
+	if !m.Transit(SessionSealed) {
+		return false
+	}
+
+	m.hooksLock.RLock()
+	hooks := m.onSealed
+	m.hooksLock.RUnlock()
+	for _, h := range hooks {
+		h(final)
+	}
+	return true
+}
+
+// OnSessionChange register hook called after each session change
+// hooks should return quickly, they run inside the timer loop
+func (m *SessionMachine) OnSessionChange(h func(from, to int)) {
+	m.hooksLock.Lock()
+	defer m.hooksLock.Unlock()
+
+	m.onChange = append(m.onChange, h)
+}
+
+// OnSealed register hook called after final result judged
+func (m *SessionMachine) OnSealed(h func(final *Final)) {
+	m.hooksLock.Lock()
+	defer m.hooksLock.Unlock()
+
+	m.onSealed = append(m.onSealed, h)
+}
+
+func validTransition(from, to int) bool {
+	switch to {
+	case SessionFirstHalf, SessionSecondHalf, SessionSealed:
+		return to == from+1
+	case SessionFinished:
+		return from < SessionFinished
+	default:
+		return false
+	}
+}
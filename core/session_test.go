@@ -0,0 +1,49 @@
+package auccore
+
+import "testing"
+
+func TestSessionMachine(t *testing.T) {
+	m := NewSessionMachine()
+
+	var changes [][2]int
+	var final *Final
+	m.OnSessionChange(func(from, to int) {
+		changes = append(changes, [2]int{from, to})
+	})
+	m.OnSealed(func(f *Final) {
+		final = f
+	})
+
+	if m.Transit(SessionSecondHalf) {
+		t.Error("skip SessionFirstHalf")
+	}
+	if m.Seal(&Final{}) {
+		t.Error("seal before SessionFinished")
+	}
+	if !m.Transit(SessionFirstHalf) {
+		t.Error("!m.Transit(SessionFirstHalf)")
+	}
+	if m.Transit(SessionFirstHalf) {
+		t.Error("transit to the same session twice")
+	}
+	if !m.Transit(SessionFinished) {
+		t.Error("halt from SessionFirstHalf")
+	}
+	if m.Transit(SessionSecondHalf) {
+		t.Error("go back from SessionFinished")
+	}
+
+	f := &Final{Capacity: 1}
+	if !m.Seal(f) {
+		t.Error("!m.Seal(f)")
+	}
+	if m.Current() != SessionSealed {
+		t.Error("m.Current() != SessionSealed")
+	}
+	if final != f {
+		t.Error("OnSealed hook not called")
+	}
+	if len(changes) != 3 || changes[2] != [2]int{SessionFinished, SessionSealed} {
+		t.Errorf("unexpected changes %v", changes)
+	}
+}
@@ -1,12 +1,18 @@
 package auccore
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// Bid is the record of a bid owned by Store, Store changes Active and Withdrawn
 type Bid struct {
 	Serial   int
 	Client   int
@@ -14,6 +20,21 @@ type Bid struct {
 	Time     time.Time
 	Sequence int
 	Active   bool
+	Nonce    string // reveal nonce of sealed-bid first half, not persisted
+
+	RequestID string // optional client supplied identifier for idempotent retry
+	SourceIP  string // optional address of bidder, for audit
+	Withdrawn bool
+
+	WithdrawTime time.Time // decided by warehouse on Withdraw unless already set, not in Store
+}
+
+// Commitment is a sealed bid of first half, only hash of price is visible until reveal
+type Commitment struct {
+	Client   int
+	Hash     string
+	Time     time.Time
+	Revealed bool
 }
 
 type Block struct {
@@ -39,6 +60,11 @@ type Store struct {
 	Capacity    int
 	TailBid     *Bid   // last one successful bid
 	FinalBids   []*Bid // all successful bids
+
+	// ReservePrice allow Judge to allocate fewer than Capacity, 0 for disable
+	ReservePrice int
+
+	Commitments map[int]*Commitment // sealed bids of first half by bidder identifier
 }
 
 // NewStore return new *Store instance
@@ -48,6 +74,7 @@ func NewStore(capacity int) *Store {
 		BidderChain: NewChain(),
 		PriceChain:  NewChain(),
 		Capacity:    capacity,
+		Commitments: make(map[int]*Commitment),
 	}
 }
 
@@ -82,7 +109,42 @@ func (s *Store) GetPriceBlock(key int) *Block {
 	return s.PriceChain.GetBlock(key)
 }
 
+// AddCommitment save bidder's *Commitment, return false if bidder already committed
+func (s *Store) AddCommitment(c *Commitment) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, got := s.Commitments[c.Client]; got {
+		return false
+	}
+	s.Commitments[c.Client] = c
+	return true
+}
+
+// GetCommitment return the *Commitment of specific bidder
+func (s *Store) GetCommitment(key int) *Commitment {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.Commitments[key]
+}
+
+// CountUnrevealed return the count of commitments never revealed
+func (s *Store) CountUnrevealed() int {
+	s.RLock()
+	defer s.RUnlock()
+
+	c := 0
+	for _, cm := range s.Commitments {
+		if !cm.Revealed {
+			c++
+		}
+	}
+	return c
+}
+
 // Add add *Bid to PriceChain and BidderChain, also handle bidder's previous bids carefully
+// Store owns bid afterwards, caller must not modify it
 func (s *Store) Add(bid *Bid) {
 	s.Lock()
 	defer s.Unlock()
@@ -90,18 +152,86 @@ func (s *Store) Add(bid *Bid) {
 	s.BidderChain.Insert(bid.Client, bid, false)
 	s.PriceChain.Insert(bid.Price, bid, true)
 
+	// mark sealed bid revealed
+	if c := s.Commitments[bid.Client]; c != nil {
+		c.Revealed = true
+	}
+
 	// decrease Block.Valid
+	// previous active bid may not be the last one if it was withdrawn
 	b := s.BidderChain.GetBlock(bid.Client)
 	if b.Total > 1 {
-		preBid := b.Bids[b.Total-2]
-		s.PriceChain.DecrActiveCount(preBid.Price)
-		preBid.Active = false
+		for _, preBid := range b.Bids[:len(b.Bids)-1] {
+			if preBid.Active {
+				s.PriceChain.DecrActiveCount(preBid.Price)
+				preBid.Active = false
+			}
+		}
 		b.Valid = 1
 	}
 
 	s.updateState()
 }
 
+// Withdraw withdraw bidder's bid of specific sequence and reactivate the previous one
+// return the withdrawn *Bid, or nil if not found or already withdrawn
+func (s *Store) Withdraw(client, sequence int) *Bid {
+	s.Lock()
+	defer s.Unlock()
+
+	b := s.BidderChain.GetBlock(client)
+	if b == nil {
+		return nil
+	}
+
+	idx := -1
+	for i, bid := range b.Bids {
+		if bid.Sequence == sequence && !bid.Withdrawn {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return nil
+	}
+
+	bid := b.Bids[idx]
+	bid.Withdrawn = true
+	if !bid.Active {
+		// already replaced by a later bid
+		return bid
+	}
+
+	bid.Active = false
+	s.PriceChain.DecrActiveCount(bid.Price)
+	b.Valid = 0
+	for i := idx - 1; i >= 0; i-- {
+		if preBid := b.Bids[i]; !preBid.Withdrawn {
+			preBid.Active = true
+			s.PriceChain.IncrActiveCount(preBid.Price)
+			b.Valid = 1
+			break
+		}
+	}
+
+	s.updateState()
+	return bid
+}
+
+// Replace replace bids and commitments of store by those of c, c should not be used afterwards
+func (s *Store) Replace(c *Store) {
+	s.Lock()
+	defer s.Unlock()
+
+	// replace in place, chains are read without store lock
+	s.BidderChain.replace(c.BidderChain)
+	s.PriceChain.replace(c.PriceChain)
+	s.TailBid = c.TailBid
+	s.FinalBids = c.FinalBids
+	s.ReservePrice = c.ReservePrice
+	s.Commitments = c.Commitments
+}
+
 // SortAllBlocks sort all blocks' Block.Bids in time ASC order
 // usually called after end
 func (s *Store) SortAllBlocks() {
@@ -119,6 +249,118 @@ func (s *Store) SortAllBlocks() {
 	//}
 }
 
+// SortBlocks sort specific blocks' Block.Bids in time ASC order
+func (s *Store) SortBlocks(keys []int) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, key := range keys {
+		s.PriceChain.SortBlock(key)
+	}
+
+	s.updateState()
+}
+
+// Bids return copies of bidder's bids in insertion order, nil if bidder not found
+func (s *Store) Bids(client int) []Bid {
+	s.RLock()
+	defer s.RUnlock()
+
+	b := s.BidderChain.GetBlock(client)
+	if b == nil {
+		return nil
+	}
+	bids := make([]Bid, len(b.Bids))
+	for i, bid := range b.Bids {
+		bids[i] = *bid
+	}
+	return bids
+}
+
+// Tail return a copy of TailBid, false if not decided
+func (s *Store) Tail() (Bid, bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.TailBid == nil {
+		return Bid{}, false
+	}
+	return *s.TailBid, true
+}
+
+// Histogram return count of active bids by price
+func (s *Store) Histogram() map[int]int {
+	s.RLock()
+	defer s.RUnlock()
+
+	h := make(map[int]int)
+	for _, key := range s.PriceChain.Index {
+		if b := s.PriceChain.Blocks[key]; b.Valid > 0 {
+			h[key] = int(b.Valid)
+		}
+	}
+	return h
+}
+
+// ActiveBids return copies of active bids of price in time ASC order
+func (s *Store) ActiveBids(price int) []Bid {
+	s.RLock()
+	defer s.RUnlock()
+
+	b := s.PriceChain.GetBlock(price)
+	if b == nil {
+		return nil
+	}
+	bids := make([]Bid, 0, b.Valid)
+	for _, bid := range b.Bids {
+		if bid.Active {
+			bids = append(bids, *bid)
+		}
+	}
+	sort.SliceStable(bids, func(i, j int) bool { return bids[i].Time.Before(bids[j].Time) })
+	return bids
+}
+
+// Rank return the position of bidder's active bid in PriceChain, 1 for the highest,
+// and the active bid, return 0 and nil if bidder not found
+func (s *Store) Rank(client int) (int, *Bid) {
+	s.RLock()
+	defer s.RUnlock()
+
+	b := s.BidderChain.GetBlock(client)
+	if b == nil {
+		return 0, nil
+	}
+	var active *Bid
+	for _, bid := range b.Bids {
+		if bid.Active {
+			active = bid
+		}
+	}
+	if active == nil {
+		return 0, nil
+	}
+
+	rank := 0
+	for _, key := range s.PriceChain.Index {
+		pb := s.PriceChain.Blocks[key]
+		if key > active.Price {
+			rank += int(pb.Valid)
+			continue
+		}
+		for _, bid := range pb.Bids {
+			if !bid.Active {
+				continue
+			}
+			rank++
+			if bid == active {
+				return rank, active
+			}
+		}
+	}
+	return 0, nil
+}
+
 // updateState update the lowest bid
 // may inaccurate due to bids in block is NOT in order
 // it is different between the time in warehouse and inserting to store
@@ -167,7 +409,7 @@ func (s *Store) Equal(c *Store) bool {
 		for i, bid := range b.Bids {
 			bidC := bc.Bids[i]
 			if bid.Client != bidC.Client || bid.Price != bidC.Price ||
-				bid.Sequence != bidC.Sequence || bid.Active != bidC.Active ||
+				bid.Sequence != bidC.Sequence || bid.Active != bidC.Active || bid.RequestID != bidC.RequestID ||
 				!bid.Time.Truncate(time.Microsecond).Equal(bidC.Time.Truncate(time.Microsecond)) {
 				return false
 			}
@@ -176,32 +418,193 @@ func (s *Store) Equal(c *Store) bool {
 	return true
 }
 
+// BidDiff is a bid differs between two stores, Bid or Other is nil if missing
+type BidDiff struct {
+	Client   int
+	Sequence int
+	Fields   []string // mismatched fields
+	Bid      *Bid
+	Other    *Bid
+}
+
+// StoreDiff is the difference between two stores
+type StoreDiff struct {
+	Missing []int // bidders in store but not in other
+	Extra   []int // bidders in other but not in store
+	Bids    []BidDiff
+
+	Commitments []int // bidders whose commitment is missing in either store or differs
+
+	TailDiff     bool // TailBid differs
+	TailBid      *Bid
+	OtherTailBid *Bid
+}
+
+// Empty return true if two stores are equal
+func (d *StoreDiff) Empty() bool {
+	return len(d.Missing) == 0 && len(d.Extra) == 0 && len(d.Bids) == 0 && len(d.Commitments) == 0 && !d.TailDiff
+}
+
+// String format the report
+func (d *StoreDiff) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "missing %d, extra %d, bids %d, tail %v", len(d.Missing), len(d.Extra), len(d.Bids), d.TailDiff)
+	if len(d.Missing) > 0 {
+		fmt.Fprintf(&b, "\nmissing bidders %v", d.Missing)
+	}
+	if len(d.Extra) > 0 {
+		fmt.Fprintf(&b, "\nextra bidders %v", d.Extra)
+	}
+	if len(d.Commitments) > 0 {
+		fmt.Fprintf(&b, "\ncommitments %v", d.Commitments)
+	}
+	for _, bd := range d.Bids {
+		fmt.Fprintf(&b, "\n%d (%d) %s: %s / %s", bd.Client, bd.Sequence, strings.Join(bd.Fields, ","), formatDiffBid(bd.Bid), formatDiffBid(bd.Other))
+	}
+	if d.TailDiff {
+		fmt.Fprintf(&b, "\ntail %s / %s", formatDiffBid(d.TailBid), formatDiffBid(d.OtherTailBid))
+	}
+	return b.String()
+}
+
+func formatDiffBid(bid *Bid) string {
+	if bid == nil {
+		return "missing"
+	}
+	return fmt.Sprintf("%d @ %s active %v", bid.Price, bid.Time.Format("15:04:05.000000"), bid.Active)
+}
+
+// diffBid return mismatched fields of two bids of the same bidder and sequence
+func diffBid(a, b *Bid) []string {
+	var fields []string
+	if a.Price != b.Price {
+		fields = append(fields, "Price")
+	}
+	if !a.Time.Truncate(time.Microsecond).Equal(b.Time.Truncate(time.Microsecond)) {
+		fields = append(fields, "Time")
+	}
+	if a.Active != b.Active {
+		fields = append(fields, "Active")
+	}
+	if a.Withdrawn != b.Withdrawn {
+		fields = append(fields, "Withdrawn")
+	}
+	if a.RequestID != b.RequestID {
+		fields = append(fields, "RequestID")
+	}
+	return fields
+}
+
+// Diff compare two stores in both directions
+func (s *Store) Diff(c *Store) *StoreDiff {
+	s.RLock()
+	defer s.RUnlock()
+	if c != s {
+		c.RLock()
+		defer c.RUnlock()
+	}
+
+	d := &StoreDiff{}
+	for _, key := range s.BidderChain.Index {
+		b := s.BidderChain.Blocks[key]
+		bc, ok := c.BidderChain.Blocks[key]
+		if !ok {
+			d.Missing = append(d.Missing, key)
+			continue
+		}
+
+		others := make(map[int]*Bid, len(bc.Bids))
+		for _, bid := range bc.Bids {
+			others[bid.Sequence] = bid
+		}
+		for _, bid := range b.Bids {
+			other, ok := others[bid.Sequence]
+			if !ok {
+				d.Bids = append(d.Bids, BidDiff{Client: key, Sequence: bid.Sequence, Bid: bid})
+				continue
+			}
+			delete(others, bid.Sequence)
+			if fields := diffBid(bid, other); len(fields) > 0 {
+				d.Bids = append(d.Bids, BidDiff{Client: key, Sequence: bid.Sequence, Fields: fields, Bid: bid, Other: other})
+			}
+		}
+		for _, other := range bc.Bids {
+			if _, ok := others[other.Sequence]; ok {
+				d.Bids = append(d.Bids, BidDiff{Client: key, Sequence: other.Sequence, Other: other})
+			}
+		}
+	}
+	for _, key := range c.BidderChain.Index {
+		if _, ok := s.BidderChain.Blocks[key]; !ok {
+			d.Extra = append(d.Extra, key)
+		}
+	}
+
+	for key, cm := range s.Commitments {
+		other, ok := c.Commitments[key]
+		if !ok || other.Hash != cm.Hash || !other.Time.Truncate(time.Microsecond).Equal(cm.Time.Truncate(time.Microsecond)) {
+			d.Commitments = append(d.Commitments, key)
+		}
+	}
+	for key := range c.Commitments {
+		if _, ok := s.Commitments[key]; !ok {
+			d.Commitments = append(d.Commitments, key)
+		}
+	}
+
+	if (s.TailBid == nil) != (c.TailBid == nil) ||
+		(s.TailBid != nil && (s.TailBid.Client != c.TailBid.Client || s.TailBid.Sequence != c.TailBid.Sequence)) {
+		d.TailDiff = true
+		d.TailBid = s.TailBid
+		d.OtherTailBid = c.TailBid
+	}
+
+	sort.Ints(d.Missing)
+	sort.Ints(d.Extra)
+	sort.Ints(d.Commitments)
+	sort.Slice(d.Bids, func(i, j int) bool {
+		if d.Bids[i].Client != d.Bids[j].Client {
+			return d.Bids[i].Client < d.Bids[j].Client
+		}
+		return d.Bids[i].Sequence < d.Bids[j].Sequence
+	})
+	return d
+}
+
 // Judge final result
 func (s *Store) Judge() (seq int, avg float64) {
 	if s.Capacity <= 0 {
 		return 0, 0
 	}
-	if s.TailBid == nil {
-		return 0, 0
-	}
 
 	s.Lock()
 	defer s.Unlock()
 
 	success := 0
 	totalPrice := 0
-	s.FinalBids = make([]*Bid, s.Capacity)
+	s.FinalBids = make([]*Bid, 0, s.Capacity)
 	for _, key := range s.PriceChain.Index {
 		b := s.PriceChain.Blocks[key]
 		for _, bid := range b.Bids {
 			if success < s.Capacity && bid.Active {
-				s.FinalBids[success] = bid
+				s.FinalBids = append(s.FinalBids, bid)
 				success++
 				totalPrice += bid.Price
 			}
 		}
 	}
 
+	// insufficient demand, eg, not enough bids at reserve price
+	// fewer than capacity allocated, the last successful bid is TailBid
+	// without reserve price no one succeeds, as before
+	if s.TailBid == nil {
+		if success == 0 || s.ReservePrice <= 0 {
+			s.FinalBids = nil
+			return 0, 0
+		}
+		s.TailBid = s.FinalBids[success-1]
+	}
+
 	minPriceSuccess := 0
 	minPriceLastSecondAll := 0
 	minPriceLastSecondSuccess := 0
@@ -226,6 +629,18 @@ func (s *Store) Judge() (seq int, avg float64) {
 	return minPriceLastSecondSuccess, float64(totalPrice) / float64(success)
 }
 
+// CommitmentHash return hex encoded sha256 of "client:price:nonce"
+// bidders submit it in first half and reveal price with the nonce later
+func CommitmentHash(client, price int, nonce string) string {
+	h := sha256.Sum256([]byte(strconv.Itoa(client) + ":" + strconv.Itoa(price) + ":" + nonce))
+	return hex.EncodeToString(h[:])
+}
+
+// Match check the revealed *Bid matches the commitment
+func (c *Commitment) Match(bid *Bid) bool {
+	return c.Client == bid.Client && c.Hash == CommitmentHash(bid.Client, bid.Price, bid.Nonce)
+}
+
 // Insert insert *Bid to specific *Block
 // if sortIndex apply, eg, insert the bid to a Chain of PriceChain, also sort the Block.Index
 func (c *Chain) Insert(key int, bid *Bid, sortIndex bool) {
@@ -299,6 +714,27 @@ func (c *Chain) decrActiveCount(key int) {
 	atomic.AddUint64(&c.Blocks[key].Valid, ^uint64(0))
 }
 
+// IncrActiveCount increase the Block.Valid
+func (c *Chain) IncrActiveCount(key int) {
+	c.RLock()
+	defer c.RUnlock()
+
+	c.incrActiveCount(key)
+}
+
+func (c *Chain) incrActiveCount(key int) {
+	atomic.AddUint64(&c.Blocks[key].Valid, 1)
+}
+
+// replace take index and blocks of o
+func (c *Chain) replace(o *Chain) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.Index = o.Index
+	c.Blocks = o.Blocks
+}
+
 // Length return length of blocks
 func (c *Chain) Length() int {
 	c.RLock()
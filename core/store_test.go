@@ -205,3 +205,217 @@ func testConcurrencyAdd(t *testing.T, clientEnd int) {
 		t.Error("store.CountBids() != clientEnd")
 	}
 }
+
+func TestCommitment(t *testing.T) {
+	store := NewStore(3)
+
+	c := &Commitment{Client: 1, Hash: CommitmentHash(1, 100, "nonce")}
+	if !store.AddCommitment(c) {
+		t.Error("!store.AddCommitment(c)")
+	}
+	if store.AddCommitment(&Commitment{Client: 1, Hash: CommitmentHash(1, 200, "nonce")}) {
+		t.Error("store.AddCommitment() accept duplicate commitment")
+	}
+
+	bid := newBid(1, 200, 1)
+	bid.Nonce = "nonce"
+	if c.Match(bid) {
+		t.Error("c.Match() accept wrong price")
+	}
+	bid.Price = 100
+	bid.Nonce = "other"
+	if c.Match(bid) {
+		t.Error("c.Match() accept wrong nonce")
+	}
+	bid.Nonce = "nonce"
+	if !c.Match(bid) {
+		t.Error("!c.Match(bid)")
+	}
+
+	if store.CountUnrevealed() != 1 {
+		t.Error("store.CountUnrevealed() != 1")
+	}
+	store.Add(bid)
+	if store.CountUnrevealed() != 0 {
+		t.Error("store.CountUnrevealed() != 0")
+	}
+}
+
+func TestWithdraw(t *testing.T) {
+	store := NewStore(2)
+	store.Add(newBid(1, 10, 1))
+	store.Add(newBid(2, 10, 1))
+	store.Add(newBid(3, 10, 1))
+	if store.TailBid.Client != 2 {
+		t.Error("store.TailBid.Client != 2")
+	}
+
+	bid := newBid(3, 12, 2)
+	store.Add(bid)
+	if store.TailBid.Client != 1 {
+		t.Error("store.TailBid.Client != 1")
+	}
+
+	if store.Withdraw(3, 2) != bid {
+		t.Error("store.Withdraw(3, 2) != bid")
+	}
+	if bid.Active || !bid.Withdrawn {
+		t.Error("withdrawn bid still active")
+	}
+	if !store.GetBidderBlock(3).Bids[0].Active {
+		t.Error("previous bid not reactivated")
+	}
+	if store.GetPriceBlock(12).Valid != 0 || store.GetPriceBlock(10).Valid != 3 {
+		t.Error("PriceChain valid count not updated")
+	}
+	if store.TailBid.Client != 2 {
+		t.Error("store.TailBid.Client != 2")
+	}
+	if store.Withdraw(3, 2) != nil {
+		t.Error("store.Withdraw() withdraw twice")
+	}
+
+	// new bid after withdrawal replaces the reactivated bid
+	store.Add(newBid(3, 11, 3))
+	if store.GetBidderBlock(3).Bids[0].Active {
+		t.Error("reactivated bid still active")
+	}
+	if store.GetPriceBlock(10).Valid != 2 || store.GetPriceBlock(11).Valid != 1 {
+		t.Error("PriceChain valid count not updated")
+	}
+	if store.TailBid.Client != 1 {
+		t.Error("store.TailBid.Client != 1")
+	}
+}
+
+func TestJudgeInsufficientDemand(t *testing.T) {
+	store := NewStore(5)
+	store.ReservePrice = 10
+	store.Add(newBid(1, 12, 1))
+	store.Add(newBid(2, 10, 1))
+	store.Add(newBid(3, 11, 1))
+	if store.TailBid != nil {
+		t.Error("store.TailBid != nil")
+	}
+
+	_, avg := store.Judge()
+	if len(store.FinalBids) != 3 {
+		t.Error("len(store.FinalBids) != 3")
+	}
+	if store.TailBid == nil || store.TailBid.Client != 2 {
+		t.Error("store.TailBid.Client != 2")
+	}
+	if avg != 11 {
+		t.Error("avg != 11")
+	}
+}
+
+func TestJudgeUndersubscribedNoReserve(t *testing.T) {
+	store := NewStore(5)
+	store.Add(newBid(1, 12, 1))
+	store.Add(newBid(2, 10, 1))
+
+	seq, avg := store.Judge()
+	if seq != 0 || avg != 0 {
+		t.Errorf("unexpected judge %d %f", seq, avg)
+	}
+	if store.TailBid != nil {
+		t.Error("store.TailBid != nil")
+	}
+	if len(store.FinalBids) != 0 {
+		t.Error("len(store.FinalBids) != 0")
+	}
+}
+
+func TestStoreDiff(t *testing.T) {
+	now := time.Now()
+	s, c := NewStore(2), NewStore(2)
+	for _, bid := range []*Bid{newBid(1, 100, 1), newBid(2, 200, 1), newBid(3, 300, 1)} {
+		bid.Time = now
+		s.Add(bid)
+		if bid.Client != 3 {
+			bidCopy := *bid
+			c.Add(&bidCopy)
+		}
+	}
+	if d := s.Diff(s); !d.Empty() {
+		t.Errorf("store differs from itself %s", d)
+	}
+
+	extra := newBid(4, 400, 1)
+	extra.Time = now
+	c.Add(extra)
+	changed := *c.GetBidderBlock(2).Bids[0]
+	changed.Price = 201
+	second := newBid(2, 210, 2)
+	second.Time = now
+	c.GetBidderBlock(2).Bids = []*Bid{&changed, second}
+	c.TailBid = extra
+
+	d := s.Diff(c)
+	if len(d.Missing) != 1 || d.Missing[0] != 3 {
+		t.Errorf("unexpected missing %v", d.Missing)
+	}
+	if len(d.Extra) != 1 || d.Extra[0] != 4 {
+		t.Errorf("unexpected extra %v", d.Extra)
+	}
+	if len(d.Bids) != 2 {
+		t.Fatalf("unexpected bids %s", d)
+	}
+	if d.Bids[0].Sequence != 1 || len(d.Bids[0].Fields) != 1 || d.Bids[0].Fields[0] != "Price" {
+		t.Errorf("unexpected bid diff %s", d)
+	}
+	if d.Bids[1].Sequence != 2 || d.Bids[1].Bid != nil || d.Bids[1].Other != second {
+		t.Errorf("unexpected bid diff %s", d)
+	}
+	if !d.TailDiff || d.TailBid.Client != 2 || d.OtherTailBid.Client != 4 {
+		t.Errorf("unexpected tail diff %s", d)
+	}
+	if r := s.Diff(c).Extra; len(c.Diff(s).Missing) != len(r) {
+		t.Error("diff is not symmetric")
+	}
+
+	s.AddCommitment(&Commitment{Client: 1, Hash: "a", Time: now})
+	s.AddCommitment(&Commitment{Client: 2, Hash: "b", Time: now})
+	c.AddCommitment(&Commitment{Client: 2, Hash: "c", Time: now})
+	c.AddCommitment(&Commitment{Client: 5, Hash: "d", Time: now})
+	if d := s.Diff(c); len(d.Commitments) != 3 || d.Commitments[0] != 1 || d.Commitments[2] != 5 {
+		t.Errorf("unexpected commitments diff %v", d.Commitments)
+	}
+}
+
+func TestStatusChanges(t *testing.T) {
+	now := time.Now()
+	before, after := NewStore(2), NewStore(2)
+	for _, bid := range []*Bid{newBid(1, 100, 1), newBid(2, 200, 1), newBid(3, 300, 1)} {
+		bid.Time = now
+		before.Add(bid)
+	}
+	// price of client 2 differs in warehouse, client 3 missing, client 4 extra
+	for _, bid := range []*Bid{newBid(1, 100, 1), newBid(2, 90, 1), newBid(4, 150, 1)} {
+		bid.Time = now
+		after.Add(bid)
+	}
+	before.Judge()
+	after.Judge()
+
+	if changes := statusChanges(before, before); len(changes) != 0 {
+		t.Errorf("unexpected changes %s", formatBidChanges(changes))
+	}
+
+	changes := statusChanges(before, after)
+	expected := []BidChange{
+		{Client: 1, Sequence: 1, Price: 100, Before: BidStatusLost, After: BidStatusWon},
+		{Client: 2, Sequence: 1, Price: 90, Before: BidStatusWon, After: BidStatusLost},
+		{Client: 3, Sequence: 1, Price: 300, Before: BidStatusWon, After: BidStatusMissing},
+		{Client: 4, Sequence: 1, Price: 150, Before: BidStatusMissing, After: BidStatusWon},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("unexpected changes %s", formatBidChanges(changes))
+	}
+	for i, c := range changes {
+		if c != expected[i] {
+			t.Errorf("change %s, expected %s", c, expected[i])
+		}
+	}
+}
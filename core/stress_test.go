@@ -0,0 +1,150 @@
+package auccore
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// run with -race, every goroutine shares the exchange like real traffic
+func TestStressExchange(t *testing.T) {
+	now := time.Now()
+	conf := Config{
+		StartTime:          now,
+		HalfTime:           now.Add(time.Millisecond * 600),
+		EndTime:            now.Add(time.Millisecond * 1500),
+		Capacity:           50,
+		WithdrawWindow:     time.Millisecond * 200,
+		SoftCloseWindow:    time.Millisecond * 200,
+		SoftCloseExtension: time.Millisecond * 100,
+		SoftCloseCap:       time.Millisecond * 300,
+	}
+	t.Setenv("DB_DRIVER", "")
+	e, err := NewExchange(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := NewMemorySink()
+	e.SetEventSink(sink)
+	go e.Serve()
+	for i := 0; i < 100 && e.Session() == SessionUnprepared; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	r := NewReplica(conf, NewMemorySource(sink), nil)
+	r.Interval = time.Millisecond * 20
+	go r.Serve()
+	defer r.Close()
+
+	var wg sync.WaitGroup
+	quit := make(chan struct{})
+
+	// bidders
+	for client := 1; client <= 300; client++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(client)))
+
+			e.Bid(BidRequest{Client: client, Price: 100 + rnd.Intn(20)})
+			time.Sleep(time.Until(e.Config().HalfTime))
+			for e.Session() == SessionSecondHalf {
+				price := e.State().LowestPrice + rnd.Intn(5)
+				result, err := e.Bid(BidRequest{Client: client, Price: price})
+				if err == nil && rnd.Intn(4) == 0 {
+					e.Withdraw(client, result.Serial)
+				}
+				time.Sleep(time.Millisecond * time.Duration(rnd.Intn(50)))
+			}
+		}(client)
+	}
+
+	// readers and operator
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-quit:
+					return
+				default:
+				}
+				client := 1 + rand.Intn(300)
+				e.Enquiry(client)
+				e.State()
+				e.Config()
+				e.Final()
+				e.SuccessfulBids()
+				r.Enquiry(client)
+				r.Rank(client)
+				r.State()
+				if i == 0 {
+					e.Pause("stress")
+					e.Resume("stress")
+					e.ScheduleChanges()
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}(i)
+	}
+
+	for e.Session() < SessionFinished {
+		time.Sleep(time.Millisecond * 10)
+	}
+	final := e.Seal()
+	close(quit)
+	wg.Wait()
+	e.Close()
+
+	if final == nil || final.Allocated != conf.Capacity {
+		t.Fatalf("unexpected final %+v", final)
+	}
+	if d := e.SealDiff(); d == nil || len(d.Missing)+len(d.Extra)+len(d.Bids) > 0 {
+		t.Errorf("store differs from warehouse %s", d)
+	}
+	results := e.SuccessfulBids()
+	if len(results) != conf.Capacity {
+		t.Errorf("len(e.SuccessfulBids()) %d", len(results))
+	}
+	for _, res := range results {
+		if res.Price < final.LowestPrice {
+			t.Errorf("successful bid %+v lower than lowest price %d", res, final.LowestPrice)
+		}
+	}
+}
+
+func TestStressStore(t *testing.T) {
+	store := NewStore(100)
+
+	var wg sync.WaitGroup
+	for client := 1; client <= 200; client++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			for seq := 1; seq <= BidsPerBidder; seq++ {
+				store.Add(&Bid{Client: client, Price: 100 + (client+seq)%10, Time: time.Now(), Sequence: seq, Active: true})
+				store.Bids(client)
+				store.Tail()
+				store.Rank(client)
+				store.Histogram()
+				store.ActiveBids(100 + client%10)
+				if seq == BidsPerBidder {
+					store.Withdraw(client, seq)
+				}
+			}
+		}(client)
+	}
+	wg.Wait()
+
+	if store.CountBidders() != 200 || store.CountBids() != 200*BidsPerBidder {
+		t.Error("bids lost")
+	}
+	active := 0
+	for _, cnt := range store.Histogram() {
+		active += cnt
+	}
+	if active != 200 {
+		t.Errorf("active bids %d", active)
+	}
+}
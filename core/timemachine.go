@@ -49,6 +49,7 @@ func DumpAll(log *log.Logger, st *Store) {
 	}
 
 	log.Println("=============================")
+	log.Printf("ALLOCATED %d / %d\n", success, st.Capacity)
 	log.Printf("AVG PRICE %.2f\n", float64(totalPrice)/float64(success))
 	log.Printf("MIN PRICE %d\n", st.TailBid.Price)
 	log.Printf("TAIL BID %d @ %s No. %d\n", st.TailBid.Price, st.TailBid.Time.Format("15:04:05"), minPriceLastSecondSuccess)
@@ -0,0 +1,220 @@
+package auccore
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TimeSource decide Bid.Time before saving to warehouse
+type TimeSource interface {
+	// Now return current time in microsecond, zero for letting warehouse decide
+	Now() time.Time
+}
+
+// DatabaseClock let warehouse decide Bid.Time, eg, now() of SQL database, default of Exchange.
+// Time is not guaranteed increasing across connections
+type DatabaseClock struct{}
+
+func (DatabaseClock) Now() time.Time {
+	return time.Time{}
+}
+
+// monotonic make time strictly increasing in microsecond
+type monotonic struct {
+	lock sync.Mutex
+	last time.Time
+}
+
+// next return t truncated to microsecond, or 1µs after the last one if t is not after it
+func (m *monotonic) next(t time.Time) time.Time {
+	t = t.Truncate(time.Microsecond)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !t.After(m.last) {
+		t = m.last.Add(time.Microsecond)
+	}
+	m.last = t
+	return t
+}
+
+// observe make later time after t
+func (m *monotonic) observe(t time.Time) {
+	t = t.Truncate(time.Microsecond)
+
+	m.lock.Lock()
+	if t.After(m.last) {
+		m.last = t
+	}
+	m.lock.Unlock()
+}
+
+// LocalClock is local wall clock advanced by monotonic clock,
+// never jumps with wall clock adjustment, strictly increasing in microsecond
+type LocalClock struct {
+	base time.Time // with monotonic reading
+	monotonic
+}
+
+func NewLocalClock() *LocalClock {
+	return &LocalClock{base: time.Now()}
+}
+
+func (c *LocalClock) wall() time.Time {
+	return c.base.Add(time.Since(c.base)).Round(0)
+}
+
+func (c *LocalClock) Now() time.Time {
+	return c.next(c.wall())
+}
+
+// NTPClock is LocalClock corrected by offset queried from NTP server every Interval,
+// strictly increasing in microsecond, it stalls rather than goes back when offset decreases
+type NTPClock struct {
+	Server   string
+	Interval time.Duration
+
+	// Query return offset of server clock to local clock, nil for SNTP
+	Query func(server string) (time.Duration, error)
+
+	local  *LocalClock
+	offset int64 // atomic, nanoseconds
+	quit   chan struct{}
+	once   sync.Once
+	monotonic
+}
+
+// NewNTPClock create clock synced from server, eg, pool.ntp.org:123, call Start to sync periodically
+func NewNTPClock(server string, interval time.Duration) *NTPClock {
+	if !strings.Contains(server, ":") {
+		server += ":123"
+	}
+	return &NTPClock{Server: server, Interval: interval, local: NewLocalClock(), quit: make(chan struct{})}
+}
+
+// Sync query offset from server once
+func (c *NTPClock) Sync() error {
+	query := c.Query
+	if query == nil {
+		query = sntpOffset
+	}
+	offset, err := query(c.Server)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&c.offset, int64(offset))
+	return nil
+}
+
+// Offset return offset applied to local clock
+func (c *NTPClock) Offset() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.offset))
+}
+
+// Start sync now and every Interval until Stop, errors of later syncs keep previous offset
+func (c *NTPClock) Start() error {
+	err := c.Sync()
+	go func() {
+		ticker := time.NewTicker(c.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.Sync()
+			case <-c.quit:
+				return
+			}
+		}
+	}()
+	return err
+}
+
+func (c *NTPClock) Stop() {
+	c.once.Do(func() { close(c.quit) })
+}
+
+func (c *NTPClock) Now() time.Time {
+	return c.next(c.local.wall().Add(c.Offset()))
+}
+
+// ntpEpoch is seconds from 1900 to 1970
+const ntpEpoch = 2208988800
+
+// sntpOffset query server by SNTP, return server clock minus local clock
+func sntpOffset(server string) (time.Duration, error) {
+	conn, err := net.DialTimeout("udp", server, time.Second*2)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 2))
+
+	req := make([]byte, 48)
+	req[0] = 0x1B // LI 0, version 3, mode client
+	t1 := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	res := make([]byte, 48)
+	if _, err := conn.Read(res); err != nil {
+		return 0, err
+	}
+	t4 := time.Now()
+
+	t2 := ntpTime(res[32:40]) // server receive
+	t3 := ntpTime(res[40:48]) // server transmit
+	return (t2.Sub(t1) + t3.Sub(t4)) / 2, nil
+}
+
+func ntpTime(b []byte) time.Time {
+	sec := int64(binary.BigEndian.Uint32(b[:4])) - ntpEpoch
+	frac := int64(binary.BigEndian.Uint32(b[4:]))
+	return time.Unix(sec, frac*1e9>>32)
+}
+
+// HybridClock is a hybrid logical clock over Physical,
+// it never goes behind observed time of other nodes, eg, bids replicated from leader,
+// the logical counter is folded into microseconds
+type HybridClock struct {
+	Physical TimeSource
+	monotonic
+}
+
+func NewHybridClock(physical TimeSource) *HybridClock {
+	return &HybridClock{Physical: physical}
+}
+
+func (c *HybridClock) Now() time.Time {
+	return c.next(c.Physical.Now())
+}
+
+// Observe merge time of other node
+func (c *HybridClock) Observe(t time.Time) {
+	c.observe(t)
+}
+
+// ParseTimeSource parse time source from spec, eg,
+// "database", "local", "ntp:pool.ntp.org", "hlc", NTP clock is started
+func ParseTimeSource(spec string) (TimeSource, error) {
+	name, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, arg = spec[:i], spec[i+1:]
+	}
+
+	if name == "" || name == "database" {
+		return DatabaseClock{}, nil
+	} else if name == "local" {
+		return NewLocalClock(), nil
+	} else if name == "ntp" && arg != "" {
+		c := NewNTPClock(arg, time.Minute)
+		return c, c.Start()
+	} else if name == "hlc" {
+		return NewHybridClock(NewLocalClock()), nil
+	}
+
+	return nil, Error{Code: CodeRequestInvalid, Message: "Invalid time source " + spec}
+}
@@ -0,0 +1,76 @@
+package auccore
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLocalClock(t *testing.T) {
+	c := NewLocalClock()
+
+	var wg sync.WaitGroup
+	times := make([][]time.Time, 4)
+	for i := range times {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				times[i] = append(times[i], c.Now())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[time.Time]bool)
+	for _, ts := range times {
+		for j, ts1 := range ts {
+			if seen[ts1] || ts1.Nanosecond()%1000 != 0 {
+				t.Fatalf("duplicate or not in microsecond %s", ts1)
+			}
+			seen[ts1] = true
+			if j > 0 && !ts1.After(ts[j-1]) {
+				t.Fatalf("not increasing %s, %s", ts[j-1], ts1)
+			}
+		}
+	}
+}
+
+func TestNTPClock(t *testing.T) {
+	offset := time.Hour
+	c := NewNTPClock("localhost", time.Minute)
+	c.Query = func(server string) (time.Duration, error) { return offset, nil }
+	if err := c.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	ahead := c.Now()
+	if d := ahead.Sub(time.Now()); d < time.Minute*59 || d > time.Minute*61 {
+		t.Errorf("offset not applied %s", d)
+	}
+
+	// never goes back
+	offset = 0
+	c.Sync()
+	if !c.Now().After(ahead) {
+		t.Error("NTPClock goes back")
+	}
+}
+
+func TestHybridClock(t *testing.T) {
+	c := NewHybridClock(NewLocalClock())
+	remote := time.Now().Add(time.Second)
+	c.Observe(remote)
+	if now := c.Now(); !now.After(remote) {
+		t.Errorf("%s not after observed %s", now, remote)
+	}
+
+	if _, err := ParseTimeSource("hlc"); err != nil {
+		t.Error(err)
+	}
+	if ts, _ := ParseTimeSource(""); !ts.Now().IsZero() {
+		t.Error("database clock decided time")
+	}
+	if _, err := ParseTimeSource("sundial"); err == nil {
+		t.Error("invalid time source parsed")
+	}
+}
@@ -3,14 +3,14 @@ package auccore
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
-	"math/rand"
 	"strconv"
 	"sync"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	_ "github.com/lib/pq"
 )
 
@@ -20,46 +20,133 @@ const TableShards = 8 // sharding table, 2^N, N>=0
 type Warehouse interface {
 	Initialize()
 	Terminate()
-	Add(bid *Bid) error              // Add data to log warehouse
-	Commit(bid *Bid) error           // Add data to result warehouse
-	Restore(store *Store, c *Config) // Restore data from log warehouse to Store
+	Add(ctx context.Context, bid *Bid) error                // Add data to log warehouse
+	Commit(ctx context.Context, bid *Bid) error             // Add data to result warehouse
+	Withdraw(ctx context.Context, bid *Bid) error           // Add withdrawal record of bid to log warehouse
+	AddCommitment(ctx context.Context, c *Commitment) error // Add sealed bid of first half to log warehouse
+	Restore(store *Store, c *Config) error                  // Restore data from log warehouse to Store
 }
 
 // MemoryWarehouse store data in memory, for debug and high concurrency test
 // MySQL and Postgres are hardly handle more than 10k TPS
 type MemoryWarehouse struct {
+	Simulation Simulation // latency of the default simulator, must be set before Initialize
+
 	store     *Store
 	simulator *ConcurrencySimulator
+	requests  sync.Map // saved *Bid by unique Bid.RequestID per client
+
+	withdrawalsLock sync.Mutex
+	withdrawals     []Bid // withdrawn bids with withdrawal time
+
+	chaosLock sync.RWMutex
+	chaos     *chaosMonkey
 }
 
 func NewMemoryWarehouse() *MemoryWarehouse {
-	return &MemoryWarehouse{}
+	return &MemoryWarehouse{chaos: newChaosMonkey(Chaos{})}
+}
+
+// SetSimulator replace the default latency simulator built from Simulation, must be called before Initialize
+func (w *MemoryWarehouse) SetSimulator(simulator *ConcurrencySimulator) {
+	w.simulator = simulator
 }
 
 func (w *MemoryWarehouse) Initialize() {
 	w.store = NewStore(0)
-	w.simulator = NewConcurrencySimulator(11000 + rand.Intn(2000))
+	if w.simulator == nil {
+		w.simulator = w.Simulation.Simulator()
+	}
 }
 
 func (w *MemoryWarehouse) Terminate() {
 }
 
-func (w *MemoryWarehouse) Add(bid *Bid) error {
-	w.simulator.Run()
+func (w *MemoryWarehouse) Add(ctx context.Context, bid *Bid) error {
+	if err := w.simulator.RunContext(ctx); err != nil {
+		return contextError(err)
+	}
+	monkey := w.monkey()
+	if err := monkey.before(ctx); err != nil {
+		return err
+	}
 
-	bid.Time = time.Now().Truncate(time.Microsecond)
+	// decided by warehouse clock unless by TimeSource
+	if bid.Time.IsZero() {
+		bid.Time = monkey.now().Truncate(time.Microsecond)
+	}
 
 	bidCopy := *bid
+	if bid.RequestID != "" {
+		if saved, loaded := w.requests.LoadOrStore(strconv.Itoa(bid.Client)+":"+bid.RequestID, &bidCopy); loaded {
+			replayBid(bid, saved.(*Bid))
+			return nil
+		}
+	}
 	w.store.Add(&bidCopy)
 
 	return nil
 }
 
-func (w *MemoryWarehouse) Commit(bid *Bid) error {
+func (w *MemoryWarehouse) Commit(ctx context.Context, bid *Bid) error {
+	return nil
+}
+
+func (w *MemoryWarehouse) Withdraw(ctx context.Context, bid *Bid) error {
+	if err := w.simulator.RunContext(ctx); err != nil {
+		return contextError(err)
+	}
+	monkey := w.monkey()
+	if err := monkey.before(ctx); err != nil {
+		return err
+	}
+
+	if bid.WithdrawTime.IsZero() {
+		bid.WithdrawTime = monkey.now().Truncate(time.Microsecond)
+	}
+
+	w.withdrawalsLock.Lock()
+	w.withdrawals = append(w.withdrawals, Bid{Client: bid.Client, Sequence: bid.Sequence, Time: bid.WithdrawTime})
+	w.withdrawalsLock.Unlock()
+
+	return nil
+}
+
+func (w *MemoryWarehouse) AddCommitment(ctx context.Context, c *Commitment) error {
+	if err := w.simulator.RunContext(ctx); err != nil {
+		return contextError(err)
+	}
+	monkey := w.monkey()
+	if err := monkey.before(ctx); err != nil {
+		return err
+	}
+
+	// decided by warehouse clock unless by TimeSource
+	if c.Time.IsZero() {
+		c.Time = monkey.now().Truncate(time.Microsecond)
+	}
+
+	saved := *c
+	saved.Revealed = false
+	if !w.store.AddCommitment(&saved) && w.store.GetCommitment(c.Client).Hash != c.Hash {
+		return Error{Code: CodeServerSaveError1, Message: "Commitment err"}
+	}
 	return nil
 }
 
-func (w *MemoryWarehouse) Restore(store *Store, c *Config) {
+func (w *MemoryWarehouse) Restore(store *Store, c *Config) error {
+	// bids are still added while replica resyncs
+	w.store.RLock()
+	defer w.store.RUnlock()
+
+	// restore commitments before bids revealing them
+	for _, cm := range w.store.Commitments {
+		if cm.Time.After(c.StartTime) && cm.Time.Before(c.HalfTime) {
+			cmCopy := *cm
+			cmCopy.Revealed = false
+			store.AddCommitment(&cmCopy)
+		}
+	}
 	for _, key := range w.store.BidderChain.Index {
 		b := w.store.BidderChain.Blocks[key]
 		for _, bid := range b.Bids {
@@ -74,6 +161,15 @@ func (w *MemoryWarehouse) Restore(store *Store, c *Config) {
 			}
 		}
 	}
+
+	w.withdrawalsLock.Lock()
+	defer w.withdrawalsLock.Unlock()
+	for _, wd := range w.withdrawals {
+		if wd.Time.After(c.HalfTime) && wd.Time.Before(c.EndTime) {
+			store.Withdraw(wd.Client, wd.Sequence)
+		}
+	}
+	return nil
 }
 
 type PostgresWarehouse struct {
@@ -95,29 +191,15 @@ func NewPostgresWarehouse(table string, db *sql.DB, logger *log.Logger) *Postgre
 func (w *PostgresWarehouse) Initialize() {
 	w.once.Do(func() {
 		w.loc, _ = time.LoadLocation("Asia/Shanghai")
-		for i := 0; i < TableShards; i++ {
-			_, err := w.db.Exec(fmt.Sprintf(`CREATE TABLE %s (
-			id BIGSERIAL PRIMARY KEY,
-    		client INT,
-    		price INT,
-    		sequence SMALLINT,
-    		ts TIMESTAMP(6) DEFAULT now());`, w.table+fmt.Sprintf("%04d", i)))
-
-			if err != nil {
-				w.log.Panicln(err)
-			}
-		}
-
-		_, err := w.db.Exec(fmt.Sprintf(`CREATE TABLE %s (
-			id BIGSERIAL PRIMARY KEY,
-    		client INT,
-    		price INT,
-    		sequence SMALLINT,
-    		ts TIMESTAMP(6) DEFAULT now());`, w.getTableResult()))
-
+		s := newSchema(w.table, "")
+		version, err := migrate(w.db, s, postgresMigrations, `CREATE TABLE IF NOT EXISTS `+s.version+` (
+			version INT PRIMARY KEY,
+			description VARCHAR(255),
+			ts TIMESTAMP(6) DEFAULT now());`, true)
 		if err != nil {
 			w.log.Panicln(err)
 		}
+		w.log.Printf("Warehouse schema version %d", version)
 	})
 }
 
@@ -125,67 +207,132 @@ func (w *PostgresWarehouse) Terminate() {
 	w.db.Close()
 }
 
-func (w *PostgresWarehouse) Add(bid *Bid) error {
-	ctx := context.Background()
+func (w *PostgresWarehouse) Add(ctx context.Context, bid *Bid) error {
 	conn, err := w.db.Conn(ctx)
-	defer conn.Close()
-
 	if err != nil {
+		if ctx.Err() != nil {
+			return contextError(ctx.Err())
+		}
 		w.log.Println("ERR:GetConn")
 		w.log.Println(err)
 		return Error{Code: CodeServerSaveError0, Message: "Add err"}
 	}
+	defer conn.Close()
 
-	var ts string
-	if err := conn.QueryRowContext(ctx, "INSERT INTO "+w.getTableByClient(bid.Client)+" (client, price, sequence) VALUES ($1, $2, $3) RETURNING ts", bid.Client, bid.Price, bid.Sequence).Scan(&ts); err != nil {
+	// Bid.Time decided by TimeSource, or now() in Asia/Shanghai regardless of session time zone
+	var ts time.Time
+	if err := conn.QueryRowContext(ctx, "INSERT INTO "+w.getTableByClient(bid.Client)+" (client, price, sequence, request_id, serial, source_ip, ts) VALUES ($1, $2, $3, $4, $5, $6, COALESCE($7::timestamp, "+w.now()+")) ON CONFLICT (client, request_id) DO NOTHING RETURNING ts", bid.Client, bid.Price, bid.Sequence, nullString(bid.RequestID), bid.Serial, nullString(bid.SourceIP), sqlTime(bid.Time, w.loc)).Scan(&ts); err == sql.ErrNoRows {
+		// saved by previous attempt
+		return w.replay(ctx, conn, bid)
+	} else if err != nil && ctx.Err() != nil {
+		return contextError(ctx.Err())
+	} else if err != nil {
 		w.log.Println("ERR:GetRow")
 		w.log.Println(err)
 		return Error{Code: CodeServerSaveError3, Message: "Add err"}
 	}
 
-	t, e := time.ParseInLocation("2006-01-02T15:04:05.999999999Z", ts, w.loc)
+	// set process time
+	bid.Time = wallClock(ts, w.loc).Truncate(time.Microsecond)
+
+	return nil
+}
+
+// replay load bid saved with the same Bid.RequestID
+func (w *PostgresWarehouse) replay(ctx context.Context, conn *sql.Conn, bid *Bid) error {
+	saved := Bid{Serial: bid.Serial}
+	var serial sql.NullInt64
+	var ts time.Time
+	if err := conn.QueryRowContext(ctx, "SELECT serial, price, sequence, ts FROM "+w.getTableByClient(bid.Client)+" WHERE client = $1 AND request_id = $2", bid.Client, bid.RequestID).Scan(&serial, &saved.Price, &saved.Sequence, &ts); err != nil {
+		w.log.Println("ERR:GetRow")
+		w.log.Println(err)
+		return Error{Code: CodeServerSaveError3, Message: "Add err"}
+	}
+	if serial.Valid {
+		saved.Serial = int(serial.Int64)
+	}
+	saved.Time = wallClock(ts, w.loc).Truncate(time.Microsecond)
+	replayBid(bid, &saved)
+
+	return nil
+}
+
+func (w *PostgresWarehouse) Commit(ctx context.Context, bid *Bid) error {
+	_, e := w.db.ExecContext(ctx, "INSERT INTO "+w.getTableResult()+" (client, price, sequence, serial, ts) VALUES ($1, $2, $3, $4, $5)", bid.Client, bid.Price, bid.Sequence, bid.Serial, sqlTime(bid.Time, w.loc))
 	if e != nil {
+		w.log.Println("ERR:INSERT INTO")
 		w.log.Println(e)
-		return Error{Code: CodeServerSaveError4, Message: "Add err"}
+		return Error{Code: CodeServerSaveError5, Message: "Commit err"}
 	}
 
-	// set process time
-	bid.Time = t.Truncate(time.Microsecond)
-
 	return nil
 }
 
-func (w *PostgresWarehouse) Commit(bid *Bid) error {
-	_, e := w.db.Exec("INSERT INTO "+w.getTableResult()+" (client, price, sequence, ts) VALUES ($1, $2, $3, $4)", bid.Client, bid.Price, bid.Sequence, bid.Time.Format("2006-01-02 15:04:05.000000"))
+func (w *PostgresWarehouse) Withdraw(ctx context.Context, bid *Bid) error {
+	var ts time.Time
+	e := w.db.QueryRowContext(ctx, "INSERT INTO "+w.getTableWithdrawal()+" (client, sequence, ts) VALUES ($1, $2, COALESCE($3::timestamp, "+w.now()+")) RETURNING ts", bid.Client, bid.Sequence, sqlTime(bid.WithdrawTime, w.loc)).Scan(&ts)
 	if e != nil {
 		w.log.Println("ERR:INSERT INTO")
 		w.log.Println(e)
-		return Error{Code: CodeServerSaveError5, Message: "Commit err"}
+		return Error{Code: CodeServerSaveError1, Message: "Withdraw err"}
 	}
 
+	// set withdrawal time
+	bid.WithdrawTime = wallClock(ts, w.loc).Truncate(time.Microsecond)
+
 	return nil
 }
 
-func (w *PostgresWarehouse) Restore(store *Store, c *Config) {
+func (w *PostgresWarehouse) AddCommitment(ctx context.Context, c *Commitment) error {
+	var ts time.Time
+	e := w.db.QueryRowContext(ctx, "INSERT INTO "+w.getTableCommitment()+" (client, hash, ts) VALUES ($1, $2, COALESCE($3::timestamp, "+w.now()+")) ON CONFLICT (client) DO NOTHING RETURNING ts", c.Client, c.Hash, sqlTime(c.Time, w.loc)).Scan(&ts)
+	if e == sql.ErrNoRows {
+		// saved by previous attempt
+		e = w.db.QueryRowContext(ctx, "SELECT ts FROM "+w.getTableCommitment()+" WHERE client = $1", c.Client).Scan(&ts)
+	}
+	if e != nil && ctx.Err() != nil {
+		return contextError(ctx.Err())
+	} else if e != nil {
+		w.log.Println("ERR:INSERT INTO")
+		w.log.Println(e)
+		return Error{Code: CodeServerSaveError1, Message: "Commitment err"}
+	}
+
+	// set commitment time
+	c.Time = wallClock(ts, w.loc).Truncate(time.Microsecond)
+
+	return nil
+}
+
+func (w *PostgresWarehouse) Restore(store *Store, c *Config) error {
 	pageSize := 1000
 
+	// restore commitments before bids revealing them
+	if err := w.restoreCommitments(store, c); err != nil {
+		return err
+	}
+
 	for t := 0; t < TableShards; t++ {
 		id := 0
 		for {
 			curI := 0
-			rows, err := w.db.Query("SELECT id,client,price,sequence,ts FROM "+w.table+fmt.Sprintf("%04d", t)+" WHERE id > $1 ORDER BY id ASC LIMIT "+strconv.Itoa(pageSize), id)
+			rows, err := w.db.Query("SELECT id,client,price,sequence,request_id,serial,source_ip,ts FROM "+w.table+fmt.Sprintf("%04d", t)+" WHERE id > $1 ORDER BY id ASC LIMIT "+strconv.Itoa(pageSize), id)
+			if err != nil {
+				return err
+			}
 			for rows.Next() {
 				bid := &Bid{Active: true}
-				var ts string
-				err := rows.Scan(&id, &bid.Client, &bid.Price, &bid.Sequence, &ts)
-				if err != nil {
-					log.Fatal(err)
-				}
-				t, e := time.ParseInLocation("2006-01-02T15:04:05.999999999Z", ts, w.loc)
-				if e != nil {
-					log.Fatal(err)
+				var ts time.Time
+				var requestID, sourceIP sql.NullString
+				var serial sql.NullInt64
+				if err := rows.Scan(&id, &bid.Client, &bid.Price, &bid.Sequence, &requestID, &serial, &sourceIP, &ts); err != nil {
+					rows.Close()
+					return err
 				}
-				bid.Time = t.Truncate(time.Microsecond)
+				bid.Time = wallClock(ts, w.loc).Truncate(time.Microsecond)
+				bid.RequestID = requestID.String
+				bid.Serial = int(serial.Int64)
+				bid.SourceIP = sourceIP.String
 				if bid.Sequence == 1 && bid.Time.After(c.StartTime) && bid.Time.Before(c.HalfTime) {
 					store.Add(bid)
 				} else if bid.Sequence > 1 && bid.Time.After(c.HalfTime) && bid.Time.Before(c.EndTime) {
@@ -196,9 +343,8 @@ func (w *PostgresWarehouse) Restore(store *Store, c *Config) {
 
 				curI++
 			}
-			err = rows.Err()
-			if err != nil {
-				log.Fatal(err)
+			if err := rows.Err(); err != nil {
+				return err
 			}
 
 			if curI < pageSize {
@@ -206,6 +352,50 @@ func (w *PostgresWarehouse) Restore(store *Store, c *Config) {
 			}
 		}
 	}
+
+	// apply withdrawals after all bids restored
+	rows, err := w.db.Query("SELECT client,sequence,ts FROM " + w.getTableWithdrawal() + " ORDER BY id ASC")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var client, sequence int
+		var ts time.Time
+		if err := rows.Scan(&client, &sequence, &ts); err != nil {
+			return err
+		}
+		t := wallClock(ts, w.loc)
+		if t.After(c.HalfTime) && t.Before(c.EndTime) {
+			store.Withdraw(client, sequence)
+		}
+	}
+	return rows.Err()
+}
+
+func (w *PostgresWarehouse) restoreCommitments(store *Store, c *Config) error {
+	rows, err := w.db.Query("SELECT client,hash,ts FROM " + w.getTableCommitment() + " ORDER BY id ASC")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		cm := &Commitment{}
+		var ts time.Time
+		if err := rows.Scan(&cm.Client, &cm.Hash, &ts); err != nil {
+			return err
+		}
+		cm.Time = wallClock(ts, w.loc).Truncate(time.Microsecond)
+		if cm.Time.After(c.StartTime) && cm.Time.Before(c.HalfTime) {
+			store.AddCommitment(cm)
+		}
+	}
+	return rows.Err()
+}
+
+// now return SQL of current time in w.loc, TIMESTAMP has no time zone
+func (w *PostgresWarehouse) now() string {
+	return "(now() AT TIME ZONE '" + w.loc.String() + "')"
 }
 
 func (w *PostgresWarehouse) getTableByClient(client int) string {
@@ -216,7 +406,19 @@ func (w *PostgresWarehouse) getTableResult() string {
 	return w.table + "f"
 }
 
+func (w *PostgresWarehouse) getTableWithdrawal() string {
+	return w.table + "w"
+}
+
+func (w *PostgresWarehouse) getTableCommitment() string {
+	return w.table + "c"
+}
+
+// MysqlWarehouse read and write TIMESTAMP in session time_zone, which must be Asia/Shanghai,
+// eg, time_zone=%27Asia%2FShanghai%27 in MYSQL_DSN
 type MysqlWarehouse struct {
+	Engine string // storage engine of tables, eg, MyISAM, InnoDB, set before Initialize, "" for MyISAM
+
 	table string // table prefix
 	db    *sql.DB
 	loc   *time.Location
@@ -235,31 +437,22 @@ func NewMysqlWarehouse(table string, db *sql.DB, logger *log.Logger) *MysqlWareh
 func (w *MysqlWarehouse) Initialize() {
 	w.once.Do(func() {
 		w.loc, _ = time.LoadLocation("Asia/Shanghai")
-		for i := 0; i < TableShards; i++ {
-			_, err := w.db.Exec(fmt.Sprintf(`CREATE TABLE %s (
-			id INT(10) UNSIGNED NOT NULL AUTO_INCREMENT,
-			client INT(10) UNSIGNED NOT NULL,
-			price INT(10) UNSIGNED NOT NULL,
-			sequence TINYINT(3) UNSIGNED NOT NULL,
-			ts TIMESTAMP(6) DEFAULT CURRENT_TIMESTAMP(6),
-			PRIMARY KEY (id)) ENGINE = MyISAM;`, w.table+fmt.Sprintf("%04d", i)))
-
-			if err != nil {
-				w.log.Panicln(err)
-			}
+		if w.Engine == "" {
+			w.Engine = "MyISAM"
 		}
-
-		_, err := w.db.Exec(fmt.Sprintf(`CREATE TABLE %s (
-			id INT(10) UNSIGNED NOT NULL AUTO_INCREMENT,
-			client INT(10) UNSIGNED NOT NULL,
-			price INT(10) UNSIGNED NOT NULL,
-			sequence TINYINT(3) UNSIGNED NOT NULL,
+		if !IsValidEngine(w.Engine) {
+			w.log.Panicln("invalid engine " + w.Engine)
+		}
+		s := newSchema(w.table, w.Engine)
+		version, err := migrate(w.db, s, mysqlMigrations, `CREATE TABLE IF NOT EXISTS `+s.version+` (
+			version INT(10) UNSIGNED NOT NULL,
+			description VARCHAR(255),
 			ts TIMESTAMP(6) DEFAULT CURRENT_TIMESTAMP(6),
-			PRIMARY KEY (id)) ENGINE = MyISAM;`, w.getTableResult()))
-
+			PRIMARY KEY (version)) ENGINE = InnoDB;`, false)
 		if err != nil {
 			w.log.Panicln(err)
 		}
+		w.log.Printf("Warehouse schema version %d, engine %s", version, w.Engine)
 	})
 }
 
@@ -267,24 +460,35 @@ func (w *MysqlWarehouse) Terminate() {
 	w.db.Close()
 }
 
-func (w *MysqlWarehouse) Add(bid *Bid) error {
-	ctx := context.Background()
+func (w *MysqlWarehouse) Add(ctx context.Context, bid *Bid) error {
 	conn, err := w.db.Conn(ctx)
-	defer conn.Close()
-
 	if err != nil {
+		if ctx.Err() != nil {
+			return contextError(ctx.Err())
+		}
 		w.log.Println("ERR:GetConn")
 		w.log.Println(err)
 		return Error{Code: CodeServerSaveError0, Message: "Add err"}
 	}
+	defer conn.Close()
 
-	r, err := conn.ExecContext(ctx, "INSERT INTO "+w.getTableByClient(bid.Client)+" (client, price, sequence) VALUES (?, ?, ?)", bid.Client, bid.Price, bid.Sequence)
-	if err != nil {
+	r, err := conn.ExecContext(ctx, "INSERT INTO "+w.getTableByClient(bid.Client)+" (client, price, sequence, request_id, serial, source_ip, ts) VALUES (?, ?, ?, ?, ?, ?, COALESCE(?, CURRENT_TIMESTAMP(6)))", bid.Client, bid.Price, bid.Sequence, nullString(bid.RequestID), bid.Serial, nullString(bid.SourceIP), sqlTime(bid.Time, w.loc))
+	if err != nil && isDuplicateEntry(err) {
+		// saved by previous attempt
+		return w.replay(ctx, conn, bid)
+	} else if err != nil && ctx.Err() != nil {
+		return contextError(ctx.Err())
+	} else if err != nil {
 		w.log.Println("ERR:INSERT INTO")
 		w.log.Println(err)
 		return Error{Code: CodeServerSaveError1, Message: "Add err"}
 	}
 
+	if !bid.Time.IsZero() {
+		// decided by TimeSource
+		return nil
+	}
+
 	l, err := r.LastInsertId()
 	if err != nil {
 		w.log.Println("ERR:LastInsertId")
@@ -311,8 +515,32 @@ func (w *MysqlWarehouse) Add(bid *Bid) error {
 	return nil
 }
 
-func (w *MysqlWarehouse) Commit(bid *Bid) error {
-	_, e := w.db.Exec("INSERT INTO "+w.getTableResult()+" (client, price, sequence, ts) VALUES (?, ?, ?, ?)", bid.Client, bid.Price, bid.Sequence, bid.Time.Format("2006-01-02 15:04:05.000000"))
+// replay load bid saved with the same Bid.RequestID
+func (w *MysqlWarehouse) replay(ctx context.Context, conn *sql.Conn, bid *Bid) error {
+	saved := Bid{Serial: bid.Serial}
+	var serial sql.NullInt64
+	var ts string
+	if err := conn.QueryRowContext(ctx, "SELECT serial, price, sequence, ts FROM "+w.getTableByClient(bid.Client)+" WHERE client = ? AND request_id = ?", bid.Client, bid.RequestID).Scan(&serial, &saved.Price, &saved.Sequence, &ts); err != nil {
+		w.log.Println("ERR:GetRow")
+		w.log.Println(err)
+		return Error{Code: CodeServerSaveError3, Message: "Add err"}
+	}
+	if serial.Valid {
+		saved.Serial = int(serial.Int64)
+	}
+	t, e := time.ParseInLocation("2006-01-02 15:04:05.000000", ts, w.loc)
+	if e != nil {
+		w.log.Println(e)
+		return Error{Code: CodeServerSaveError4, Message: "Add err"}
+	}
+	saved.Time = t.Truncate(time.Microsecond)
+	replayBid(bid, &saved)
+
+	return nil
+}
+
+func (w *MysqlWarehouse) Commit(ctx context.Context, bid *Bid) error {
+	_, e := w.db.ExecContext(ctx, "INSERT INTO "+w.getTableResult()+" (client, price, sequence, serial, ts) VALUES (?, ?, ?, ?, ?)", bid.Client, bid.Price, bid.Sequence, bid.Serial, sqlTime(bid.Time, w.loc))
 	if e != nil {
 		w.log.Println("ERR:INSERT INTO")
 		w.log.Println(e)
@@ -322,26 +550,113 @@ func (w *MysqlWarehouse) Commit(bid *Bid) error {
 	return nil
 }
 
-func (w *MysqlWarehouse) Restore(store *Store, c *Config) {
+func (w *MysqlWarehouse) Withdraw(ctx context.Context, bid *Bid) error {
+	r, e := w.db.ExecContext(ctx, "INSERT INTO "+w.getTableWithdrawal()+" (client, sequence, ts) VALUES (?, ?, COALESCE(?, CURRENT_TIMESTAMP(6)))", bid.Client, bid.Sequence, sqlTime(bid.WithdrawTime, w.loc))
+	if e != nil {
+		w.log.Println("ERR:INSERT INTO")
+		w.log.Println(e)
+		return Error{Code: CodeServerSaveError1, Message: "Withdraw err"}
+	}
+
+	if !bid.WithdrawTime.IsZero() {
+		return nil
+	}
+
+	l, e := r.LastInsertId()
+	if e != nil {
+		w.log.Println("ERR:LastInsertId")
+		w.log.Println(e)
+		return Error{Code: CodeServerSaveError2, Message: "Withdraw err"}
+	}
+
+	var ts string
+	if e := w.db.QueryRowContext(ctx, "SELECT ts FROM "+w.getTableWithdrawal()+" WHERE id = ? LIMIT 1", l).Scan(&ts); e != nil {
+		w.log.Println("ERR:GetRow")
+		w.log.Println(e)
+		return Error{Code: CodeServerSaveError3, Message: "Withdraw err"}
+	}
+
+	t, e := time.ParseInLocation("2006-01-02 15:04:05.000000", ts, w.loc)
+	if e != nil {
+		w.log.Println(e)
+		return Error{Code: CodeServerSaveError4, Message: "Withdraw err"}
+	}
+
+	// set withdrawal time
+	bid.WithdrawTime = t.Truncate(time.Microsecond)
+
+	return nil
+}
+
+func (w *MysqlWarehouse) AddCommitment(ctx context.Context, c *Commitment) error {
+	_, e := w.db.ExecContext(ctx, "INSERT INTO "+w.getTableCommitment()+" (client, hash, ts) VALUES (?, ?, COALESCE(?, CURRENT_TIMESTAMP(6)))", c.Client, c.Hash, sqlTime(c.Time, w.loc))
+	if e != nil && isDuplicateEntry(e) {
+		// saved by previous attempt
+	} else if e != nil && ctx.Err() != nil {
+		return contextError(ctx.Err())
+	} else if e != nil {
+		w.log.Println("ERR:INSERT INTO")
+		w.log.Println(e)
+		return Error{Code: CodeServerSaveError1, Message: "Commitment err"}
+	} else if !c.Time.IsZero() {
+		// decided by TimeSource
+		return nil
+	}
+
+	// one commitment per bidder
+	var ts string
+	if e := w.db.QueryRowContext(ctx, "SELECT ts FROM "+w.getTableCommitment()+" WHERE client = ? LIMIT 1", c.Client).Scan(&ts); e != nil {
+		w.log.Println("ERR:GetRow")
+		w.log.Println(e)
+		return Error{Code: CodeServerSaveError3, Message: "Commitment err"}
+	}
+
+	t, e := time.ParseInLocation("2006-01-02 15:04:05.000000", ts, w.loc)
+	if e != nil {
+		w.log.Println(e)
+		return Error{Code: CodeServerSaveError4, Message: "Commitment err"}
+	}
+
+	// set commitment time
+	c.Time = t.Truncate(time.Microsecond)
+
+	return nil
+}
+
+func (w *MysqlWarehouse) Restore(store *Store, c *Config) error {
 	pageSize := 1000
 
+	// restore commitments before bids revealing them
+	if err := w.restoreCommitments(store, c); err != nil {
+		return err
+	}
+
 	for t := 0; t < TableShards; t++ {
 		id := 0
 		for {
 			curI := 0
-			rows, err := w.db.Query("SELECT id,client,price,sequence,ts FROM "+w.table+fmt.Sprintf("%04d", t)+" WHERE id > ? ORDER BY id ASC LIMIT "+strconv.Itoa(pageSize), id)
+			rows, err := w.db.Query("SELECT id,client,price,sequence,request_id,serial,source_ip,ts FROM "+w.table+fmt.Sprintf("%04d", t)+" WHERE id > ? ORDER BY id ASC LIMIT "+strconv.Itoa(pageSize), id)
+			if err != nil {
+				return err
+			}
 			for rows.Next() {
 				bid := &Bid{Active: true}
 				var ts string
-				err := rows.Scan(&id, &bid.Client, &bid.Price, &bid.Sequence, &ts)
-				if err != nil {
-					log.Fatal(err)
+				var requestID, sourceIP sql.NullString
+				var serial sql.NullInt64
+				if err := rows.Scan(&id, &bid.Client, &bid.Price, &bid.Sequence, &requestID, &serial, &sourceIP, &ts); err != nil {
+					rows.Close()
+					return err
 				}
 				t, e := time.ParseInLocation("2006-01-02 15:04:05.000000", ts, w.loc)
 				if e != nil {
-					log.Fatal(err)
+					rows.Close()
+					return e
 				}
 				bid.Time = t.Truncate(time.Microsecond)
+				bid.RequestID = requestID.String
+				bid.Serial = int(serial.Int64)
+				bid.SourceIP = sourceIP.String
 				if bid.Sequence == 1 && bid.Time.After(c.StartTime) && bid.Time.Before(c.HalfTime) {
 					store.Add(bid)
 				} else if bid.Sequence > 1 && bid.Time.After(c.HalfTime) && bid.Time.Before(c.EndTime) {
@@ -352,9 +667,8 @@ func (w *MysqlWarehouse) Restore(store *Store, c *Config) {
 
 				curI++
 			}
-			err = rows.Err()
-			if err != nil {
-				log.Fatal(err)
+			if err := rows.Err(); err != nil {
+				return err
 			}
 
 			if curI < pageSize {
@@ -362,6 +676,52 @@ func (w *MysqlWarehouse) Restore(store *Store, c *Config) {
 			}
 		}
 	}
+
+	// apply withdrawals after all bids restored
+	rows, err := w.db.Query("SELECT client,sequence,ts FROM " + w.getTableWithdrawal() + " ORDER BY id ASC")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var client, sequence int
+		var ts string
+		if err := rows.Scan(&client, &sequence, &ts); err != nil {
+			return err
+		}
+		t, e := time.ParseInLocation("2006-01-02 15:04:05.000000", ts, w.loc)
+		if e != nil {
+			return e
+		}
+		if t.After(c.HalfTime) && t.Before(c.EndTime) {
+			store.Withdraw(client, sequence)
+		}
+	}
+	return rows.Err()
+}
+
+func (w *MysqlWarehouse) restoreCommitments(store *Store, c *Config) error {
+	rows, err := w.db.Query("SELECT client,hash,ts FROM " + w.getTableCommitment() + " ORDER BY id ASC")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		cm := &Commitment{}
+		var ts string
+		if err := rows.Scan(&cm.Client, &cm.Hash, &ts); err != nil {
+			return err
+		}
+		t, e := time.ParseInLocation("2006-01-02 15:04:05.000000", ts, w.loc)
+		if e != nil {
+			return e
+		}
+		cm.Time = t.Truncate(time.Microsecond)
+		if cm.Time.After(c.StartTime) && cm.Time.Before(c.HalfTime) {
+			store.AddCommitment(cm)
+		}
+	}
+	return rows.Err()
 }
 
 func (w *MysqlWarehouse) getTableByClient(client int) string {
@@ -371,3 +731,43 @@ func (w *MysqlWarehouse) getTableByClient(client int) string {
 func (w *MysqlWarehouse) getTableResult() string {
 	return w.table + "f"
 }
+
+func (w *MysqlWarehouse) getTableWithdrawal() string {
+	return w.table + "w"
+}
+
+func (w *MysqlWarehouse) getTableCommitment() string {
+	return w.table + "c"
+}
+
+// replayBid return the bid saved by previous attempt with the same Bid.RequestID as the outcome of retry
+func replayBid(bid, saved *Bid) {
+	bid.Serial = saved.Serial
+	bid.Price = saved.Price
+	bid.Sequence = saved.Sequence
+	bid.Time = saved.Time
+}
+
+// sqlTime format t as TIMESTAMP in loc, NULL if zero
+func sqlTime(t time.Time, loc *time.Location) sql.NullString {
+	if t.IsZero() {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: t.In(loc).Format("2006-01-02 15:04:05.000000"), Valid: true}
+}
+
+// wallClock read TIMESTAMP without time zone scanned as UTC in loc
+func wallClock(t time.Time, loc *time.Location) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
+}
+
+// nullString save empty string as NULL, NULL never conflicts in unique key
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// isDuplicateEntry check MySQL error 1062 Duplicate entry for unique key
+func isDuplicateEntry(err error) bool {
+	var me *mysql.MySQLError
+	return errors.As(err, &me) && me.Number == 1062
+}